@@ -1,8 +1,14 @@
 package middleware
 
 import (
+	"buylist/api/auth"
 	"buylist/internal"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,6 +25,132 @@ func ValidateBuyList() gin.HandlerFunc {
 			return
 		}
 
+		if len(buyList.Reminders) > 0 && buyList.ScheduledFor == nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Reminders require the list to have a ScheduledFor date",
+			})
+			return
+		}
+
 		c.Set("buyList", buyList)
 	}
 }
+
+// RequireListOwner answers 404 Not Found when the list of the id param doesn't
+// exist or isn't of the authenticated user. It must run after ValidateId.
+func RequireListOwner(service *internal.BuyListService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := service.Owned(c.MustGet("idNum").(uint64), auth.UserID(c.Request))
+		if errors.Is(err, internal.ErrBuyListNotFound) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+}
+
+// Parse an ISO 8601 date of a query param. Dates without time on the end of
+// a range include the whole day.
+func parseDateParam(name string, value string, end bool) (*time.Time, error) {
+	date, err := internal.ParseISODate(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid date passed on %s parameter, must be on ISO 8601 format", name)
+	}
+	if end && len(value) == len("2006-01-02") {
+		date = date.AddDate(0, 0, 1)
+	}
+
+	return &date, nil
+}
+
+// ValidateBuyListFilter reads the search params of buylists and sets filter.
+func ValidateBuyListFilter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := internal.BuyListFilter{
+			Title:      c.Query("title"),
+			Ingredient: c.Query("ingredient"),
+			Category:   c.Query("category"),
+		}
+		abort := func(err error) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+
+		if createdAtStr := c.Query("created_at"); createdAtStr != "" {
+			createdAtDate, err := time.Parse("02/01/2006", createdAtStr)
+			if err != nil {
+				abort(errors.New("Invalid date passed on created_at parameter"))
+				return
+			}
+			filter.CreatedAt.Scan(createdAtDate)
+		}
+
+		for _, param := range []struct {
+			name   string
+			end    bool
+			target **time.Time
+		}{
+			{"created_from", false, &filter.CreatedFrom},
+			{"created_to", true, &filter.CreatedTo},
+			{"updated_since", false, &filter.UpdatedSince},
+		} {
+			if value := c.Query(param.name); value != "" {
+				date, err := parseDateParam(param.name, value, param.end)
+				if err != nil {
+					abort(err)
+					return
+				}
+				*param.target = date
+			}
+		}
+
+		// interval on ISO 8601 format: start/end
+		if between := c.Query("scheduled_between"); between != "" {
+			dates := strings.Split(between, "/")
+			if len(dates) != 2 {
+				abort(errors.New("Invalid scheduled_between parameter, must be two ISO 8601 dates as start/end"))
+				return
+			}
+			var err error
+			if filter.ScheduledFrom, err = parseDateParam("scheduled_between", dates[0], false); err != nil {
+				abort(err)
+				return
+			}
+			if filter.ScheduledTo, err = parseDateParam("scheduled_between", dates[1], true); err != nil {
+				abort(err)
+				return
+			}
+		}
+
+		if ingredientID := c.Query("ingredient_id"); ingredientID != "" {
+			id, err := strconv.ParseUint(ingredientID, 10, 32)
+			if err != nil {
+				abort(errors.New("Invalid ingredient identifier passed on ingredient_id parameter"))
+				return
+			}
+			filter.IngredientID = uint(id)
+		}
+
+		if completedStr := c.Query("completed"); completedStr != "" {
+			completed, err := strconv.ParseBool(completedStr)
+			if err != nil {
+				abort(errors.New("Invalid completed parameter, must be true or false"))
+				return
+			}
+			filter.Completed = &completed
+		}
+
+		if expression := c.Query("filter"); expression != "" {
+			parsed, err := internal.ParseFilter(expression)
+			if err != nil {
+				abort(err)
+				return
+			}
+			filter.Expression = parsed
+		}
+
+		c.Set("filter", filter)
+	}
+}
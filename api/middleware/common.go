@@ -11,9 +11,22 @@ func ValidateId() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		idNum, err := strconv.ParseUint(c.Param("id"), 10, 32)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		c.Set("idNum", idNum)
 	}
 }
+
+func ValidateItemId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		itemIdNum, err := strconv.ParseUint(c.Param("item"), 10, 32)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid item identifier"})
+			return
+		}
+
+		c.Set("itemIdNum", itemIdNum)
+	}
+}
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ETag of a version of a resource.
+func ETag(version uint) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// ETag of a representation of a version of a resource. Variant tells apart
+// representations of the same version, like the ones with other relations
+// loaded, the version is still read from it by If-Match.
+func VariantETag(version uint, variant string) string {
+	sum := sha256.Sum256([]byte(variant))
+	return fmt.Sprintf("\"%d-%s\"", version, hex.EncodeToString(sum[:8]))
+}
+
+// Parse the version of an entity tag, weak tags are accepted.
+func parseETag(tag string) (uint, bool) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+
+	versionStr, _, _ := strings.Cut(tag[1:len(tag)-1], "-")
+	version, err := strconv.ParseUint(versionStr, 10, 32)
+	if err != nil || version == 0 {
+		return 0, false
+	}
+
+	return uint(version), true
+}
+
+// ValidateIfMatch reads the If-Match header and sets ifMatch with the version
+// the request is based on. Requests without the header or with "*" don't set
+// it. Tags that can't match any version fail with 412 Precondition Failed.
+func ValidateIfMatch() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := strings.TrimSpace(c.GetHeader("If-Match"))
+		if header == "" || header == "*" {
+			return
+		}
+
+		version, ok := parseETag(header)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "If-Match doesn't match the resource"})
+			return
+		}
+
+		c.Set("ifMatch", version)
+	}
+}
+
+// NotModified sets the ETag and Last-Modified headers of the resource and
+// answers 304 Not Modified when the client already has this representation,
+// by If-None-Match or, without it, If-Modified-Since. Returns true when the
+// request was answered.
+func NotModified(c *gin.Context, etag string, modified time.Time) bool {
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+
+	notModified := false
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			// weak comparison, as for GET and HEAD
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				notModified = true
+			}
+		}
+	} else if ifModifiedSince := c.GetHeader("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		// dates on header have only seconds
+		notModified = err == nil && !modified.Truncate(time.Second).After(since)
+	}
+
+	if notModified {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+	}
+
+	return notModified
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"buylist/internal"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const MaxPageLimit = 500
+
+// Normalize field names so id, ID, created_at and CreatedAt are the same.
+func normalizeField(name string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), "_", ""))
+}
+
+// ValidatePage reads the limit, cursor and sort params of collection
+// requests, setting page, and the fields param, setting fields with the JSON
+// fields of model to answer. Sort accepts only sortFields.
+func ValidatePage(sortFields []string, model interface{}) gin.HandlerFunc {
+	data, _ := json.Marshal(model)
+	var members map[string]interface{}
+	json.Unmarshal(data, &members)
+	modelFields := map[string]string{}
+	for member := range members {
+		modelFields[normalizeField(member)] = member
+	}
+
+	return func(c *gin.Context) {
+		var page internal.Page
+		if limit := c.Query("limit"); limit != "" {
+			limitNum, err := strconv.Atoi(limit)
+			if err != nil || limitNum < 1 || limitNum > MaxPageLimit {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("Invalid limit, must be between 1 and %d", MaxPageLimit),
+				})
+				return
+			}
+			page.Limit = limitNum
+		}
+
+		sort, err := internal.ParseSort(c.Query("sort"), sortFields)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		page.Sort = sort
+		page.Cursor = c.Query("cursor")
+		if page.Cursor != "" && page.Limit == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cursor requires a limit"})
+			return
+		}
+		c.Set("page", page)
+
+		fields := []string{}
+		for _, field := range strings.Split(c.Query("fields"), ",") {
+			if strings.TrimSpace(field) == "" {
+				continue
+			}
+			member, exists := modelFields[normalizeField(field)]
+			if !exists {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid field " + field})
+				return
+			}
+			fields = append(fields, member)
+		}
+		c.Set("fields", fields)
+	}
+}
+
+// SelectsField reports if the field is on the fields param, every field is
+// selected when the param is empty.
+func SelectsField(c *gin.Context, field string) bool {
+	fields := c.GetStringSlice("fields")
+	if len(fields) == 0 {
+		return true
+	}
+	for _, selected := range fields {
+		if normalizeField(selected) == normalizeField(field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WritePage answers with the rows of a page, only with the fields selected.
+// The total of rows is sent on X-Total-Count header and the next page, when
+// there is one, on the Link header.
+func WritePage(c *gin.Context, rows interface{}, result internal.PageResult) {
+	c.Header("X-Total-Count", strconv.FormatInt(result.Total, 10))
+	if result.Next != "" {
+		next := *c.Request.URL
+		query := next.Query()
+		query.Set("cursor", result.Next)
+		next.RawQuery = query.Encode()
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+
+	fields := c.GetStringSlice("fields")
+	if len(fields) == 0 {
+		c.JSON(http.StatusOK, rows)
+		return
+	}
+
+	data, err := json.Marshal(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var members []map[string]interface{}
+	json.Unmarshal(data, &members)
+
+	selected := make([]map[string]interface{}, len(members))
+	for i, row := range members {
+		selected[i] = map[string]interface{}{}
+		for _, field := range fields {
+			selected[i][field] = row[field]
+		}
+	}
+	c.JSON(http.StatusOK, selected)
+}
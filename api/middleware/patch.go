@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"buylist/internal/patch"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ValidatePatch parses the body of PATCH requests as a JSON Merge Patch or
+// JSON Patch, according to the Content-Type, and sets it on patch.
+func ValidatePatch() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if contentType != patch.MergePatchType && contentType != patch.JSONPatchType {
+			c.Header("Accept-Patch", patch.MergePatchType+", "+patch.JSONPatchType)
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{
+				"error": "Patch must be " + patch.MergePatchType + " or " + patch.JSONPatchType,
+			})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		parsed, err := patch.Parse(contentType, body)
+		if err != nil {
+			PatchError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		c.Set("patch", parsed)
+	}
+}
+
+// PatchError answers with the error, including the operation and path
+// where the patch failed when known.
+func PatchError(c *gin.Context, status int, err error) {
+	var patchErr *patch.Error
+	if !errors.As(err, &patchErr) {
+		c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"error": patchErr.Error(), "path": patchErr.Path}
+	if patchErr.Operation >= 0 {
+		response["operation"] = patchErr.Operation
+	}
+	c.AbortWithStatusJSON(status, response)
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"buylist/api/auth"
+	"buylist/internal"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ValidateReportFilter reads the params selecting the purchases of reports
+// and sets reportFilter, limited to the lists of the authenticated user.
+func ValidateReportFilter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := internal.ReportFilter{Owner: auth.UserID(c.Request)}
+		for _, param := range []struct {
+			name   string
+			end    bool
+			target **time.Time
+		}{
+			{"from", false, &filter.From},
+			{"to", true, &filter.To},
+		} {
+			if value := c.Query(param.name); value != "" {
+				date, err := parseDateParam(param.name, value, param.end)
+				if err != nil {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				*param.target = date
+			}
+		}
+
+		if format := c.DefaultQuery("format", "json"); format != "json" && format != "csv" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid format, must be json or csv"})
+			return
+		}
+
+		c.Set("reportFilter", filter)
+	}
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ValidateSuggestionParams reads how many days ahead suggestions are due,
+// 2 by default, and their minimum confidence, and sets days and minConfidence.
+func ValidateSuggestionParams() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		days, err := strconv.Atoi(c.DefaultQuery("days", "2"))
+		if err != nil || days < 0 || days > 365 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid days, must be between 0 and 365"})
+			return
+		}
+
+		minConfidence, err := strconv.ParseFloat(c.DefaultQuery("min_confidence", "0"), 64)
+		if err != nil || minConfidence < 0 || minConfidence > 1 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid min_confidence, must be between 0 and 1"})
+			return
+		}
+
+		c.Set("days", days)
+		c.Set("minConfidence", minConfidence)
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"buylist/internal"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireWhatsApp rejects the request when WhatsApp notifications are not configured.
+func RequireWhatsApp(whatsapp *internal.WhatsAppNotifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if whatsapp == nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "WhatsApp notifications are not configured",
+			})
+			return
+		}
+	}
+}
+
+// ValidateWhatsAppSignature checks the X-Hub-Signature-256 header sent by the
+// provider on callbacks. Callbacks are rejected while WHATSAPP_APP_SECRET is
+// not configured, as they couldn't be told apart from forged ones.
+func ValidateWhatsAppSignature() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := os.Getenv("WHATSAPP_APP_SECRET")
+		if secret == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "WhatsApp callbacks are not configured",
+			})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(c.GetHeader("X-Hub-Signature-256"))) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+			return
+		}
+	}
+}
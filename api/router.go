@@ -3,7 +3,9 @@ package api
 import (
 	"buylist/api/auth"
 	"buylist/api/login"
+	"buylist/internal"
 	"os"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
@@ -13,7 +15,7 @@ import (
 	"gorm.io/gorm"
 )
 
-func GetRouter(databaseConnection *gorm.DB, auth *auth.Authenticator) *gin.Engine {
+func GetRouter(databaseConnection *gorm.DB, auth *auth.Authenticator, notifier internal.Notifier, whatsapp *internal.WhatsAppNotifier) *gin.Engine {
 	// init router
 	gin.SetMode(os.Getenv("GIN_MODE"))
 	router := gin.Default()
@@ -23,10 +25,28 @@ func GetRouter(databaseConnection *gorm.DB, auth *auth.Authenticator) *gin.Engin
 	store := cookie.NewStore([]byte("secret"))
 	router.Use(sessions.Sessions("auth-session", store))
 
+	// events published by services are sent to webhooks and list streams
+	events := &internal.EventBus{}
+	dispatcher := &internal.WebhookDispatcher{Database: databaseConnection}
+	events.Subscribe(dispatcher.Dispatch)
+	hub := internal.NewListHub(100, time.Hour)
+	events.Subscribe(hub.Publish)
+
 	api := router.Group("/api")
 	{
-		GetIngredientRoutes(api, databaseConnection)
-		GetBuyListRoutes(api, databaseConnection)
+		GetIngredientRoutes(api, databaseConnection, events)
+		GetBuyListRoutes(api, databaseConnection, events, notifier, hub)
+		GetSettingsRoutes(api, databaseConnection, whatsapp)
+		GetWhatsAppRoutes(api, whatsapp)
+		GetWebhookRoutes(api, databaseConnection, dispatcher)
+		GetSyncRoutes(api, databaseConnection, events)
+		GetSearchRoutes(api, databaseConnection)
+		GetTrashRoutes(api, databaseConnection, events)
+		GetStoreRoutes(api, databaseConnection)
+		GetReportRoutes(api, databaseConnection)
+		GetSuggestionRoutes(api, databaseConnection, events)
+		GetCalendarRoutes(api, databaseConnection)
+		GetArchiveRoutes(api, databaseConnection, events)
 		api.GET("/login", login.Handler(auth))
 	}
 
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/internal"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+// ExportAccount godoc
+// @Summary Export the data of the user
+// @Description Returns an archive with the buylists of the authenticated user, with their items and
+// reminders, the ingredients used by the items and the settings, to be restored by the import.
+// Ingredients are shared by every user, so only the ones on the lists are exported.
+// Phone numbers, webhooks, calendar tokens and prices aren't exported. The archive has a Version
+// increased on incompatible changes of its format.
+// With format zip the JSON archive is compressed on a ZIP file.
+// @Produces json
+// @Produces application/zip
+// @Sucess 200 {object} internal.Archive
+// @Failure 400
+// @Failure 500
+// @Router /api/export [get]
+// @Param format query string false "json, by default, or zip"
+func ExportAccount(c *gin.Context, service *internal.ArchiveService) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "zip" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format, must be json or zip"})
+		return
+	}
+
+	archive, err := service.Export(auth.UserID(c.Request))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename := fmt.Sprintf("buylist-export-%s", archive.ExportedAt.Format("20060102"))
+	if format == "json" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, filename))
+		c.JSON(http.StatusOK, archive)
+		return
+	}
+
+	var file bytes.Buffer
+	if err := archive.WriteZip(&file); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, filename))
+	c.Data(http.StatusOK, "application/zip", file.Bytes())
+}
+
+// ImportAccount godoc
+// @Summary Import the data of the user
+// @Description Receives an archive of the export, as JSON or ZIP, and restores it for the authenticated
+// user, on this or another instance. Lists are created with new identifiers, Lists of the answer maps
+// the identifiers of the archive to them, so importing twice duplicates the lists. Ingredients are found
+// by name or alias and only the missing ones are created. Settings on the archive replace the current ones.
+// Reminders not sent that were due before the import are dropped.
+// @Accepts json
+// @Accepts application/zip
+// @Produces json
+// @Sucess 201 {object} internal.ArchiveImportResult
+// @Failure 400
+// @Failure 500
+// @Router /api/import [post]
+func ImportAccount(c *gin.Context, service *internal.ArchiveService) {
+	archive, err := internal.ReadArchive(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := service.Import(archive, auth.UserID(c.Request))
+	if errors.Is(err, internal.ErrInvalidArchive) || errors.Is(err, internal.ErrInvalidBudget) || errors.Is(err, internal.ErrInvalidEmail) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, result)
+}
+
+func GetArchiveRoutes(group *gin.RouterGroup, db *gorm.DB, events *internal.EventBus) {
+	service := internal.ArchiveService{Database: db, Events: events}
+	archive := group.Group("")
+	{
+		archive.Use(adapter.Wrap(auth.EnsureValidToken()))
+		archive.GET("/export", func(c *gin.Context) {
+			ExportAccount(c, &service)
+		})
+		archive.POST("/import", func(c *gin.Context) {
+			ImportAccount(c, &service)
+		})
+	}
+}
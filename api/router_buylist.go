@@ -1,21 +1,34 @@
 package api
 
 import (
+	"buylist/api/auth"
 	"buylist/api/middleware"
 	"buylist/internal"
-	"database/sql"
+	"buylist/internal/patch"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
 	"gorm.io/gorm"
 )
 
 // GetBuyList godoc
 // @Summary Find buylists
-// @Description Search buylists, by default returns all lists on database.
+// @Description Search the buylists of the authenticated user, by default returns all of them.
 // Using query params will search for buylists that match them.
+// With limit the lists are paginated, the Link header has the next page and X-Total-Count
+// the total of lists found.
 // @Produces json
 // @Sucess 200 {array} []internal.BuyList
 // @Failure 400
@@ -23,42 +36,198 @@ import (
 // @Router /api/buylist [get]
 // @Param title query string false "buylist title"
 // @Param created_at query string false "buylist creation date in dd/mm/yyyy format"
+// @Param created_from query string false "lists created since the ISO 8601 date"
+// @Param created_to query string false "lists created before the ISO 8601 date, a date without time includes the day"
+// @Param updated_since query string false "lists updated since the ISO 8601 date"
+// @Param scheduled_between query string false "lists scheduled on the ISO 8601 interval start/end"
+// @Param ingredient_id query int false "lists with an item of the ingredient"
+// @Param ingredient query string false "lists with an item of the ingredient name"
+// @Param category query string false "lists with an item of the ingredient category"
+// @Param completed query bool false "lists with every item purchased or not"
+// @Param filter query string false "expression on title, owner, created_at, updated_at, scheduled_for, completed and has(ingredient or category: value) combined by and, or, not"
+// @Param limit query int false "max lists on the page"
+// @Param cursor query string false "cursor of the page, from the Link header of the previous page"
+// @Param sort query string false "comma separated fields to sort by, prefixed by - on descending order: id, title, created_at, updated_at"
+// @Param fields query string false "comma separated fields of the lists to answer"
 func GetBuyList(c *gin.Context, service *internal.BuyListService) {
-	title := c.Query("title")
-	createdAtStr := c.Query("created_at")
+	page := c.MustGet("page").(internal.Page)
+	filter := c.MustGet("filter").(internal.BuyListFilter)
+	filter.Owner = auth.UserID(c.Request)
 
-	var createdAt sql.NullTime
-	if createdAtStr != "" {
-		createdAtDate, err := time.Parse("02/01/2006", createdAtStr)
-		if err != nil {
+	lists, result, err := service.FindPage(filter, page, middleware.SelectsField(c, "Items"))
+
+	if errors.Is(err, internal.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	middleware.WritePage(c, lists, result)
+}
+
+// GetBuyListById godoc
+// @Summary Get a buylist
+// @Description Returns the buylist with its items and their ingredients. The include param
+// chooses the relations loaded: items, items.ingredient and reminders.
+// With the store param items are sorted in the walking order of the store and grouped by aisle
+// on Sections, items of categories without aisle on the store are on the unsorted section.
+// Answers 304 when the list didn't change since the If-None-Match or If-Modified-Since headers.
+// The Accept header chooses the representation: JSON, text/markdown with a checkbox list by
+// category, text/plain with a compact list, text/html with a page to be printed or
+// application/pdf with an A4 document with the estimated price of each item in its unit, on one or two
+// columns by the columns param, by default two when the list doesn't fit on one page.
+// @Produces json
+// @Produces text/markdown
+// @Produces text/plain
+// @Produces text/html
+// @Produces application/pdf
+// @Sucess 200 {object} internal.BuyList
+// @Failure 304
+// @Failure 400
+// @Failure 404
+// @Failure 406
+// @Failure 500
+// @Router /api/buylist/{id} [get]
+// @Param id path int true "buylist identifier"
+// @Param include query string false "comma separated relations to load, by default items,items.ingredient"
+// @Param store query int false "identifier of a store of the user to sort the items by"
+// @Param If-None-Match header string false "ETag of the list version the client has"
+// @Param If-Modified-Since header string false "date of the list version the client has"
+// @Param columns query int false "columns of the PDF, 1 or 2"
+// @Param Accept header string false "application/json, text/markdown, text/plain, text/html or application/pdf"
+func GetBuyListById(c *gin.Context, service *internal.BuyListService, stores *internal.StoreService, prices *internal.PriceService) {
+	idNum := c.MustGet("idNum").(uint64)
+
+	c.Header("Vary", "Accept")
+	format := c.NegotiateFormat(gin.MIMEJSON, internal.MediaMarkdown, internal.MediaText, internal.MediaHTML, internal.MediaPDF)
+	if format == "" {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"error": fmt.Sprintf("Can't answer on the Accept types, must be one of %s, %s, %s, %s or %s",
+				gin.MIMEJSON, internal.MediaMarkdown, internal.MediaText, internal.MediaHTML, internal.MediaPDF),
+		})
+		return
+	}
+
+	columns := 0
+	if columnsStr := c.Query("columns"); columnsStr != "" {
+		if columnsStr != "1" && columnsStr != "2" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid columns, must be 1 or 2"})
+			return
+		}
+		columns, _ = strconv.Atoi(columnsStr)
+	}
+
+	include := []string{internal.IncludeItems, internal.IncludeItemsIngredient}
+	if includeStr, exists := c.GetQuery("include"); exists {
+		include = []string{}
+		for _, relation := range strings.Split(includeStr, ",") {
+			if relation = strings.TrimSpace(relation); relation != "" {
+				include = append(include, relation)
+			}
+		}
+	}
+	for _, relation := range include {
+		if !slices.Contains(internal.BuyListIncludes, relation) {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "Invalid date passed on created_at parameter",
+				"error": fmt.Sprintf("Invalid include %s, must be one of %s", relation, strings.Join(internal.BuyListIncludes, ",")),
 			})
 			return
 		}
+	}
 
-		createdAt.Scan(createdAtDate)
+	var store internal.Store
+	if storeStr := c.Query("store"); storeStr != "" {
+		storeID, err := strconv.ParseUint(storeStr, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid store identifier"})
+			return
+		}
+		store, err = stores.Get(auth.UserID(c.Request), storeID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	// the route and the renderings need the ingredient of every item
+	if store.ID != 0 || format != gin.MIMEJSON {
+		for _, relation := range []string{internal.IncludeItems, internal.IncludeItemsIngredient} {
+			if !slices.Contains(include, relation) {
+				include = append(include, relation)
+			}
+		}
 	}
 
-	var lists []internal.BuyList
-	var err error
-	if title != "" || createdAtStr != "" {
-		lists, err = service.FindByParams(title, createdAt)
-	} else {
-		lists, err = service.Find()
+	list, err := service.GetIncluding(idNum, include)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
 	}
 
+	// the route also changes with the store, so it isn't cached by the list version
+	if store.ID != 0 {
+		route := store.Route(list)
+		if format == gin.MIMEJSON {
+			c.JSON(http.StatusOK, route)
+			return
+		}
+		renderBuyList(c, format, route.BuyList, route.Groups(), prices, columns)
+		return
+	}
+
+	modified, err := service.LastModified(list)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	// renderings, lists with other relations loaded or changes on their
+	// ingredients are other representations
+	relations := slices.Clone(include)
+	slices.Sort(relations)
+	variant := fmt.Sprintf("%s;%d;%s;%d", format, columns, strings.Join(relations, ","), modified.UnixNano())
+	if middleware.NotModified(c, middleware.VariantETag(list.Version, variant), modified) {
+		return
+	}
 
-	c.JSON(http.StatusOK, lists)
+	if format != gin.MIMEJSON {
+		renderBuyList(c, format, list, internal.GroupItemsByCategory(list.Items), prices, columns)
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func renderBuyList(c *gin.Context, format string, list internal.BuyList, groups []internal.ItemGroup,
+	prices *internal.PriceService, columns int) {
+	var rendered bytes.Buffer
+	if format == internal.MediaPDF {
+		itemPrices, err := prices.ItemPrices(list)
+		if err == nil {
+			err = internal.RenderPDF(&rendered, list, groups, itemPrices, columns)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf(`inline; filename="buylist-%d.pdf"`, list.ID))
+		c.Data(http.StatusOK, format, rendered.Bytes())
+		return
+	}
+
+	if err := internal.RenderList(&rendered, format, list, groups); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Data(http.StatusOK, format+"; charset=utf-8", rendered.Bytes())
 }
 
 // CreateBuyList godoc
 // @Summary Create buylist with ingredients
-// @Description Receives post data that creates a buylist
+// @Description Receives post data that creates a buylist.
+// Lists with a ScheduledFor date can have Reminders, each one sent OffsetMinutes before the date.
 // @Accepts json
 // @Produces json
 // @Sucess 201 {object} internal.BuyList
@@ -67,6 +236,7 @@ func GetBuyList(c *gin.Context, service *internal.BuyListService) {
 // @Router /api/buylist [post]
 func CreateBuyList(c *gin.Context, service *internal.BuyListService) {
 	buyList := c.MustGet("buyList").(internal.BuyList)
+	buyList.Owner = auth.UserID(c.Request)
 
 	buyList, err := service.Create(buyList)
 
@@ -75,18 +245,23 @@ func CreateBuyList(c *gin.Context, service *internal.BuyListService) {
 		return
 	}
 
+	c.Header("ETag", middleware.ETag(buyList.Version))
 	c.JSON(http.StatusCreated, buyList)
 }
 
 // UpdateBuyList godoc
 // @Summary Update a buylist
 // @Description Receives the identifier of buylist and data to update it.
+// The list is updated only when it wasn't changed since the version on If-Match header
+// or, without the header, the Version sent.
 // @Accepts json
 // @Produces json
 // @Sucess 200 {object} internal.BuyList
 // @Failure 400
+// @Failure 412
 // @Failure 500
 // @Router /api/buylist [put]
+// @Param If-Match header string false "ETag of the list version being updated"
 func UpdateBuyList(c *gin.Context, service *internal.BuyListService) {
 	buyList := c.MustGet("buyList").(internal.BuyList)
 	idNum := c.MustGet("idNum").(uint64)
@@ -98,25 +273,133 @@ func UpdateBuyList(c *gin.Context, service *internal.BuyListService) {
 		return
 	}
 
+	if version, exists := c.Get("ifMatch"); exists {
+		buyList.Version = version.(uint)
+	}
+
 	buyList, err := service.Update(buyList, idNum)
 
+	if errors.Is(err, internal.ErrVersionConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.Header("ETag", middleware.ETag(buyList.Version))
+	c.JSON(http.StatusOK, buyList)
+}
+
+// PatchBuyList godoc
+// @Summary Partially update a buylist
+// @Description Applies a JSON Merge Patch (application/merge-patch+json) or a JSON Patch
+// (application/json-patch+json) on the stored buylist. Items removed by the patch are deleted
+// from the list and items without ID are added. Patches that can't be applied answer with the
+// operation and path where they failed.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} internal.BuyList
+// @Failure 400
+// @Failure 404
+// @Failure 412
+// @Failure 415
+// @Failure 422
+// @Failure 500
+// @Router /api/buylist/{id} [patch]
+// @Param id path int true "buylist identifier"
+// @Param If-Match header string false "ETag of the list version being patched"
+func PatchBuyList(c *gin.Context, service *internal.BuyListService) {
+	idNum := c.MustGet("idNum").(uint64)
+	jsonPatch := c.MustGet("patch").(patch.Patch)
+
+	stored, err := service.Get(idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	version := stored.Version
+	if ifMatch, exists := c.Get("ifMatch"); exists {
+		version = ifMatch.(uint)
+	}
+	if version != stored.Version {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": internal.ErrVersionConflict.Error()})
+		return
+	}
+
+	document, err := json.Marshal(stored)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	document, err = jsonPatch.Apply(document)
+	if err != nil {
+		middleware.PatchError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	var buyList internal.BuyList
+	if err := patch.Unmarshal(document, &buyList); err != nil {
+		middleware.PatchError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if buyList.ID != stored.ID {
+		middleware.PatchError(c, http.StatusUnprocessableEntity, &patch.Error{Operation: -1, Path: "/ID", Message: "identifier can't be changed"})
+		return
+	}
+	storedItems := map[uint]bool{}
+	for _, item := range stored.Items {
+		storedItems[item.ID] = true
+	}
+	for i, item := range buyList.Items {
+		if item.ID != 0 && !storedItems[item.ID] {
+			middleware.PatchError(c, http.StatusUnprocessableEntity, &patch.Error{
+				Operation: -1,
+				Path:      fmt.Sprintf("/Items/%d/ID", i),
+				Message:   "item does not exists on list",
+			})
+			return
+		}
+	}
+	if len(buyList.Reminders) > 0 && buyList.ScheduledFor == nil {
+		middleware.PatchError(c, http.StatusUnprocessableEntity, &patch.Error{
+			Operation: -1,
+			Path:      "/ScheduledFor",
+			Message:   "Reminders require the list to have a ScheduledFor date",
+		})
+		return
+	}
+
+	buyList.Version = version
+	buyList, err = service.Patch(buyList, idNum)
+
+	if errors.Is(err, internal.ErrVersionConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("ETag", middleware.ETag(buyList.Version))
 	c.JSON(http.StatusOK, buyList)
 }
 
 // DeleteBuyList godoc
 // @Summary Deletes an buylist
 // @Description Receives the identifier of an buylist and deletes it.
+// With If-Match header the list is deleted only when it wasn't changed since that version.
 // @Accepts json
 // @Produces json
 // @Sucess 200 {object} internal.BuyList
 // @Failure 400
+// @Failure 412
 // @Failure 500
 // @Router /api/buylist [delete]
+// @Param If-Match header string false "ETag of the list version being deleted"
 func DeleteBuyList(c *gin.Context, service *internal.BuyListService) {
 	idNum, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	if err != nil {
@@ -126,8 +409,12 @@ func DeleteBuyList(c *gin.Context, service *internal.BuyListService) {
 		return
 	}
 
-	list, err := service.Delete(idNum)
+	list, err := service.Delete(idNum, c.GetUint("ifMatch"))
 
+	if errors.Is(err, internal.ErrVersionConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": err.Error(),
@@ -138,21 +425,660 @@ func DeleteBuyList(c *gin.Context, service *internal.BuyListService) {
 	c.JSON(http.StatusOK, list)
 }
 
-func GetBuyListRoutes(group *gin.RouterGroup, db *gorm.DB) {
-	service := internal.BuyListService{Database: db}
+// ShareBuyList godoc
+// @Summary Email a copy of a buylist
+// @Description Sends a copy of the buylist content to the email passed. The recipient doesn't get
+// access to the list. Each user can email up to 10 copies a day.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} internal.BuyList
+// @Failure 400
+// @Failure 404
+// @Failure 429
+// @Failure 500
+// @Router /api/buylist/{id}/share [post]
+// @Param id path int true "buylist identifier"
+func ShareBuyList(c *gin.Context, service *internal.BuyListService, shares *internal.ShareService, notifier internal.Notifier) {
+	idNum := c.MustGet("idNum").(uint64)
+	var share struct {
+		Email string `binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&share); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	list, err := service.Get(idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = shares.Record(list, share.Email)
+	if errors.Is(err, internal.ErrShareLimit) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = notifier.Notify(c.Request.Context(), internal.Notification{
+		Kind:      internal.NotificationShareInvite,
+		Owner:     list.Owner,
+		Recipient: share.Email,
+		BuyList:   list,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// DuplicateBuyList godoc
+// @Summary Duplicate a buylist
+// @Description Creates a new list with the items of the buylist, none of them purchased.
+// The new list isn't scheduled. Title is optional.
+// @Accepts json
+// @Produces json
+// @Sucess 201 {object} internal.BuyList
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /api/buylist/{id}/duplicate [post]
+// @Param id path int true "buylist identifier"
+func DuplicateBuyList(c *gin.Context, service *internal.BuyListService) {
+	idNum := c.MustGet("idNum").(uint64)
+	var duplicate struct {
+		Title string
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&duplicate); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	list, err := service.Duplicate(idNum, duplicate.Title, auth.UserID(c.Request))
+	if errors.Is(err, internal.ErrBuyListNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("ETag", middleware.ETag(list.Version))
+	c.JSON(http.StatusCreated, list)
+}
+
+// MergeBuyLists godoc
+// @Summary Merge buylists
+// @Description Moves the items of the Sources lists into the Target list and deletes the sources.
+// Items of the same ingredient are consolidated on one item with the sum of quantities.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} internal.BuyList
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /api/buylist/merge [post]
+func MergeBuyLists(c *gin.Context, service *internal.BuyListService) {
+	var merge struct {
+		Target  uint64   `binding:"required"`
+		Sources []uint64 `binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&merge); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, ID := range append([]uint64{merge.Target}, merge.Sources...) {
+		err := service.Owned(ID, auth.UserID(c.Request))
+		if errors.Is(err, internal.ErrBuyListNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	list, err := service.Merge(merge.Target, merge.Sources)
+	if errors.Is(err, internal.ErrBuyListNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("ETag", middleware.ETag(list.Version))
+	c.JSON(http.StatusOK, list)
+}
+
+// SplitBuyList godoc
+// @Summary Split a buylist
+// @Description Moves items of the buylist to new lists with the same schedule. The items of ItemIDs
+// or of the Categories go to one new list, with ByCategory each category goes to its own list.
+// Returns the lists created.
+// @Accepts json
+// @Produces json
+// @Sucess 201 {array} []internal.BuyList
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /api/buylist/{id}/split [post]
+// @Param id path int true "buylist identifier"
+func SplitBuyList(c *gin.Context, service *internal.BuyListService) {
+	idNum := c.MustGet("idNum").(uint64)
+	var options internal.SplitOptions
+	if err := c.ShouldBindJSON(&options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(options.ItemIDs) == 0 && len(options.Categories) == 0 && !options.ByCategory {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Split requires ItemIDs, Categories or ByCategory"})
+		return
+	}
+
+	lists, err := service.Split(idNum, options)
+	if errors.Is(err, internal.ErrBuyListNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, lists)
+}
+
+// GetBestStore godoc
+// @Summary Find the cheapest store for a buylist
+// @Description Estimates the cost of the buylist at each store of the user, with the latest price recorded
+// there for the ingredient of each item, in the unit of the item, times its quantity. Items without
+// a price in their unit at a store are on the Missing of its estimate. Cheapest is the store pricing most items at the lowest total,
+// Split is set when buying each item on the cheaper of two stores is better.
+// @Produces json
+// @Sucess 200 {object} internal.BestStore
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /api/buylist/{id}/best-store [get]
+// @Param id path int true "buylist identifier"
+func GetBestStore(c *gin.Context, service *internal.BuyListService, prices *internal.PriceService) {
+	idNum := c.MustGet("idNum").(uint64)
+	list, err := service.Get(idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	best, err := prices.BestStore(list)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, best)
+}
+
+// BudgetedItem is an item with the budget status of its list, answered by
+// changes that affect the cost of the list.
+type BudgetedItem struct {
+	internal.BuyItem
+	Budget *internal.BudgetStatus `json:",omitempty"`
+}
+
+// Check the budgets of the list of item. Failures are only logged since
+// the item was already saved.
+func withBudget(item internal.BuyItem, budgets *internal.BudgetService) BudgetedItem {
+	status, err := budgets.Check(uint(item.BuyListID))
+	if err != nil {
+		log.Printf("Error checking budget of list %d: %v", item.BuyListID, err)
+	}
+
+	return BudgetedItem{BuyItem: item, Budget: status}
+}
+
+// Read the delimiter of CSV files from param, a single character or tab.
+func csvDelimiter(param string) (rune, error) {
+	switch {
+	case param == "":
+		return ',', nil
+	case param == "tab":
+		return '\t', nil
+	case utf8.RuneCountInString(param) == 1 && param != "\"" && param != "\n" && param != "\r":
+		return []rune(param)[0], nil
+	}
+
+	return 0, errors.New("Invalid delimiter, must be a single character or tab")
+}
+
+// ExportBuyList godoc
+// @Summary Export a buylist as CSV
+// @Description Returns the items of the buylist as a CSV file with the columns title, ingredient,
+// quantity, unit, category and price, the latest price recorded for the item or its ingredient in its unit.
+// @Produces text/csv
+// @Sucess 200 {string} string
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /api/buylist/{id}/export [get]
+// @Param id path int true "buylist identifier"
+// @Param format query string false "only csv"
+// @Param columns query string false "JSON object mapping the fields to the headers of their columns"
+// @Param delimiter query string false "delimiter of the columns, comma by default, or tab"
+func ExportBuyList(c *gin.Context, service *internal.BuyListService, csvService *internal.CSVService) {
+	idNum := c.MustGet("idNum").(uint64)
+	if format := c.DefaultQuery("format", "csv"); format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format, must be csv"})
+		return
+	}
+	columns, err := internal.ParseCSVColumns(c.Query("columns"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	delimiter, err := csvDelimiter(c.Query("delimiter"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	list, err := service.Get(idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	var file bytes.Buffer
+	if err := csvService.Export(list, columns, delimiter, &file); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="buylist-%d.csv"`, list.ID))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", file.Bytes())
+}
+
+// ImportBuyLists godoc
+// @Summary Import buylists from CSV
+// @Description Receives a CSV file on the file field and creates a buylist for each title, with an
+// item for each row. Columns are found by the header: title, ingredient, quantity, unit, category and
+// price, or the ones mapped on columns. Ingredients are found by name or alias, only the ones missing
+// are created. Prices are recorded at the store, required when the file has prices.
+// With dry_run nothing is saved and the lists are returned to be reviewed. Files with invalid rows
+// answer 422 with the Errors of each row and nothing is saved.
+// @Accepts multipart/form-data
+// @Produces json
+// @Sucess 201 {object} internal.ImportResult
+// @Failure 400
+// @Failure 422
+// @Failure 500
+// @Router /api/buylist/import [post]
+// @Param file formData file true "CSV file"
+// @Param columns formData string false "JSON object mapping the fields to the headers of their columns"
+// @Param delimiter formData string false "delimiter of the columns, comma by default, or tab"
+// @Param title formData string false "title of the list when the file has no title column"
+// @Param store formData int false "store identifier the prices were observed at"
+// @Param dry_run formData bool false "validate the file without saving"
+func ImportBuyLists(c *gin.Context, service *internal.CSVService) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A CSV file is required on the file field"})
+		return
+	}
+
+	options := internal.ImportOptions{Title: c.PostForm("title")}
+	if options.Columns, err = internal.ParseCSVColumns(c.PostForm("columns")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if options.Delimiter, err = csvDelimiter(c.PostForm("delimiter")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if store := c.PostForm("store"); store != "" {
+		storeID, err := strconv.ParseUint(store, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid store identifier"})
+			return
+		}
+		options.StoreID = uint(storeID)
+	}
+	if dryRun := c.PostForm("dry_run"); dryRun != "" {
+		if options.DryRun, err = strconv.ParseBool(dryRun); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid dry_run, must be true or false"})
+			return
+		}
+	}
+
+	reader, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer reader.Close()
+
+	result, err := service.Import(reader, auth.UserID(c.Request), options)
+	if errors.Is(err, internal.ErrInvalidImport) {
+		c.JSON(http.StatusUnprocessableEntity, result)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if options.DryRun {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+	c.JSON(http.StatusCreated, result)
+}
+
+// SetItemPurchased godoc
+// @Summary Check off an item of a buylist
+// @Description Marks an item of the buylist as purchased or not.
+// When every item is purchased the list is completed.
+// A purchase with UnitPrice and StoreID records the price of the ingredient at the store,
+// Unit is the unit the price is for (kg, l, unit...). Priced purchases have the Budget status
+// when the list or its owner have a budget.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} api.BudgetedItem
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /api/buylist/{id}/items/{item}/purchased [put]
+// @Param id path int true "buylist identifier"
+// @Param item path int true "item identifier"
+func SetItemPurchased(c *gin.Context, service *internal.BuyListService, stores *internal.StoreService, prices *internal.PriceService, budgets *internal.BudgetService) {
+	idNum := c.MustGet("idNum").(uint64)
+	itemID := c.MustGet("itemIdNum").(uint64)
+
+	var purchase struct {
+		Purchased bool
+		UnitPrice *float64
+		Unit      string
+		StoreID   uint
+	}
+	if err := c.BindJSON(&purchase); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if purchase.UnitPrice != nil && (purchase.StoreID == 0 || *purchase.UnitPrice < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A price needs the StoreID and can't be negative"})
+		return
+	}
+	if purchase.UnitPrice != nil && !purchase.Purchased {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Prices are only recorded on purchases"})
+		return
+	}
+
+	if purchase.UnitPrice != nil {
+		if _, err := stores.Get(auth.UserID(c.Request), uint64(purchase.StoreID)); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	item, err := service.SetPurchased(idNum, itemID, purchase.Purchased)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if purchase.UnitPrice != nil {
+		if _, err := prices.Observe(item, purchase.StoreID, *purchase.UnitPrice, purchase.Unit); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, withBudget(item, budgets))
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// AddItem godoc
+// @Summary Add an item to a buylist
+// @Description Receives an item and adds it to the buylist. The ingredient of the item is created
+// when IngredientID is not set. When the list or its owner have a budget, Budget has the
+// remaining budgets and a Warning when the projected spend reaches the first threshold.
+// @Accepts json
+// @Produces json
+// @Sucess 201 {object} api.BudgetedItem
+// @Failure 400
+// @Failure 404
+// @Router /api/buylist/{id}/items [post]
+// @Param id path int true "buylist identifier"
+func AddItem(c *gin.Context, service *internal.BuyListService, budgets *internal.BudgetService) {
+	idNum := c.MustGet("idNum").(uint64)
+	var item internal.BuyItem
+	if err := c.BindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	item, err := service.AddItem(idNum, item)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, withBudget(item, budgets))
+}
+
+// RemoveItem godoc
+// @Summary Remove an item from a buylist
+// @Produces json
+// @Sucess 200 {object} internal.BuyItem
+// @Failure 400
+// @Failure 404
+// @Router /api/buylist/{id}/items/{item} [delete]
+// @Param id path int true "buylist identifier"
+// @Param item path int true "item identifier"
+func RemoveItem(c *gin.Context, service *internal.BuyListService) {
+	idNum := c.MustGet("idNum").(uint64)
+	itemID := c.MustGet("itemIdNum").(uint64)
+
+	item, err := service.RemoveItem(idNum, itemID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// SetItemQuantity godoc
+// @Summary Change the quantity of an item of a buylist
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} internal.BuyItem
+// @Failure 400
+// @Failure 404
+// @Router /api/buylist/{id}/items/{item}/quantity [put]
+// @Param id path int true "buylist identifier"
+// @Param item path int true "item identifier"
+func SetItemQuantity(c *gin.Context, service *internal.BuyListService) {
+	idNum := c.MustGet("idNum").(uint64)
+	itemID := c.MustGet("itemIdNum").(uint64)
+
+	var quantity struct {
+		Quantity uint
+	}
+	if err := c.BindJSON(&quantity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	item, err := service.SetQuantity(idNum, itemID, quantity.Quantity)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// BuyListEvents godoc
+// @Summary Stream buylist changes
+// @Description Server-Sent Events stream of the changes of a buylist: item.added, item.removed,
+// item.quantity_changed, item.purchased, item.unpurchased, buylist.updated, buylist.completed and buylist.deleted.
+// Event id is the sequence of the event on the list, send it on Last-Event-ID header to resume the stream.
+// A resync event is sent when some events were lost and the list must be reloaded.
+// @Produces text/event-stream
+// @Sucess 200
+// @Failure 400
+// @Failure 404
+// @Router /api/buylist/{id}/events [get]
+// @Param id path int true "buylist identifier"
+// @Param Last-Event-ID header int false "id of the last event received"
+func BuyListEvents(c *gin.Context, service *internal.BuyListService, hub *internal.ListHub) {
+	idNum := c.MustGet("idNum").(uint64)
+	if _, err := service.Get(idNum); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	var lastSeq uint64
+	if lastEventID != "" {
+		var err error
+		lastSeq, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+	}
+
+	missed, complete, events, cancel := hub.Subscribe(uint(idNum), lastSeq)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	send := func(event internal.ListEvent) {
+		if lastSeq != 0 && event.Seq > lastSeq+1 {
+			complete = false
+		}
+		if !complete {
+			c.SSEvent("resync", gin.H{"BuyListID": idNum})
+			complete = true
+		}
+		data, _ := json.Marshal(event.Event)
+		fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+		lastSeq = event.Seq
+	}
+
+	if !complete {
+		c.SSEvent("resync", gin.H{"BuyListID": idNum})
+		complete = true
+	}
+	for _, event := range missed {
+		send(event)
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event := <-events:
+			send(event)
+			return event.Type != internal.EventBuyListDeleted
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+			return true
+		}
+	})
+}
+
+func GetBuyListRoutes(group *gin.RouterGroup, db *gorm.DB, events *internal.EventBus, notifier internal.Notifier, hub *internal.ListHub) {
+	service := internal.BuyListService{Database: db, Events: events}
+	storeService := internal.StoreService{Database: db}
+	priceService := internal.PriceService{Database: db}
+	budgetService := internal.BudgetService{Database: db, Events: events}
+	csvService := internal.CSVService{Database: db, Events: events}
+	shareService := internal.ShareService{Database: db}
+	owned := middleware.RequireListOwner(&service)
 	buylist := group.Group("buylist")
 	{
-		buylist.GET("", func(c *gin.Context) {
+		buylist.Use(adapter.Wrap(auth.EnsureValidToken()))
+		buylist.GET("", middleware.ValidateBuyListFilter(), middleware.ValidatePage(internal.BuyListSortFields, internal.BuyList{}), func(c *gin.Context) {
 			GetBuyList(c, &service)
 		})
+		buylist.GET("/:id", middleware.ValidateId(), owned, func(c *gin.Context) {
+			GetBuyListById(c, &service, &storeService, &priceService)
+		})
 		buylist.POST("", middleware.ValidateBuyList(), func(c *gin.Context) {
 			CreateBuyList(c, &service)
 		})
-		buylist.PUT("/:id", middleware.ValidateBuyList(), middleware.ValidateId(), func(c *gin.Context) {
+		buylist.PUT("/:id", middleware.ValidateBuyList(), middleware.ValidateId(), owned, middleware.ValidateIfMatch(), func(c *gin.Context) {
 			UpdateBuyList(c, &service)
 		})
-		buylist.DELETE("/:id", middleware.ValidateId(), func(c *gin.Context) {
+		buylist.PATCH("/:id", middleware.ValidateId(), owned, middleware.ValidateIfMatch(), middleware.ValidatePatch(), func(c *gin.Context) {
+			PatchBuyList(c, &service)
+		})
+		buylist.DELETE("/:id", middleware.ValidateId(), owned, middleware.ValidateIfMatch(), func(c *gin.Context) {
 			DeleteBuyList(c, &service)
 		})
+		buylist.POST("/import", func(c *gin.Context) {
+			ImportBuyLists(c, &csvService)
+		})
+		buylist.GET("/:id/export", middleware.ValidateId(), owned, func(c *gin.Context) {
+			ExportBuyList(c, &service, &csvService)
+		})
+		buylist.POST("/merge", func(c *gin.Context) {
+			MergeBuyLists(c, &service)
+		})
+		buylist.GET("/:id/best-store", middleware.ValidateId(), owned, func(c *gin.Context) {
+			GetBestStore(c, &service, &priceService)
+		})
+		buylist.POST("/:id/duplicate", middleware.ValidateId(), owned, func(c *gin.Context) {
+			DuplicateBuyList(c, &service)
+		})
+		buylist.POST("/:id/split", middleware.ValidateId(), owned, func(c *gin.Context) {
+			SplitBuyList(c, &service)
+		})
+		buylist.POST("/:id/share", middleware.ValidateId(), owned, func(c *gin.Context) {
+			ShareBuyList(c, &service, &shareService, notifier)
+		})
+		buylist.GET("/:id/events", middleware.ValidateId(), owned, func(c *gin.Context) {
+			BuyListEvents(c, &service, hub)
+		})
+		buylist.GET("/:id/ws", middleware.ValidateId(), owned, func(c *gin.Context) {
+			CollaborateBuyList(c, &service, hub)
+		})
+		buylist.POST("/:id/items", middleware.ValidateId(), owned, func(c *gin.Context) {
+			AddItem(c, &service, &budgetService)
+		})
+		buylist.DELETE("/:id/items/:item", middleware.ValidateId(), owned, middleware.ValidateItemId(), func(c *gin.Context) {
+			RemoveItem(c, &service)
+		})
+		buylist.PUT("/:id/items/:item/quantity", middleware.ValidateId(), owned, middleware.ValidateItemId(), func(c *gin.Context) {
+			SetItemQuantity(c, &service)
+		})
+		buylist.PUT("/:id/items/:item/purchased", middleware.ValidateId(), owned, middleware.ValidateItemId(), func(c *gin.Context) {
+			SetItemPurchased(c, &service, &storeService, &priceService, &budgetService)
+		})
 	}
 }
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/internal"
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+// CalendarFeed is a calendar token with the path of its feed.
+type CalendarFeed struct {
+	internal.CalendarToken
+	Path string
+}
+
+// GetCalendar godoc
+// @Summary Get the scheduled buylists as a calendar
+// @Description Returns an iCalendar with an event on the scheduled date of each buylist of the owner
+// of the token, with an alarm for each of its reminders and the items on the description.
+// The token is the secret of the feed, it doesn't need authentication so calendar apps can subscribe to it.
+// @Produces text/calendar
+// @Sucess 200
+// @Failure 404
+// @Failure 500
+// @Router /api/calendar/{token}.ics [get]
+// @Param token path string true "calendar token of the user"
+func GetCalendar(c *gin.Context, service *internal.CalendarService) {
+	token, found := strings.CutSuffix(c.Param("file"), ".ics")
+	if !found || token == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": internal.ErrCalendarTokenNotFound.Error()})
+		return
+	}
+
+	lists, err := service.Feed(token)
+	if errors.Is(err, internal.ErrCalendarTokenNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var calendar bytes.Buffer
+	if err := internal.WriteCalendar(&calendar, lists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", calendar.Bytes())
+}
+
+// GetCalendarToken godoc
+// @Summary Get the calendar token
+// @Description Returns the calendar token of the authenticated user with the path of its feed.
+// @Produces json
+// @Sucess 200 {object} CalendarFeed
+// @Failure 404
+// @Failure 500
+// @Router /api/settings/calendar [get]
+func GetCalendarToken(c *gin.Context, service *internal.CalendarService) {
+	token, err := service.Token(auth.UserID(c.Request))
+	if errors.Is(err, internal.ErrCalendarTokenNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, CalendarFeed{CalendarToken: token, Path: token.Path()})
+}
+
+// RotateCalendarToken godoc
+// @Summary Create the calendar token
+// @Description Creates a new calendar token for the authenticated user, the previous one stops working.
+// @Produces json
+// @Sucess 201 {object} CalendarFeed
+// @Failure 500
+// @Router /api/settings/calendar [post]
+func RotateCalendarToken(c *gin.Context, service *internal.CalendarService) {
+	token, err := service.Rotate(auth.UserID(c.Request))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, CalendarFeed{CalendarToken: token, Path: token.Path()})
+}
+
+// RevokeCalendarToken godoc
+// @Summary Revoke the calendar token
+// @Description Removes the calendar token of the authenticated user, its feed stops working.
+// @Sucess 204
+// @Failure 404
+// @Failure 500
+// @Router /api/settings/calendar [delete]
+func RevokeCalendarToken(c *gin.Context, service *internal.CalendarService) {
+	err := service.Revoke(auth.UserID(c.Request))
+	if errors.Is(err, internal.ErrCalendarTokenNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func GetCalendarRoutes(group *gin.RouterGroup, db *gorm.DB) {
+	service := internal.CalendarService{Database: db}
+	group.GET("/calendar/:file", func(c *gin.Context) {
+		GetCalendar(c, &service)
+	})
+
+	tokens := group.Group("settings/calendar")
+	{
+		tokens.Use(adapter.Wrap(auth.EnsureValidToken()))
+		tokens.GET("", func(c *gin.Context) {
+			GetCalendarToken(c, &service)
+		})
+		tokens.POST("", func(c *gin.Context) {
+			RotateCalendarToken(c, &service)
+		})
+		tokens.DELETE("", func(c *gin.Context) {
+			RevokeCalendarToken(c, &service)
+		})
+	}
+}
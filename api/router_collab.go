@@ -0,0 +1,136 @@
+package api
+
+import (
+	"buylist/internal"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: checkOrigin,
+}
+
+// Browsers connect to sockets from any site with the cookies and credentials
+// of the user, so only pages of the same host or of the origins on the
+// comma separated ALLOWED_ORIGINS are accepted. Clients that aren't
+// browsers don't send an Origin.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+
+	allowed := strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",")
+	for i := range allowed {
+		allowed[i] = strings.TrimSpace(allowed[i])
+	}
+	return slices.Contains(allowed, origin)
+}
+
+// Message sent by the server on collaborative editing sockets:
+// snapshot with the list when the client connects, event with the changes
+// made by any client and ack with the results of the operations of the client.
+type collabMessage struct {
+	Type    string
+	Clock   uint64                     `json:",omitempty"`
+	List    *internal.BuyList          `json:",omitempty"`
+	Event   *internal.ListEvent        `json:",omitempty"`
+	Results []internal.OperationResult `json:",omitempty"`
+	Error   string                     `json:",omitempty"`
+}
+
+// Message sent by clients with the operations made on the list.
+type collabRequest struct {
+	Operations []internal.Operation
+}
+
+// CollaborateBuyList godoc
+// @Summary Edit a buylist collaboratively
+// @Description WebSocket where clients send operations made on the buylist: add_item, remove_item,
+// set_quantity, set_purchased and move_item. Operations are merged as a CRDT, each one has a Stamp
+// with a Lamport Clock (greater than the Clock of the last message received) and the Replica id of the client.
+// The server answers with an ack with the result of each operation and sends to all clients an event
+// for each change applied to the list.
+// Browsers can only connect from the same host or the origins on ALLOWED_ORIGINS.
+// @Sucess 101
+// @Failure 400
+// @Failure 403
+// @Failure 404
+// @Router /api/buylist/{id}/ws [get]
+// @Param id path int true "buylist identifier"
+func CollaborateBuyList(c *gin.Context, service *internal.BuyListService, hub *internal.ListHub) {
+	idNum := c.MustGet("idNum").(uint64)
+	events, cancel := hub.Listen(uint(idNum))
+	defer cancel()
+
+	list, err := service.Get(idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// upgrader already answered the request
+		return
+	}
+	defer conn.Close()
+
+	var writeLock sync.Mutex
+	write := func(message collabMessage) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return conn.WriteJSON(message)
+	}
+
+	if err := write(collabMessage{Type: "snapshot", Clock: list.Clock, List: &list}); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case event := <-events:
+				if write(collabMessage{Type: "event", Event: &event}) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var request collabRequest
+		if err := conn.ReadJSON(&request); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Error reading collaboration message of list %d: %v", idNum, err)
+			}
+			return
+		}
+
+		list, results, err := service.ApplyOperations(idNum, request.Operations)
+		message := collabMessage{Type: "ack", Clock: list.Clock, Results: results}
+		if err != nil {
+			message = collabMessage{Type: "error", Error: err.Error()}
+		}
+		if write(message) != nil {
+			return
+		}
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"buylist/api/auth"
 	"buylist/api/middleware"
 	"buylist/internal"
+	"buylist/internal/patch"
+	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -11,6 +14,34 @@ import (
 	"gorm.io/gorm"
 )
 
+// GetIngredientById godoc
+// @Summary Get an ingredient
+// @Description Returns the ingredient with the identifier passed.
+// Answers 304 when the ingredient didn't change since the If-None-Match or If-Modified-Since headers.
+// @Produces json
+// @Sucess 200 {object} internal.Ingredient
+// @Failure 304
+// @Failure 400
+// @Failure 404
+// @Router /api/ingredient/{id} [get]
+// @Param id path int true "ingredient identifier"
+// @Param If-None-Match header string false "ETag of the ingredient version the client has"
+// @Param If-Modified-Since header string false "date of the ingredient version the client has"
+func GetIngredientById(c *gin.Context, service *internal.IngredientService) {
+	idNum := c.MustGet("idNum").(uint64)
+	ingredient, err := service.Get(uint(idNum))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	if middleware.NotModified(c, middleware.ETag(ingredient.Version), ingredient.UpdatedAt) {
+		return
+	}
+
+	c.JSON(http.StatusOK, ingredient)
+}
+
 // CreateIngredient godoc
 // @Summary Create ingredient
 // @Description Receives post data that creates an ingredient
@@ -22,24 +53,30 @@ import (
 // @Router /api/ingredient [post]
 func CreateIngredient(c *gin.Context, service *internal.IngredientService) {
 	ingredient := c.MustGet("ingredient").(internal.Ingredient)
-	ingredient, err := service.Create(ingredient.Name, ingredient.OriginType)
+	ingredient, err := service.Create(ingredient)
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
+	c.Header("ETag", middleware.ETag(ingredient.Version))
 	c.JSON(http.StatusCreated, ingredient)
 }
 
 // UpdateIngredient godoc
 // @Summary Update an ingredient
 // @Description Receives the identifier of ingredient and data to update it.
+// The ingredient is updated only when it wasn't changed since the version on If-Match header
+// or, without the header, the Version sent.
 // @Accepts json
 // @Produces json
 // @Sucess 200 {object} internal.Ingredient
 // @Failure 400
+// @Failure 412
 // @Failure 500
 // @Router /api/ingredient [put]
+// @Param If-Match header string false "ETag of the ingredient version being updated"
 func UpdateIngredient(c *gin.Context, service *internal.IngredientService) {
 	ingredient := c.MustGet("ingredient").(internal.Ingredient)
 	idNum := c.MustGet("idNum").(uint64)
@@ -48,31 +85,122 @@ func UpdateIngredient(c *gin.Context, service *internal.IngredientService) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "Ingredient data and identifier passed don't match",
 		})
+		return
+	}
+
+	if version, exists := c.Get("ifMatch"); exists {
+		ingredient.Version = version.(uint)
 	}
 
 	ingredient, err := service.Update(ingredient, uint(idNum))
 
+	if errors.Is(err, internal.ErrVersionConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("ETag", middleware.ETag(ingredient.Version))
+	c.JSON(http.StatusOK, ingredient)
+}
+
+// PatchIngredient godoc
+// @Summary Partially update an ingredient
+// @Description Applies a JSON Merge Patch (application/merge-patch+json) or a JSON Patch
+// (application/json-patch+json) on the stored ingredient. Patches that can't be applied
+// answer with the operation and path where they failed.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} internal.Ingredient
+// @Failure 400
+// @Failure 404
+// @Failure 412
+// @Failure 415
+// @Failure 422
+// @Failure 500
+// @Router /api/ingredient/{id} [patch]
+// @Param id path int true "ingredient identifier"
+// @Param If-Match header string false "ETag of the ingredient version being patched"
+func PatchIngredient(c *gin.Context, service *internal.IngredientService) {
+	idNum := c.MustGet("idNum").(uint64)
+	jsonPatch := c.MustGet("patch").(patch.Patch)
+
+	stored, err := service.Get(uint(idNum))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	version := stored.Version
+	if ifMatch, exists := c.Get("ifMatch"); exists {
+		version = ifMatch.(uint)
+	}
+	if version != stored.Version {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": internal.ErrVersionConflict.Error()})
+		return
+	}
+
+	document, err := json.Marshal(stored)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	document, err = jsonPatch.Apply(document)
+	if err != nil {
+		middleware.PatchError(c, http.StatusUnprocessableEntity, err)
+		return
 	}
 
+	var ingredient internal.Ingredient
+	if err := patch.Unmarshal(document, &ingredient); err != nil {
+		middleware.PatchError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if ingredient.ID != stored.ID {
+		middleware.PatchError(c, http.StatusUnprocessableEntity, &patch.Error{Operation: -1, Path: "/ID", Message: "identifier can't be changed"})
+		return
+	}
+
+	ingredient.CreatedAt = stored.CreatedAt
+	ingredient.DeletedAt = stored.DeletedAt
+	ingredient.Version = version
+	ingredient, err = service.Update(ingredient, uint(idNum))
+
+	if errors.Is(err, internal.ErrVersionConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("ETag", middleware.ETag(ingredient.Version))
 	c.JSON(http.StatusOK, ingredient)
 }
 
 // DeleteIngredient godoc
 // @Summary Deletes an ingredient
 // @Description Receives the identifier of an ingredient and deletes it.
+// With If-Match header the ingredient is deleted only when it wasn't changed since that version.
 // @Accepts json
 // @Produces json
 // @Sucess 200 {object} internal.Ingredient
 // @Failure 400
+// @Failure 412
 // @Failure 500
 // @Router /api/ingredient [delete]
+// @Param If-Match header string false "ETag of the ingredient version being deleted"
 func DeleteIngredient(c *gin.Context, service *internal.IngredientService) {
 	idNum := c.MustGet("idNum").(uint64)
-	ingredient, err := service.Delete(uint(idNum))
+	ingredient, err := service.Delete(uint(idNum), c.GetUint("ifMatch"), auth.UserID(c.Request))
 
-	if err != nil {
+	if errors.Is(err, internal.ErrVersionConflict) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 	} else {
 		c.JSON(http.StatusOK, ingredient)
@@ -83,6 +211,8 @@ func DeleteIngredient(c *gin.Context, service *internal.IngredientService) {
 // @Summary Find ingredients
 // @Description Search ingredients, by default returns all ingredients on database.
 // Using query params will search for ingredients that match them.
+// With limit the ingredients are paginated, the Link header has the next page and X-Total-Count
+// the total of ingredients found.
 // @Produces json
 // @Sucess 200 {array} []internal.Ingredient
 // @Failure 400
@@ -90,45 +220,91 @@ func DeleteIngredient(c *gin.Context, service *internal.IngredientService) {
 // @Router /api/ingredient [get]
 // @Param name query string false "name of ingredient"
 // @Param originType query string false "type of ingredient"
+// @Param limit query int false "max ingredients on the page"
+// @Param cursor query string false "cursor of the page, from the Link header of the previous page"
+// @Param sort query string false "comma separated fields to sort by, prefixed by - on descending order: id, name, origin_type, category, created_at, updated_at"
+// @Param fields query string false "comma separated fields of the ingredients to answer"
 func FindIngredient(c *gin.Context, service *internal.IngredientService) {
-	name := c.Query("name")
-	originType := c.Query("originType")
+	page := c.MustGet("page").(internal.Page)
+	filter := internal.IngredientFilter{
+		Name:       c.Query("name"),
+		OriginType: c.Query("originType"),
+	}
 
-	var ingredients []internal.Ingredient = nil
-	var err error = nil
-	if name != "" || originType != "" {
-		ingredients, err = service.FindByParams(name, originType)
-	} else {
-		ingredients, err = service.Find()
+	ingredients, result, err := service.FindPage(filter, page)
+
+	if errors.Is(err, internal.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
+	middleware.WritePage(c, ingredients, result)
+}
+
+// GetIngredientPrices godoc
+// @Summary Get the price history of an ingredient
+// @Description Returns the prices recorded for the ingredient on the stores of the authenticated user, oldest first, and a summary by
+// store and unit with the latest, average and minimum prices and the Trend (up, down or stable)
+// with the percent of Change over the history.
+// @Produces json
+// @Sucess 200 {object} internal.PriceHistory
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /api/ingredient/{id}/prices [get]
+// @Param id path int true "ingredient identifier"
+func GetIngredientPrices(c *gin.Context, service *internal.IngredientService, prices *internal.PriceService) {
+	idNum := c.MustGet("idNum").(uint64)
+	if _, err := service.Get(uint(idNum)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	history, err := prices.History(auth.UserID(c.Request), uint(idNum))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, ingredients)
+	c.JSON(http.StatusOK, history)
 }
 
-func GetIngredientRoutes(group *gin.RouterGroup, db *gorm.DB) {
-	ingredientService := internal.IngredientService{Database: db}
+func GetIngredientRoutes(group *gin.RouterGroup, db *gorm.DB, events *internal.EventBus) {
+	ingredientService := internal.IngredientService{Database: db, Events: events}
+	priceService := internal.PriceService{Database: db}
 
 	ingredient := group.Group("ingredient")
 	{
 		ingredient.Use(adapter.Wrap(auth.EnsureValidToken()))
-		ingredient.GET("", func(c *gin.Context) {
+		ingredient.GET("", middleware.ValidatePage(internal.IngredientSortFields, internal.Ingredient{}), func(c *gin.Context) {
 			FindIngredient(c, &ingredientService)
 		})
 
+		ingredient.GET("/:id", middleware.ValidateId(), func(c *gin.Context) {
+			GetIngredientById(c, &ingredientService)
+		})
+
+		ingredient.GET("/:id/prices", middleware.ValidateId(), func(c *gin.Context) {
+			GetIngredientPrices(c, &ingredientService, &priceService)
+		})
+
 		ingredient.POST("", middleware.ValidateIngredient(), func(c *gin.Context) {
 			CreateIngredient(c, &ingredientService)
 		})
 
-		ingredient.PUT("/:id", middleware.ValidateIngredient(), middleware.ValidateId(), func(c *gin.Context) {
+		ingredient.PUT("/:id", middleware.ValidateIngredient(), middleware.ValidateId(), middleware.ValidateIfMatch(), func(c *gin.Context) {
 			UpdateIngredient(c, &ingredientService)
 		})
 
-		ingredient.DELETE("/:id", middleware.ValidateId(), func(c *gin.Context) {
+		ingredient.PATCH("/:id", middleware.ValidateId(), middleware.ValidateIfMatch(), middleware.ValidatePatch(), func(c *gin.Context) {
+			PatchIngredient(c, &ingredientService)
+		})
+
+		ingredient.DELETE("/:id", middleware.ValidateId(), middleware.ValidateIfMatch(), func(c *gin.Context) {
 			DeleteIngredient(c, &ingredientService)
 		})
 	}
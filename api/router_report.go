@@ -0,0 +1,184 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/api/middleware"
+	"buylist/internal"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Respond the report as JSON or, with the csv format, as a CSV file with
+// the header and a record of each row.
+func writeReport[T any](c *gin.Context, name string, rows []T, header []string, record func(T) []string) {
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, rows)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	c.Status(http.StatusOK)
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(header)
+	for _, row := range rows {
+		writer.Write(record(row))
+	}
+	writer.Flush()
+}
+
+func writeSpendReport(c *gin.Context, name string, rows []internal.SpendRow, err error) {
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	writeReport(c, name, rows, []string{name, "items", "priced", "spend", "change"}, func(row internal.SpendRow) []string {
+		change := ""
+		if row.Change != nil {
+			change = formatFloat(*row.Change)
+		}
+		return []string{
+			row.Group,
+			strconv.FormatInt(row.Items, 10),
+			strconv.FormatInt(row.Priced, 10),
+			formatFloat(row.Spend),
+			change,
+		}
+	})
+}
+
+// GetMonthlyReport godoc
+// @Summary Spend per month
+// @Description Returns the purchased items and their spend by month, with the percent of Change
+// from the previous month. Spend only sums the Priced items, purchased with a price.
+// @Produces json
+// @Produces text/csv
+// @Sucess 200 {array} []internal.SpendRow
+// @Failure 400
+// @Failure 500
+// @Router /api/reports/monthly [get]
+// @Param from query string false "purchases since the date, on ISO 8601 format"
+// @Param to query string false "purchases until the date, on ISO 8601 format"
+// @Param format query string false "json or csv"
+func GetMonthlyReport(c *gin.Context, service *internal.ReportService) {
+	filter := c.MustGet("reportFilter").(internal.ReportFilter)
+	rows, err := service.Monthly(filter)
+	writeSpendReport(c, "month", rows, err)
+}
+
+// GetCategoryReport godoc
+// @Summary Spend per category
+// @Description Returns the purchased items and their spend by ingredient category.
+// @Produces json
+// @Produces text/csv
+// @Sucess 200 {array} []internal.SpendRow
+// @Failure 400
+// @Failure 500
+// @Router /api/reports/categories [get]
+// @Param from query string false "purchases since the date, on ISO 8601 format"
+// @Param to query string false "purchases until the date, on ISO 8601 format"
+// @Param format query string false "json or csv"
+func GetCategoryReport(c *gin.Context, service *internal.ReportService) {
+	filter := c.MustGet("reportFilter").(internal.ReportFilter)
+	rows, err := service.Categories(filter)
+	writeSpendReport(c, "category", rows, err)
+}
+
+// GetStoreReport godoc
+// @Summary Spend per store
+// @Description Returns the items purchased with a price and their spend by store.
+// @Produces json
+// @Produces text/csv
+// @Sucess 200 {array} []internal.SpendRow
+// @Failure 400
+// @Failure 500
+// @Router /api/reports/stores [get]
+// @Param from query string false "purchases since the date, on ISO 8601 format"
+// @Param to query string false "purchases until the date, on ISO 8601 format"
+// @Param format query string false "json or csv"
+func GetStoreReport(c *gin.Context, service *internal.ReportService) {
+	filter := c.MustGet("reportFilter").(internal.ReportFilter)
+	rows, err := service.Stores(filter)
+	writeSpendReport(c, "store", rows, err)
+}
+
+// GetIngredientReport godoc
+// @Summary Ingredients purchased most often
+// @Description Returns the ingredients by number of purchases with the quantity, spend and the
+// AverageInterval in days between purchases.
+// @Produces json
+// @Produces text/csv
+// @Sucess 200 {array} []internal.IngredientUsage
+// @Failure 400
+// @Failure 500
+// @Router /api/reports/ingredients [get]
+// @Param from query string false "purchases since the date, on ISO 8601 format"
+// @Param to query string false "purchases until the date, on ISO 8601 format"
+// @Param limit query int false "max number of ingredients, 20 by default"
+// @Param format query string false "json or csv"
+func GetIngredientReport(c *gin.Context, service *internal.ReportService) {
+	filter := c.MustGet("reportFilter").(internal.ReportFilter)
+	limit := 20
+	if c.Query("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 || limit > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit, must be between 1 and 500"})
+			return
+		}
+	}
+
+	rows, err := service.Ingredients(filter, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	header := []string{"ingredient_id", "ingredient", "category", "purchases", "quantity", "spend", "average_interval"}
+	writeReport(c, "ingredients", rows, header, func(row internal.IngredientUsage) []string {
+		interval := ""
+		if row.AverageInterval != nil {
+			interval = formatFloat(*row.AverageInterval)
+		}
+		return []string{
+			strconv.FormatUint(uint64(row.IngredientID), 10),
+			row.Ingredient,
+			row.Category,
+			strconv.FormatInt(row.Purchases, 10),
+			strconv.FormatInt(row.Quantity, 10),
+			formatFloat(row.Spend),
+			interval,
+		}
+	})
+}
+
+func GetReportRoutes(group *gin.RouterGroup, db *gorm.DB) {
+	service := internal.ReportService{Database: db}
+	reports := group.Group("reports")
+	{
+		reports.Use(adapter.Wrap(auth.EnsureValidToken()))
+		reports.Use(middleware.ValidateReportFilter())
+		reports.GET("/monthly", func(c *gin.Context) {
+			GetMonthlyReport(c, &service)
+		})
+		reports.GET("/categories", func(c *gin.Context) {
+			GetCategoryReport(c, &service)
+		})
+		reports.GET("/stores", func(c *gin.Context) {
+			GetStoreReport(c, &service)
+		})
+		reports.GET("/ingredients", func(c *gin.Context) {
+			GetIngredientReport(c, &service)
+		})
+	}
+}
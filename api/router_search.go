@@ -0,0 +1,64 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/internal"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+// Search godoc
+// @Summary Search lists, items and ingredients
+// @Description Full text search on the titles of the lists of the authenticated user, the notes of their
+// items and ingredient names and aliases.
+// Every word searched must match the start of a word of the record. Results are grouped by type
+// and sorted by rank, with the matched words between <mark> tags on Highlight and Snippet.
+// @Produces json
+// @Sucess 200 {object} internal.SearchResults
+// @Failure 400
+// @Failure 500
+// @Failure 503
+// @Router /api/search [get]
+// @Param q query string true "words to search"
+// @Param limit query int false "max results of each type, 10 by default"
+func Search(c *gin.Context, service *internal.SearchService) {
+	text := c.Query("q")
+	if text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing q parameter"})
+		return
+	}
+
+	limit := 10
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > 50 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit, must be between 1 and 50"})
+			return
+		}
+	}
+
+	results, err := service.Search(text, auth.UserID(c.Request), limit)
+	if errors.Is(err, internal.ErrSearchUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, results)
+}
+
+func GetSearchRoutes(group *gin.RouterGroup, db *gorm.DB) {
+	service := internal.SearchService{Database: db}
+	group.GET("search", adapter.Wrap(auth.EnsureValidToken()), func(c *gin.Context) {
+		Search(c, &service)
+	})
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/api/middleware"
+	"buylist/internal"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+// GetSettings godoc
+// @Summary Get user settings
+// @Description Returns the settings of the authenticated user.
+// @Produces json
+// @Sucess 200 {object} internal.UserSettings
+// @Failure 500
+// @Router /api/settings [get]
+func GetSettings(c *gin.Context, service *internal.UserSettingsService) {
+	settings, err := service.Get(auth.UserID(c.Request))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// UpdateSettings godoc
+// @Summary Update user settings
+// @Description Receives the settings of the authenticated user, like the email used on notifications.
+// MonthlyBudget is the grocery budget of a month, the budget.threshold_crossed event is published when
+// the projected spend of the month reaches each of the BudgetThresholds percents, 80 and 100 by default.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} internal.UserSettings
+// @Failure 400
+// @Failure 500
+// @Router /api/settings [put]
+func UpdateSettings(c *gin.Context, service *internal.UserSettingsService) {
+	var settings internal.UserSettings
+	if err := c.BindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	settings.UserID = auth.UserID(c.Request)
+	settings, err := service.Save(settings)
+	if errors.Is(err, internal.ErrInvalidBudget) || errors.Is(err, internal.ErrInvalidEmail) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// RegisterPhone godoc
+// @Summary Register phone for WhatsApp notifications
+// @Description Receives the phone number of the authenticated user and sends a verification code to it on WhatsApp.
+// The number only receives notifications after being verified. Up to 3 codes can be requested in an hour
+// by user and by number, and wrong codes tried count for the new codes requested in that hour.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} internal.PhoneNumber
+// @Failure 400
+// @Failure 429
+// @Failure 500
+// @Failure 503
+// @Router /api/settings/phone [put]
+func RegisterPhone(c *gin.Context, whatsapp *internal.WhatsAppNotifier) {
+	var phone struct {
+		Number string `binding:"required,e164"`
+	}
+	if err := c.ShouldBindJSON(&phone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	registered, err := whatsapp.RequestVerification(c.Request.Context(), auth.UserID(c.Request), phone.Number)
+	if errors.Is(err, internal.ErrVerificationLimit) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, registered)
+}
+
+// VerifyPhone godoc
+// @Summary Verify phone for WhatsApp notifications
+// @Description Receives the code sent to the phone of the authenticated user to verify it.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} internal.PhoneNumber
+// @Failure 400
+// @Failure 503
+// @Router /api/settings/phone/verify [post]
+func VerifyPhone(c *gin.Context, whatsapp *internal.WhatsAppNotifier) {
+	var verification struct {
+		Code string `binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&verification); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	phone, err := whatsapp.Verify(auth.UserID(c.Request), verification.Code)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, phone)
+}
+
+// DeletePhone godoc
+// @Summary Opt out of WhatsApp notifications
+// @Description Removes the phone number of the authenticated user.
+// @Sucess 204
+// @Failure 500
+// @Failure 503
+// @Router /api/settings/phone [delete]
+func DeletePhone(c *gin.Context, whatsapp *internal.WhatsAppNotifier) {
+	if err := whatsapp.OptOut(auth.UserID(c.Request)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func GetSettingsRoutes(group *gin.RouterGroup, db *gorm.DB, whatsapp *internal.WhatsAppNotifier) {
+	service := internal.UserSettingsService{Database: db}
+	settings := group.Group("settings")
+	{
+		settings.Use(adapter.Wrap(auth.EnsureValidToken()))
+		settings.GET("", func(c *gin.Context) {
+			GetSettings(c, &service)
+		})
+		settings.PUT("", func(c *gin.Context) {
+			UpdateSettings(c, &service)
+		})
+
+		phone := settings.Group("phone", middleware.RequireWhatsApp(whatsapp))
+		phone.PUT("", func(c *gin.Context) {
+			RegisterPhone(c, whatsapp)
+		})
+		phone.POST("/verify", func(c *gin.Context) {
+			VerifyPhone(c, whatsapp)
+		})
+		phone.DELETE("", func(c *gin.Context) {
+			DeletePhone(c, whatsapp)
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/api/middleware"
+	"buylist/internal"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+// FindStores godoc
+// @Summary Find stores
+// @Description Returns the stores of the authenticated user with their aisles in walking order.
+// @Produces json
+// @Sucess 200 {array} []internal.Store
+// @Failure 500
+// @Router /api/stores [get]
+func FindStores(c *gin.Context, service *internal.StoreService) {
+	stores, err := service.Find(auth.UserID(c.Request))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, stores)
+}
+
+// GetStoreById godoc
+// @Summary Get a store
+// @Description Returns the store with its aisles in walking order.
+// @Produces json
+// @Sucess 200 {object} internal.Store
+// @Failure 400
+// @Failure 404
+// @Router /api/stores/{id} [get]
+// @Param id path int true "store identifier"
+func GetStoreById(c *gin.Context, service *internal.StoreService) {
+	idNum := c.MustGet("idNum").(uint64)
+	store, err := service.Get(auth.UserID(c.Request), idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, store)
+}
+
+// CreateStore godoc
+// @Summary Create store
+// @Description Creates a store of the authenticated user with its Aisles in walking order. Each aisle has the
+// ingredient Categories found on it, used to sort buylists with the store param.
+// @Accepts json
+// @Produces json
+// @Sucess 201 {object} internal.Store
+// @Failure 400
+// @Failure 500
+// @Router /api/stores [post]
+func CreateStore(c *gin.Context, service *internal.StoreService) {
+	var store internal.Store
+	if err := c.ShouldBindJSON(&store); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	store.Owner = auth.UserID(c.Request)
+	store, err := service.Create(store)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, store)
+}
+
+// UpdateStore godoc
+// @Summary Update store
+// @Description Updates the store, its aisles are replaced by the Aisles sent.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {object} internal.Store
+// @Failure 400
+// @Failure 404
+// @Router /api/stores/{id} [put]
+// @Param id path int true "store identifier"
+func UpdateStore(c *gin.Context, service *internal.StoreService) {
+	idNum := c.MustGet("idNum").(uint64)
+	var store internal.Store
+	if err := c.ShouldBindJSON(&store); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	store.Owner = auth.UserID(c.Request)
+	store, err := service.Update(store, idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, store)
+}
+
+// DeleteStore godoc
+// @Summary Deletes a store
+// @Description Receives the identifier of a store and deletes it with its aisles.
+// @Produces json
+// @Sucess 200 {object} internal.Store
+// @Failure 400
+// @Failure 404
+// @Router /api/stores/{id} [delete]
+// @Param id path int true "store identifier"
+func DeleteStore(c *gin.Context, service *internal.StoreService) {
+	idNum := c.MustGet("idNum").(uint64)
+	store, err := service.Delete(auth.UserID(c.Request), idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, store)
+}
+
+func GetStoreRoutes(group *gin.RouterGroup, db *gorm.DB) {
+	service := internal.StoreService{Database: db}
+	stores := group.Group("stores")
+	{
+		stores.Use(adapter.Wrap(auth.EnsureValidToken()))
+		stores.GET("", func(c *gin.Context) {
+			FindStores(c, &service)
+		})
+		stores.GET("/:id", middleware.ValidateId(), func(c *gin.Context) {
+			GetStoreById(c, &service)
+		})
+		stores.POST("", func(c *gin.Context) {
+			CreateStore(c, &service)
+		})
+		stores.PUT("/:id", middleware.ValidateId(), func(c *gin.Context) {
+			UpdateStore(c, &service)
+		})
+		stores.DELETE("/:id", middleware.ValidateId(), func(c *gin.Context) {
+			DeleteStore(c, &service)
+		})
+	}
+}
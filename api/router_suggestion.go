@@ -0,0 +1,91 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/api/middleware"
+	"buylist/internal"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+// FindSuggestions godoc
+// @Summary Find ingredients the user is running out of
+// @Description Learns the typical interval between purchases of each ingredient on the lists of
+// the user and returns the ones due in the next days, that aren't pending on a list, soonest first.
+// Confidence, from 0 to 1, grows with the number of purchases and how regular they are.
+// @Produces json
+// @Sucess 200 {array} []internal.Suggestion
+// @Failure 400
+// @Failure 500
+// @Router /api/suggestions [get]
+// @Param days query int false "days ahead the ingredients are due, 2 by default"
+// @Param min_confidence query number false "minimum confidence of the suggestions"
+func FindSuggestions(c *gin.Context, service *internal.SuggestionService) {
+	suggestions, err := service.Due(auth.UserID(c.Request), c.GetInt("days"), c.GetFloat64("minConfidence"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, suggestions)
+}
+
+// ApplySuggestions godoc
+// @Summary Add the suggested ingredients to a buylist
+// @Description Adds the ingredients due for the user to one of its buylists, that aren't on it yet,
+// with their typical quantity. IngredientIDs chooses which of them are added.
+// Returns the items added.
+// @Accepts json
+// @Produces json
+// @Sucess 201 {array} []internal.BuyItem
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /api/buylist/{id}/suggestions/apply [post]
+// @Param id path int true "buylist identifier"
+// @Param days query int false "days ahead the ingredients are due, 2 by default"
+// @Param min_confidence query number false "minimum confidence of the suggestions"
+func ApplySuggestions(c *gin.Context, service *internal.SuggestionService) {
+	idNum := c.MustGet("idNum").(uint64)
+	var apply struct {
+		IngredientIDs []uint
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&apply); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	items, err := service.Apply(idNum, c.GetInt("days"), c.GetFloat64("minConfidence"), apply.IngredientIDs)
+	if errors.Is(err, internal.ErrBuyListNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, items)
+}
+
+func GetSuggestionRoutes(group *gin.RouterGroup, db *gorm.DB, events *internal.EventBus) {
+	service := internal.SuggestionService{Database: db, Events: events}
+	suggestions := group.Group("suggestions")
+	{
+		suggestions.Use(adapter.Wrap(auth.EnsureValidToken()))
+		suggestions.GET("", middleware.ValidateSuggestionParams(), func(c *gin.Context) {
+			FindSuggestions(c, &service)
+		})
+	}
+	buyLists := internal.BuyListService{Database: db}
+	authenticated, owned := adapter.Wrap(auth.EnsureValidToken()), middleware.RequireListOwner(&buyLists)
+	group.POST("/buylist/:id/suggestions/apply", authenticated, middleware.ValidateId(), owned, middleware.ValidateSuggestionParams(), func(c *gin.Context) {
+		ApplySuggestions(c, &service)
+	})
+}
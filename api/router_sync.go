@@ -0,0 +1,84 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/internal"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+// GetSyncChanges godoc
+// @Summary Get changes since last sync
+// @Description Returns the buylists and items of the authenticated user and the ingredients created,
+// updated or deleted since the cursor.
+// Deleted records have DeletedAt set. Without cursor returns every record.
+// The Cursor returned must be sent on the next sync.
+// @Produces json
+// @Sucess 200 {object} internal.SyncChanges
+// @Failure 400
+// @Failure 500
+// @Router /api/sync [get]
+// @Param since query string false "cursor returned by the last sync"
+func GetSyncChanges(c *gin.Context, service *internal.SyncService) {
+	since, err := internal.DecodeSyncCursor(c.Query("since"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	changes, err := service.Changes(auth.UserID(c.Request), since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
+
+// ApplySyncMutations godoc
+// @Summary Apply offline changes
+// @Description Receives a batch of mutations made while offline. Each mutation has an unique ID,
+// an Entity (buylist, item or ingredient), an Action (create, update or delete), the EntityID
+// changed, the ClientTimestamp of the change and its Data.
+// Mutations are idempotent, sending the same ID again returns the first result. A mutation sent
+// again while the first one is being applied answers with an Error and can be sent later.
+// Mutations of records changed on server after ClientTimestamp are not applied and
+// returned as conflicts with the server record.
+// @Accepts json
+// @Produces json
+// @Sucess 200 {array} []internal.SyncResult
+// @Failure 400
+// @Router /api/sync [post]
+func ApplySyncMutations(c *gin.Context, service *internal.SyncService) {
+	var batch struct {
+		Mutations []internal.SyncMutation `binding:"dive"`
+	}
+	if err := c.ShouldBindJSON(&batch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	results := service.Apply(auth.UserID(c.Request), batch.Mutations)
+	c.JSON(http.StatusOK, gin.H{"Results": results})
+}
+
+func GetSyncRoutes(group *gin.RouterGroup, db *gorm.DB, events *internal.EventBus) {
+	service := internal.SyncService{
+		Database:    db,
+		BuyLists:    &internal.BuyListService{Database: db, Events: events},
+		Ingredients: &internal.IngredientService{Database: db, Events: events},
+	}
+	sync := group.Group("sync")
+	{
+		sync.Use(adapter.Wrap(auth.EnsureValidToken()))
+		sync.GET("", func(c *gin.Context) {
+			GetSyncChanges(c, &service)
+		})
+		sync.POST("", func(c *gin.Context) {
+			ApplySyncMutations(c, &service)
+		})
+	}
+}
@@ -1,24 +1,40 @@
 package api
 
 import (
+	"bufio"
 	"buylist/api/auth"
 	"buylist/internal"
 	"buylist/internal/database"
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/gorm"
@@ -32,11 +48,44 @@ func LoadEnv() {
 	}
 }
 
+// Key signing the tokens of the tests, the Auth0 tenant isn't reachable.
+var signingKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+// User the tests are authenticated as.
+const testUser = "auth0|tester"
+
+// Token of the user signed by signingKey.
+func token(userID string) string {
+	encode := func(value interface{}) string {
+		data, _ := json.Marshal(value)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	now := time.Now().Unix()
+	signed := encode(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encode(map[string]interface{}{
+		"iss": os.Getenv("AUTH0_DOMAIN"),
+		"aud": []string{os.Getenv("AUTH0_AUDIENCE")},
+		"sub": userID,
+		"iat": now,
+		"exp": now + 3600,
+	})
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, signingKey, crypto.SHA256, digest[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Authenticate the request as the user.
+func authorize(req *http.Request, userID string) *http.Request {
+	req.Header.Set("Authorization", "Bearer "+token(userID))
+	return req
+}
+
 func setup() (*gin.Engine, *httptest.ResponseRecorder, *gorm.DB) {
 	LoadEnv()
 	db := database.GetDatabaseConnection()
+	auth.UseSigningKey(&signingKey.PublicKey)
 	auth, _ := auth.New()
-	router := GetRouter(db, auth)
+	router := GetRouter(db, auth, &testNotifier{}, nil)
 	recorder := httptest.NewRecorder()
 	return router, recorder, db
 }
@@ -50,7 +99,7 @@ func TestIngredientCreate(t *testing.T) {
 	body := bytes.NewBuffer(ingredientJson)
 
 	req, _ := http.NewRequest("POST", "/api/ingredient", body)
-	router.ServeHTTP(recorder, req)
+	router.ServeHTTP(recorder, authorize(req, testUser))
 
 	assert.Equal(t, http.StatusCreated, recorder.Code)
 	var result internal.Ingredient
@@ -62,12 +111,12 @@ func TestIngredientCreate(t *testing.T) {
 func TestIngredientUpdate(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	service := &internal.IngredientService{Database: db}
-	ingredient, _ := service.Create("test", "testing")
+	ingredient, _ := service.Create(internal.Ingredient{Name: "test", OriginType: "testing"})
 	ingredientJson, _ := json.Marshal(ingredient)
 	jsonBody := bytes.NewBuffer(ingredientJson)
 
 	req, _ := http.NewRequest("PUT", "/api/ingredient/"+strconv.FormatUint(uint64(ingredient.ID), 10), jsonBody)
-	router.ServeHTTP(recorder, req)
+	router.ServeHTTP(recorder, authorize(req, testUser))
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 	var result internal.Ingredient
@@ -76,15 +125,36 @@ func TestIngredientUpdate(t *testing.T) {
 	assert.Equal(t, ingredient.ID, result.ID)
 	assert.Equal(t, ingredient.Name, result.Name)
 	assert.Equal(t, ingredient.OriginType, result.OriginType)
+
+	// the creation date is kept when not sent
+	recorder = httptest.NewRecorder()
+	body := fmt.Sprintf(`{"ID": %d, "Name": "renamed", "OriginType": "testing"}`, ingredient.ID)
+	req, _ = http.NewRequest("PUT", "/api/ingredient/"+strconv.FormatUint(uint64(ingredient.ID), 10), strings.NewReader(body))
+	router.ServeHTTP(recorder, authorize(req, testUser))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	stored, _ := service.Get(ingredient.ID)
+	assert.Equal(t, "renamed", stored.Name)
+	assert.True(t, ingredient.CreatedAt.Equal(stored.CreatedAt))
+
+	// ingredients of another identifier are not updated
+	recorder = httptest.NewRecorder()
+	body = fmt.Sprintf(`{"ID": %d, "Name": "mismatched"}`, ingredient.ID+1)
+	req, _ = http.NewRequest("PUT", "/api/ingredient/"+strconv.FormatUint(uint64(ingredient.ID), 10), strings.NewReader(body))
+	router.ServeHTTP(recorder, authorize(req, testUser))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("ETag"))
+	assert.True(t, json.Valid(recorder.Body.Bytes()))
+	stored, _ = service.Get(ingredient.ID)
+	assert.Equal(t, "renamed", stored.Name)
 }
 
 func TestIngredientDelete(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	service := &internal.IngredientService{Database: db}
-	ingredient, _ := service.Create("test delete", "testing")
+	ingredient, _ := service.Create(internal.Ingredient{Name: "test delete", OriginType: "testing"})
 
 	req, _ := http.NewRequest("DELETE", "/api/ingredient/"+strconv.FormatUint(uint64(ingredient.ID), 10), nil)
-	router.ServeHTTP(recorder, req)
+	router.ServeHTTP(recorder, authorize(req, testUser))
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 	var result internal.Ingredient
@@ -98,13 +168,10 @@ func TestIngredientDelete(t *testing.T) {
 func TestIngredientFind(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	service := &internal.IngredientService{Database: db}
-	ingredient, _ := service.Create("test find", "testing")
+	ingredient, _ := service.Create(internal.Ingredient{Name: "test find", OriginType: "testing"})
 
 	req, _ := http.NewRequest("GET", "/api/ingredient", nil)
-	token := getTestJwtToken()
-	bearerHeader := fmt.Sprintf("Bearer %s", token.AcessToken)
-	req.Header.Add("Authorization", bearerHeader)
-	router.ServeHTTP(recorder, req)
+	router.ServeHTTP(recorder, authorize(req, testUser))
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
@@ -125,7 +192,7 @@ func TestIngredientFind(t *testing.T) {
 
 func TestIngredientFindByParams(t *testing.T) {
 	service := &internal.IngredientService{Database: db}
-	ingredient, _ := service.Create("test find", "testing")
+	ingredient, _ := service.Create(internal.Ingredient{Name: "test find", OriginType: "testing"})
 
 	query := []string{
 		"name=find",
@@ -136,7 +203,7 @@ func TestIngredientFindByParams(t *testing.T) {
 	for _, param := range query {
 		recorder := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/ingredient?%s", param), nil)
-		router.ServeHTTP(recorder, req)
+		router.ServeHTTP(recorder, authorize(req, testUser))
 
 		assert.Equal(t, http.StatusOK, recorder.Code)
 
@@ -176,7 +243,7 @@ func TestBuyListCreate(t *testing.T) {
 	// println(string(buylistJson))
 
 	req, _ := http.NewRequest("POST", "/api/buylist", body)
-	router.ServeHTTP(recorder, req)
+	router.ServeHTTP(recorder, authorize(req, testUser))
 
 	assert.Equal(t, http.StatusCreated, recorder.Code)
 	var result internal.BuyList
@@ -188,13 +255,25 @@ func TestBuyListCreate(t *testing.T) {
 		assert.Equal(t, item.Ingredient.Name, result.Items[i].Ingredient.Name)
 		assert.Equal(t, item.Ingredient.OriginType, result.Items[i].Ingredient.OriginType)
 	}
+	assert.Equal(t, testUser, result.Owner)
+
+	// lists are only reachable by their owner
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/buylist/"+strconv.FormatUint(uint64(result.ID), 10), nil)
+	router.ServeHTTP(recorder, authorize(req, "auth0|other"))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/buylist/"+strconv.FormatUint(uint64(result.ID), 10), nil)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
 }
 
 func TestBuyListUpdate(t *testing.T) {
 	recorder := httptest.NewRecorder()
 
 	service := internal.BuyListService{Database: db}
-	buylist := internal.BuyList{Title: "Testing list",
+	buylist := internal.BuyList{Title: "Testing list", Owner: testUser,
 		Items: []internal.BuyItem{
 			{
 				Ingredient: internal.Ingredient{
@@ -223,7 +302,7 @@ func TestBuyListUpdate(t *testing.T) {
 	body := bytes.NewBuffer(updateBuyList)
 
 	req, _ := http.NewRequest("PUT", "/api/buylist/"+strconv.FormatUint(uint64(buylist.ID), 10), body)
-	router.ServeHTTP(recorder, req)
+	router.ServeHTTP(recorder, authorize(req, testUser))
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
@@ -244,6 +323,7 @@ func TestBuyListDelete(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	service := internal.BuyListService{Database: db}
 	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
 		Title: "testing",
 		Items: []internal.BuyItem{
 			{
@@ -257,7 +337,7 @@ func TestBuyListDelete(t *testing.T) {
 	})
 
 	req, _ := http.NewRequest("DELETE", "/api/buylist/"+strconv.FormatUint(uint64(list.ID), 10), nil)
-	router.ServeHTTP(recorder, req)
+	router.ServeHTTP(recorder, authorize(req, testUser))
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 	var result internal.BuyList
@@ -276,6 +356,7 @@ func TestBuyListDelete(t *testing.T) {
 func TestBuyListFindByParams(t *testing.T) {
 	service := internal.BuyListService{Database: db}
 	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
 		Title: "testing",
 		Items: []internal.BuyItem{
 			{
@@ -308,7 +389,7 @@ func TestBuyListFindByParams(t *testing.T) {
 	for _, param := range query {
 		recorder := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", "/api/buylist?"+param.Encode(), nil)
-		router.ServeHTTP(recorder, req)
+		router.ServeHTTP(recorder, authorize(req, testUser))
 
 		assert.Equal(t, http.StatusOK, recorder.Code)
 
@@ -336,6 +417,7 @@ func TestBuyListFindByParams(t *testing.T) {
 func TestBuyListFind(t *testing.T) {
 	service := internal.BuyListService{Database: db}
 	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
 		Title: "testing",
 		Items: []internal.BuyItem{
 			{
@@ -350,7 +432,7 @@ func TestBuyListFind(t *testing.T) {
 
 	recorder := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/api/buylist", nil)
-	router.ServeHTTP(recorder, req)
+	router.ServeHTTP(recorder, authorize(req, testUser))
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
@@ -374,27 +456,2034 @@ func TestBuyListFind(t *testing.T) {
 	}
 }
 
-func getTestJwtToken() auth.Auth0JwtToken {
-	issuerUrl, err := url.Parse(os.Getenv(("AUTH0_DOMAIN")))
-	if err != nil {
-		log.Fatalf("Failed to parse issuer url %v", err)
+type testNotifier struct {
+	channel       string
+	failures      int
+	notifications []internal.Notification
+}
+
+func (notifier *testNotifier) Notify(ctx context.Context, notification internal.Notification) error {
+	if notifier.failures > 0 {
+		notifier.failures--
+		return errors.New("channel unavailable")
 	}
+	notifier.notifications = append(notifier.notifications, notification)
+	return nil
+}
 
-	issuerUrl = issuerUrl.JoinPath("/oauth").JoinPath("/token")
-	clientId := os.Getenv("AUTH0_CLIENT_ID")
-	clientSecret := os.Getenv("AUTH0_CLIENT_SECRET")
-	audienceUrl := os.Getenv("AUTH0_AUDIENCE")
-	grantType := "client_credentials"
+func (notifier *testNotifier) Channel() string {
+	return notifier.channel
+}
 
-	payload := strings.NewReader(fmt.Sprintf("{\"client_id\":\"%s\",\"client_secret\":\"%s\",\"audience\":\"%s\",\"grant_type\":\"%s\"}", clientId, clientSecret, audienceUrl, grantType))
+func TestBuyListReminders(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	scheduledFor := time.Now().Add(3 * time.Hour)
+	buylist := &internal.BuyList{
+		Title:        "Scheduled list",
+		ScheduledFor: &scheduledFor,
+		Reminders: []internal.Reminder{
+			{OffsetMinutes: 24 * 60},
+			{OffsetMinutes: 60},
+		},
+	}
+	buylistJson, _ := json.Marshal(buylist)
+
+	req, _ := http.NewRequest("POST", "/api/buylist", bytes.NewBuffer(buylistJson))
+	router.ServeHTTP(recorder, authorize(req, testUser))
 
-	req, _ := http.Post(issuerUrl.String(), "application/json", payload)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var result internal.BuyList
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	assert.Equal(t, 2, len(result.Reminders))
+	assert.True(t, result.Reminders[0].FireAt.Equal(scheduledFor.Add(-24*time.Hour)))
+
+	notifier := &testNotifier{}
+	scheduler := internal.ReminderScheduler{Database: db, Notifier: notifier}
+	scheduler.DispatchDue(context.Background(), time.Now())
+
+	sent := 0
+	for _, notification := range notifier.notifications {
+		if notification.BuyList.ID == result.ID {
+			sent++
+			assert.Equal(t, uint(24*60), notification.Reminder.OffsetMinutes)
+		}
+	}
+	assert.Equal(t, 1, sent)
+
+	// reminders already sent are not sent again
+	notifier.notifications = nil
+	scheduler.DispatchDue(context.Background(), time.Now())
+	for _, notification := range notifier.notifications {
+		assert.NotEqual(t, result.ID, notification.BuyList.ID)
+	}
 
-	result := auth.Auth0JwtToken{}
-	if req.StatusCode != http.StatusOK {
-		panic("Can't get Auth0 test token")
+	// a retry only goes through the channels that failed
+	service := internal.BuyListService{Database: db}
+	list, _ := service.Create(internal.BuyList{Title: "retried reminder", Owner: testUser, ScheduledFor: &scheduledFor,
+		Reminders: []internal.Reminder{{OffsetMinutes: 24 * 60}}})
+	delivered := &testNotifier{channel: "delivered"}
+	failing := &testNotifier{channel: "failing", failures: 1}
+	scheduler.Notifier = internal.MultiNotifier{delivered, failing}
+	received := func(notifier *testNotifier) int {
+		count := 0
+		for _, notification := range notifier.notifications {
+			if notification.BuyList.ID == list.ID {
+				count++
+			}
+		}
+		return count
+	}
+	scheduler.DispatchDue(context.Background(), time.Now())
+	assert.Equal(t, 1, received(delivered))
+	assert.Equal(t, 0, received(failing))
+	scheduler.DispatchDue(context.Background(), time.Now())
+	assert.Equal(t, 1, received(delivered))
+	assert.Equal(t, 1, received(failing))
+	service.Delete(uint64(list.ID), 0)
+}
+
+// Minimal SMTP server that keeps the messages received in memory.
+type testSMTPServer struct {
+	listener net.Listener
+	messages chan string
+}
+
+func newTestSMTPServer() *testSMTPServer {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := &testSMTPServer{listener: listener, messages: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(textproto.NewConn(conn))
+		}
+	}()
+	return server
+}
+
+func (server *testSMTPServer) serve(conn *textproto.Conn) {
+	defer conn.Close()
+	conn.PrintfLine("220 localhost ready")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "DATA":
+			conn.PrintfLine("354 send data")
+			data, _ := conn.ReadDotBytes()
+			server.messages <- string(data)
+			conn.PrintfLine("250 ok")
+		case "QUIT":
+			conn.PrintfLine("221 bye")
+			return
+		default:
+			conn.PrintfLine("250 ok")
+		}
 	}
-	body, _ := io.ReadAll(req.Body)
-	json.Unmarshal(body, &result)
-	return result
+}
+
+func TestBuyListShareEmail(t *testing.T) {
+	smtpServer := newTestSMTPServer()
+	defer smtpServer.listener.Close()
+	notifier := &internal.EmailNotifier{
+		Database: db,
+		Addr:     smtpServer.listener.Addr().String(),
+		From:     "buylist@localhost",
+	}
+	emailRouter := GetRouter(db, nil, notifier, nil)
+	db.Unscoped().Where("owner = ?", testUser).Delete(&internal.ListShare{})
+
+	service := internal.BuyListService{Database: db}
+	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "shared list",
+		Items: []internal.BuyItem{
+			{Ingredient: internal.Ingredient{Name: "milk", Category: "dairy"}, Quantity: 2},
+			{Ingredient: internal.Ingredient{Name: "bread", Category: "bakery"}, Quantity: 1},
+		},
+	})
+
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"Email": "friend@example.com"}`)
+	req, _ := http.NewRequest("POST", "/api/buylist/"+strconv.FormatUint(uint64(list.ID), 10)+"/share", body)
+	emailRouter.ServeHTTP(recorder, authorize(req, testUser))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	select {
+	case message := <-smtpServer.messages:
+		assert.Contains(t, message, "To: friend@example.com")
+		assert.Contains(t, message, "text/html")
+		assert.Less(t, strings.Index(message, "bakery"), strings.Index(message, "dairy"))
+		assert.Contains(t, message, "2 x milk")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Email was not sent")
+	}
+
+	var outbox internal.OutboxEmail
+	db.Where("\"to\" = ?", "friend@example.com").Last(&outbox)
+	assert.NotNil(t, outbox.SentAt)
+
+	// copies emailed are recorded and limited by user
+	var shares []internal.ListShare
+	db.Where("owner = ?", testUser).Find(&shares)
+	assert.Equal(t, 1, len(shares))
+	assert.Equal(t, "friend@example.com", shares[0].Recipient)
+	for i := len(shares); i < 10; i++ {
+		db.Create(&internal.ListShare{BuyListID: list.ID, Owner: testUser, Recipient: "friend@example.com"})
+	}
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/buylist/"+strconv.FormatUint(uint64(list.ID), 10)+"/share", strings.NewReader(`{"Email": "friend@example.com"}`))
+	emailRouter.ServeHTTP(recorder, authorize(req, testUser))
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	db.Unscoped().Where("owner = ?", testUser).Delete(&internal.ListShare{})
+
+	for email, code := range map[string]int{"friend@example.com": http.StatusOK, "not an email": http.StatusBadRequest, "Friend <friend@example.com>": http.StatusBadRequest} {
+		recorder = httptest.NewRecorder()
+		req, _ = http.NewRequest("PUT", "/api/settings", strings.NewReader(fmt.Sprintf(`{"Email": %q}`, email)))
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		assert.Equal(t, code, recorder.Code, email)
+	}
+}
+
+func TestEmailOutboxRetry(t *testing.T) {
+	failures := 1
+	sent := 0
+	notifier := &internal.EmailNotifier{
+		Database: db,
+		Backoff:  time.Minute,
+		SendMail: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			if failures > 0 {
+				failures--
+				return errors.New("server unavailable")
+			}
+			sent++
+			return nil
+		},
+	}
+
+	err := notifier.Notify(context.Background(), internal.Notification{
+		Kind:      internal.NotificationReminder,
+		Recipient: "retry@localhost",
+		BuyList:   internal.BuyList{Title: "retry"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sent)
+
+	// backoff didn't pass yet
+	notifier.FlushOutbox(time.Now())
+	assert.Equal(t, 0, sent)
+
+	notifier.FlushOutbox(time.Now().Add(2 * time.Minute))
+	assert.Equal(t, 1, sent)
+}
+
+func TestWhatsAppNotification(t *testing.T) {
+	var sent []string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			To   string `json:"to"`
+			Text struct {
+				Body string `json:"body"`
+			} `json:"text"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		sent = append(sent, payload.Text.Body)
+		fmt.Fprintf(w, `{"messages": [{"id": "wamid.%d"}]}`, time.Now().UnixNano())
+	}))
+	defer provider.Close()
+
+	whatsapp := &internal.WhatsAppNotifier{Database: db, Endpoint: provider.URL}
+	whatsappRouter := GetRouter(db, nil, whatsapp, whatsapp)
+	userID := fmt.Sprintf("whatsapp|%d", time.Now().UnixNano())
+	number := fmt.Sprintf("+5511%09d", time.Now().UnixNano()%1000000000)
+
+	phone, err := whatsapp.RequestVerification(context.Background(), userID, number)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(sent))
+	assert.Contains(t, sent[0], phone.VerificationCode)
+
+	// not verified numbers are not notified
+	list := internal.BuyList{Title: "whatsapp list", Owner: userID, Items: []internal.BuyItem{
+		{Ingredient: internal.Ingredient{Name: "eggs", Category: "dairy"}, Quantity: 12},
+	}}
+	whatsapp.Notify(context.Background(), internal.Notification{Kind: internal.NotificationReminder, Owner: userID, BuyList: list})
+	assert.Equal(t, 1, len(sent))
+
+	_, err = whatsapp.Verify(userID, "wrong")
+	assert.NotNil(t, err)
+	_, err = whatsapp.Verify(userID, phone.VerificationCode)
+	assert.Nil(t, err)
+
+	err = whatsapp.Notify(context.Background(), internal.Notification{Kind: internal.NotificationReminder, Owner: userID, BuyList: list})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(sent))
+	assert.Contains(t, sent[1], "*whatsapp list*")
+	assert.Contains(t, sent[1], "12 x eggs")
+
+	var message internal.WhatsAppMessage
+	db.Where("\"to\" = ? and kind = ?", number, internal.NotificationReminder).Last(&message)
+	assert.Equal(t, internal.WhatsAppStatusSent, message.Status)
+
+	callback := fmt.Sprintf(`{"entry": [{"changes": [{"value": {"statuses": [{"id": "%s", "status": "delivered", "timestamp": "1700000000"}]}}]}]}`, message.ProviderMessageID)
+	postCallback := func(signature string) int {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/whatsapp/status", strings.NewReader(callback))
+		req.Header.Set("X-Hub-Signature-256", signature)
+		whatsappRouter.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	mac := hmac.New(sha256.New, []byte("app secret"))
+	mac.Write([]byte(callback))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	// callbacks can't be verified without the secret
+	t.Setenv("WHATSAPP_APP_SECRET", "")
+	assert.Equal(t, http.StatusServiceUnavailable, postCallback(signature))
+	t.Setenv("WHATSAPP_APP_SECRET", "app secret")
+	assert.Equal(t, http.StatusUnauthorized, postCallback("sha256=forged"))
+	assert.Equal(t, http.StatusOK, postCallback(signature))
+
+	db.First(&message, message.ID)
+	assert.Equal(t, internal.WhatsAppStatusDelivered, message.Status)
+
+	// codes are invalidated after too many wrong attempts
+	phone, _ = whatsapp.RequestVerification(context.Background(), userID, number)
+	for i := 0; i < 5; i++ {
+		_, err = whatsapp.Verify(userID, "wrong")
+		assert.NotNil(t, err)
+	}
+	_, err = whatsapp.Verify(userID, phone.VerificationCode)
+	assert.NotNil(t, err)
+	// and a new code doesn't give new attempts
+	_, err = whatsapp.RequestVerification(context.Background(), userID, number)
+	assert.ErrorIs(t, err, internal.ErrVerificationLimit)
+
+	// codes requested to a number are limited for every user
+	_, err = whatsapp.RequestVerification(context.Background(), userID+"-other", number)
+	assert.Nil(t, err)
+	_, err = whatsapp.RequestVerification(context.Background(), userID+"-another", number)
+	assert.ErrorIs(t, err, internal.ErrVerificationLimit)
+	sentCount := len(sent)
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/api/settings/phone", strings.NewReader(fmt.Sprintf(`{"Number": %q}`, number)))
+	whatsappRouter.ServeHTTP(recorder, authorize(req, userID+"-other"))
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, sentCount, len(sent))
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	type received struct {
+		event     string
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan received, 10)
+	var fail atomic.Bool
+	fail.Store(true)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- received{r.Header.Get("X-Buylist-Event"), r.Header.Get("X-Buylist-Signature"), body}
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	userID := fmt.Sprintf("webhook|%d", time.Now().UnixNano())
+	createWebhook := func(url string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		body, _ := json.Marshal(gin.H{"URL": url, "Events": []string{internal.EventItemPurchased, internal.EventBuyListCompleted}})
+		req, _ := http.NewRequest("POST", "/api/webhooks", bytes.NewBuffer(body))
+		router.ServeHTTP(recorder, authorize(req, userID))
+		return recorder
+	}
+
+	// webhooks can't reach the network of the server
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "")
+	for _, url := range []string{receiver.URL, "http://localhost/hook", "http://169.254.169.254/latest", "http://10.0.0.1/hook", "ftp://example.com/hook"} {
+		assert.Equal(t, http.StatusBadRequest, createWebhook(url).Code, url)
+	}
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+
+	recorder := createWebhook(receiver.URL)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var webhook NewWebhook
+	json.Unmarshal(recorder.Body.Bytes(), &webhook)
+	assert.NotEmpty(t, webhook.Secret)
+	webhook.Webhook.Secret = webhook.Secret
+
+	// the secret is only shown on creation
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/webhooks", nil)
+	router.ServeHTTP(recorder, authorize(req, userID))
+	assert.Contains(t, recorder.Body.String(), receiver.URL)
+	assert.NotContains(t, recorder.Body.String(), webhook.Secret)
+
+	// events of the lists created by the user are delivered to its webhooks
+	recorder = httptest.NewRecorder()
+	body, _ := json.Marshal(internal.BuyList{
+		Title: "webhook list",
+		Items: []internal.BuyItem{{Ingredient: internal.Ingredient{Name: "rice"}, Quantity: 1}},
+	})
+	req, _ = http.NewRequest("POST", "/api/buylist", bytes.NewBuffer(body))
+	router.ServeHTTP(recorder, authorize(req, userID))
+	var list internal.BuyList
+	json.Unmarshal(recorder.Body.Bytes(), &list)
+	assert.Equal(t, userID, list.Owner)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/buylist/%d/items/%d/purchased", list.ID, list.Items[0].ID), strings.NewReader(`{"Purchased": true}`))
+	router.ServeHTTP(recorder, authorize(req, userID))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	eventTypes := []string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case delivery := <-deliveries:
+			eventTypes = append(eventTypes, delivery.event)
+			assert.Equal(t, internal.SignWebhookPayload(webhook.Secret, delivery.body), delivery.signature)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook was not delivered")
+		}
+	}
+	assert.ElementsMatch(t, []string{internal.EventItemPurchased, internal.EventBuyListCompleted}, eventTypes)
+
+	// failed deliveries are retried
+	fail.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	dispatcher := &internal.WebhookDispatcher{Database: db}
+	dispatcher.RetryDue(time.Now().Add(time.Minute))
+	<-deliveries
+	<-deliveries
+
+	webhookService := internal.WebhookService{Database: db}
+	history, _ := webhookService.Deliveries(webhook.Webhook, 10)
+	assert.Equal(t, 2, len(history))
+	for _, delivery := range history {
+		assert.NotNil(t, delivery.DeliveredAt)
+		assert.Equal(t, 2, len(delivery.Attempts))
+	}
+
+	redelivered, err := dispatcher.Redeliver(webhook.Webhook, uint64(history[0].ID))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(redelivered.Attempts))
+	assert.Equal(t, history[0].EventType, (<-deliveries).event)
+
+	// addresses are checked again on delivery
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "")
+	redelivered, err = dispatcher.Redeliver(webhook.Webhook, uint64(history[0].ID))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(redelivered.Attempts))
+	assert.Contains(t, redelivered.Attempts[3].Error, internal.ErrWebhookTarget.Error())
+
+	// ingredients are shared, their events need an explicit subscription
+	assert.False(t, internal.Webhook{Events: []string{"*"}}.Subscribed(internal.EventIngredientCreated))
+	assert.True(t, internal.Webhook{Events: []string{internal.EventIngredientCreated}}.Subscribed(internal.EventIngredientCreated))
+}
+
+// Read the next event of a Server-Sent Events stream.
+func readServerSentEvent(reader *bufio.Reader) map[string]string {
+	event := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return event
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" && len(event) > 0 {
+			return event
+		}
+		field := strings.SplitN(line, ":", 2)
+		if len(field) == 2 && field[0] != "" {
+			event[field[0]] = strings.TrimSpace(field[1])
+		}
+	}
+}
+
+func TestBuyListEvents(t *testing.T) {
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	service := internal.BuyListService{Database: db}
+	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "streamed list",
+		Items: []internal.BuyItem{{Ingredient: internal.Ingredient{Name: "coffee"}, Quantity: 1}},
+	})
+	listURL := fmt.Sprintf("%s/api/buylist/%d", server.URL, list.ID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", listURL+"/events", nil)
+	stream, err := http.DefaultClient.Do(authorize(req, testUser))
+	assert.Nil(t, err)
+	assert.Equal(t, "text/event-stream", stream.Header.Get("Content-Type"))
+	reader := bufio.NewReader(stream.Body)
+
+	postItem, _ := http.NewRequest("POST", listURL+"/items", strings.NewReader(`{"Quantity": 3, "Ingredient": {"Name": "sugar"}}`))
+	resp, _ := http.DefaultClient.Do(authorize(postItem, testUser))
+	var added internal.BuyItem
+	json.NewDecoder(resp.Body).Decode(&added)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	event := readServerSentEvent(reader)
+	assert.Equal(t, internal.EventItemAdded, event["event"])
+	assert.Equal(t, "1", event["id"])
+	assert.Contains(t, event["data"], "sugar")
+
+	putPurchased, _ := http.NewRequest("PUT", fmt.Sprintf("%s/items/%d/purchased", listURL, added.ID), strings.NewReader(`{"Purchased": true}`))
+	http.DefaultClient.Do(authorize(putPurchased, testUser))
+	event = readServerSentEvent(reader)
+	assert.Equal(t, internal.EventItemPurchased, event["event"])
+	assert.Equal(t, "2", event["id"])
+	cancel()
+	stream.Body.Close()
+
+	// resume after the first event
+	deleteItem, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/items/%d", listURL, added.ID), nil)
+	http.DefaultClient.Do(authorize(deleteItem, testUser))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, "GET", listURL+"/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	stream, err = http.DefaultClient.Do(authorize(req, testUser))
+	assert.Nil(t, err)
+	defer stream.Body.Close()
+	reader = bufio.NewReader(stream.Body)
+	assert.Equal(t, internal.EventItemPurchased, readServerSentEvent(reader)["event"])
+	assert.Equal(t, internal.EventItemRemoved, readServerSentEvent(reader)["event"])
+}
+
+func TestListHubHistory(t *testing.T) {
+	hub := internal.NewListHub(10, time.Hour)
+	now := time.Now()
+	hub.Publish(internal.Event{Type: internal.EventItemAdded, BuyListID: 1, OccurredAt: now})
+	hub.Publish(internal.Event{Type: internal.EventItemAdded, BuyListID: 2, OccurredAt: now})
+	missed, complete, _, cancel := hub.Subscribe(1, 0)
+	cancel()
+	assert.True(t, complete)
+	assert.Equal(t, 1, len(missed))
+
+	// history of deleted lists is dropped
+	hub.Publish(internal.Event{Type: internal.EventBuyListDeleted, BuyListID: 1, OccurredAt: now})
+	missed, complete, _, cancel = hub.Subscribe(1, 1)
+	cancel()
+	assert.False(t, complete)
+	assert.Equal(t, 0, len(missed))
+
+	// and the one of lists without events for the max age
+	hub.Publish(internal.Event{Type: internal.EventItemAdded, BuyListID: 3, OccurredAt: now.Add(2 * time.Hour)})
+	missed, complete, _, cancel = hub.Subscribe(2, 0)
+	cancel()
+	assert.Equal(t, 0, len(missed))
+	missed, _, _, cancel = hub.Subscribe(3, 0)
+	cancel()
+	assert.Equal(t, 1, len(missed))
+}
+
+func TestBuyListCollaboration(t *testing.T) {
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	service := internal.BuyListService{Database: db}
+	list, _ := service.Create(internal.BuyList{Title: "shared editing", Owner: testUser})
+	wsURL := fmt.Sprintf("ws%s/api/buylist/%d/ws", strings.TrimPrefix(server.URL, "http"), list.ID)
+
+	type message struct {
+		Type    string
+		Clock   uint64
+		List    *internal.BuyList
+		Event   *internal.ListEvent
+		Results []internal.OperationResult
+	}
+	connect := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + token(testUser)}})
+		assert.Nil(t, err)
+		var snapshot message
+		conn.ReadJSON(&snapshot)
+		assert.Equal(t, "snapshot", snapshot.Type)
+		return conn
+	}
+	// read messages until the one of the type
+	read := func(conn *websocket.Conn, messageType string) message {
+		for {
+			var received message
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.ReadJSON(&received); err != nil {
+				t.Fatal(err)
+			}
+			if received.Type == messageType {
+				return received
+			}
+		}
+	}
+
+	// browsers can only connect from the allowed origins
+	header := http.Header{"Authorization": {"Bearer " + token(testUser)}, "Origin": {"https://elsewhere.example"}}
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	t.Setenv("ALLOWED_ORIGINS", "https://app.example, https://elsewhere.example")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	assert.Nil(t, err)
+	conn.Close()
+
+	alice := connect()
+	defer alice.Close()
+	bob := connect()
+	defer bob.Close()
+
+	alice.WriteJSON(map[string]interface{}{"Operations": []internal.Operation{{
+		Type:    internal.OperationAddItem,
+		Stamp:   internal.Stamp{Clock: 1, Replica: "alice"},
+		ItemKey: "alice-1",
+		Item:    &internal.BuyItem{Quantity: 1, Ingredient: internal.Ingredient{Name: "apple"}},
+	}}})
+	ack := read(alice, "ack")
+	assert.True(t, ack.Results[0].Applied)
+	event := read(bob, "event")
+	assert.Equal(t, internal.EventItemAdded, event.Event.Type)
+
+	// concurrent changes of the same item converge to the same value
+	alice.WriteJSON(map[string]interface{}{"Operations": []internal.Operation{
+		{Type: internal.OperationSetQuantity, Stamp: internal.Stamp{Clock: 2, Replica: "alice"}, ItemKey: "alice-1", Quantity: 5},
+		{Type: internal.OperationSetPurchased, Stamp: internal.Stamp{Clock: 3, Replica: "alice"}, ItemKey: "alice-1", Purchased: true},
+	}})
+	read(alice, "ack")
+	bob.WriteJSON(map[string]interface{}{"Operations": []internal.Operation{
+		{Type: internal.OperationSetQuantity, Stamp: internal.Stamp{Clock: 2, Replica: "bob"}, ItemKey: "alice-1", Quantity: 7},
+		{Type: internal.OperationSetQuantity, Stamp: internal.Stamp{Clock: 1, Replica: "bob"}, ItemKey: "alice-1", Quantity: 9},
+		{Type: internal.OperationAddItem, Stamp: internal.Stamp{Clock: 2, Replica: "bob"}, ItemKey: "bob-1",
+			Item: &internal.BuyItem{Quantity: 2, Ingredient: internal.Ingredient{Name: "pear"}}},
+	}})
+	ack = read(bob, "ack")
+	assert.True(t, ack.Results[0].Applied)
+	assert.False(t, ack.Results[1].Applied)
+	assert.True(t, ack.Results[2].Applied)
+	assert.Equal(t, uint64(3), ack.Clock)
+
+	stored, _ := service.Get(uint64(list.ID))
+	assert.Equal(t, 2, len(stored.Items))
+	assert.Equal(t, uint(7), stored.Items[0].Quantity)
+	assert.True(t, stored.Items[0].Purchased)
+	assert.Equal(t, "pear", stored.Items[1].Ingredient.Name)
+
+	// removes win over concurrent changes
+	alice.WriteJSON(map[string]interface{}{"Operations": []internal.Operation{
+		{Type: internal.OperationRemoveItem, Stamp: internal.Stamp{Clock: 4, Replica: "alice"}, ItemKey: "bob-1"},
+		{Type: internal.OperationMoveItem, Stamp: internal.Stamp{Clock: 5, Replica: "alice"}, ItemKey: "bob-1", Position: 0.5},
+	}})
+	ack = read(alice, "ack")
+	assert.True(t, ack.Results[0].Applied)
+	assert.False(t, ack.Results[1].Applied)
+
+	stored, _ = service.Get(uint64(list.ID))
+	assert.Equal(t, 1, len(stored.Items))
+}
+
+func TestSync(t *testing.T) {
+	getChanges := func(cursor string) internal.SyncChanges {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/sync?since="+cursor, nil)
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var changes internal.SyncChanges
+		json.Unmarshal(recorder.Body.Bytes(), &changes)
+		return changes
+	}
+	postMutations := func(mutations []internal.SyncMutation) []internal.SyncResult {
+		recorder := httptest.NewRecorder()
+		body, _ := json.Marshal(gin.H{"Mutations": mutations})
+		req, _ := http.NewRequest("POST", "/api/sync", bytes.NewBuffer(body))
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var response struct {
+			Results []internal.SyncResult
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return response.Results
+	}
+
+	cursor := getChanges("").Cursor
+	service := internal.BuyListService{Database: db}
+	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "offline list",
+		Items: []internal.BuyItem{{Ingredient: internal.Ingredient{Name: "tea"}, Quantity: 1}},
+	})
+
+	changes := getChanges(cursor)
+	assert.Equal(t, 1, len(changes.BuyLists))
+	assert.Equal(t, list.ID, changes.BuyLists[0].ID)
+	assert.Equal(t, 1, len(changes.BuyItems))
+	assert.Equal(t, 1, len(changes.Ingredients))
+
+	prefix := fmt.Sprint(time.Now().UnixNano())
+	rename := internal.SyncMutation{
+		ID:              prefix + "-rename",
+		Entity:          internal.SyncBuyList,
+		Action:          internal.SyncUpdate,
+		EntityID:        list.ID,
+		ClientTimestamp: time.Now(),
+		Data:            json.RawMessage(`{"Title": "renamed offline"}`),
+	}
+	stale := internal.SyncMutation{
+		ID:              prefix + "-stale",
+		Entity:          internal.SyncItem,
+		Action:          internal.SyncUpdate,
+		EntityID:        list.Items[0].ID,
+		ClientTimestamp: time.Now().Add(-time.Hour),
+		Data:            json.RawMessage(`{"Quantity": 4}`),
+	}
+	results := postMutations([]internal.SyncMutation{rename, stale})
+	assert.True(t, results[0].Applied)
+	assert.False(t, results[1].Applied)
+	assert.True(t, results[1].Conflict)
+
+	// mutations sent again are not applied twice
+	results = postMutations([]internal.SyncMutation{rename})
+	assert.True(t, results[0].Applied)
+	pending := rename
+	pending.ID = prefix + "-pending"
+	db.Create(&internal.AppliedMutation{UserID: testUser, MutationID: pending.ID})
+	results = postMutations([]internal.SyncMutation{pending})
+	assert.False(t, results[0].Applied)
+	assert.NotEmpty(t, results[0].Error)
+
+	// changes are only of the lists of the user
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/sync?since="+cursor, nil)
+	router.ServeHTTP(recorder, authorize(req, "auth0|other"))
+	assert.NotContains(t, recorder.Body.String(), "renamed offline")
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/sync", nil)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	cursor = getChanges("").Cursor
+	results = postMutations([]internal.SyncMutation{{
+		ID:              prefix + "-delete",
+		Entity:          internal.SyncBuyList,
+		Action:          internal.SyncDelete,
+		EntityID:        list.ID,
+		ClientTimestamp: time.Now(),
+	}})
+	assert.True(t, results[0].Applied)
+
+	changes = getChanges(cursor)
+	assert.Equal(t, 1, len(changes.BuyLists))
+	assert.Equal(t, "renamed offline", changes.BuyLists[0].Title)
+	assert.True(t, changes.BuyLists[0].DeletedAt.Valid)
+
+	// ingredient updates only change the fields sent
+	ingredients := internal.IngredientService{Database: db}
+	chamomile, _ := ingredients.Create(internal.Ingredient{Name: "chamomile " + prefix, Category: "drinks", Aliases: []string{"camomila " + prefix}})
+	results = postMutations([]internal.SyncMutation{{
+		ID:              prefix + "-ingredient",
+		Entity:          internal.SyncIngredient,
+		Action:          internal.SyncUpdate,
+		EntityID:        chamomile.ID,
+		ClientTimestamp: time.Now(),
+		Data:            json.RawMessage(`{"Category": "tea"}`),
+	}})
+	assert.True(t, results[0].Applied)
+	updated, _ := ingredients.Get(chamomile.ID)
+	assert.Equal(t, "tea", updated.Category)
+	assert.Equal(t, chamomile.Name, updated.Name)
+	assert.Equal(t, chamomile.Aliases, updated.Aliases)
+	assert.True(t, chamomile.CreatedAt.Equal(updated.CreatedAt))
+
+	// and the user that deleted an ingredient isn't sent to others
+	ingredients.Delete(chamomile.ID, 0, testUser)
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/sync?since="+cursor, nil)
+	router.ServeHTTP(recorder, authorize(req, "auth0|other"))
+	assert.Contains(t, recorder.Body.String(), chamomile.Name)
+	assert.NotContains(t, recorder.Body.String(), testUser)
+}
+
+func TestBuyListIfMatch(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	list, _ := service.Create(internal.BuyList{Title: "concurrent list", Owner: testUser})
+	path := "/api/buylist/" + strconv.FormatUint(uint64(list.ID), 10)
+
+	update := func(title string, ifMatch string) *httptest.ResponseRecorder {
+		list.Title = title
+		body, _ := json.Marshal(list)
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", path, bytes.NewBuffer(body))
+		req.Header.Set("If-Match", ifMatch)
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		return recorder
+	}
+
+	recorder := update("first change", fmt.Sprintf("\"%d\"", list.Version))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	etag := recorder.Header().Get("ETag")
+	assert.Equal(t, fmt.Sprintf("\"%d\"", list.Version+1), etag)
+
+	// change based on the old version is rejected
+	recorder = update("lost change", fmt.Sprintf("\"%d\"", list.Version))
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	stored, _ := service.Get(uint64(list.ID))
+	assert.Equal(t, "first change", stored.Title)
+
+	// items changes are a new version of the list
+	service.AddItem(uint64(list.ID), internal.BuyItem{Ingredient: internal.Ingredient{Name: "bread"}, Quantity: 1})
+	recorder = update("second change", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", path, nil)
+	req.Header.Set("If-Match", etag)
+	router.ServeHTTP(recorder, authorize(req, testUser))
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+
+	stored, _ = service.Get(uint64(list.ID))
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", path, nil)
+	req.Header.Set("If-Match", fmt.Sprintf("\"%d\"", stored.Version))
+	router.ServeHTTP(recorder, authorize(req, testUser))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestBuyListPatch(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "patched list",
+		Items: []internal.BuyItem{
+			{Ingredient: internal.Ingredient{Name: "milk"}, Quantity: 1},
+			{Ingredient: internal.Ingredient{Name: "eggs"}, Quantity: 12},
+		},
+	})
+	path := "/api/buylist/" + strconv.FormatUint(uint64(list.ID), 10)
+
+	patchList := func(contentType string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		return recorder
+	}
+
+	// merge patch changes only the members sent
+	recorder := patchList("application/merge-patch+json", `{"Title": "merged title"}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var result internal.BuyList
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	assert.Equal(t, "merged title", result.Title)
+	assert.Equal(t, 2, len(result.Items))
+
+	recorder = patchList("application/json-patch+json", `[
+		{"op": "test", "path": "/Items/0/Ingredient/Name", "value": "milk"},
+		{"op": "replace", "path": "/Items/0/Quantity", "value": 2},
+		{"op": "remove", "path": "/Items/1"},
+		{"op": "add", "path": "/Items/-", "value": {"Ingredient": {"Name": "bread"}, "Quantity": 1}}
+	]`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	stored, _ := service.Get(uint64(list.ID))
+	assert.Equal(t, 2, len(stored.Items))
+	assert.Equal(t, "milk", stored.Items[0].Ingredient.Name)
+	assert.Equal(t, uint(2), stored.Items[0].Quantity)
+	assert.Equal(t, "bread", stored.Items[1].Ingredient.Name)
+	assert.Equal(t, stored.Version, result.Version)
+
+	var patchError struct {
+		Path      string
+		Operation *int
+	}
+	recorder = patchList("application/json-patch+json", `[
+		{"op": "replace", "path": "/Title", "value": "not applied"},
+		{"op": "replace", "path": "/Items/5/Quantity", "value": 3}
+	]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	json.Unmarshal(recorder.Body.Bytes(), &patchError)
+	assert.Equal(t, "/Items/5", patchError.Path)
+	assert.Equal(t, 1, *patchError.Operation)
+
+	recorder = patchList("application/merge-patch+json", `{"Title": 5}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	json.Unmarshal(recorder.Body.Bytes(), &patchError)
+	assert.Equal(t, "/Title", patchError.Path)
+
+	recorder = patchList("application/json-patch+json", `[{"op": "jump", "path": "/Title"}]`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = patchList("application/json", `{"Title": "plain json"}`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, recorder.Code)
+
+	stored, _ = service.Get(uint64(list.ID))
+	assert.Equal(t, "merged title", stored.Title)
+
+	// dates kept by the server can't be patched
+	recorder = patchList("application/merge-patch+json", `{"CreatedAt": "2000-01-01T00:00:00Z", "DeletedAt": "2000-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	patched, err := service.Get(uint64(list.ID))
+	assert.Nil(t, err)
+	assert.True(t, stored.CreatedAt.Equal(patched.CreatedAt))
+}
+
+func TestBuyListGetById(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "single list",
+		Items: []internal.BuyItem{{Ingredient: internal.Ingredient{Name: "rice"}, Quantity: 1}},
+	})
+	path := "/api/buylist/" + strconv.FormatUint(uint64(list.ID), 10)
+
+	get := func(url string, headers map[string]string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		return recorder
+	}
+
+	recorder := get(path, nil)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var result internal.BuyList
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	assert.Equal(t, list.Title, result.Title)
+	assert.Equal(t, "rice", result.Items[0].Ingredient.Name)
+	etag := recorder.Header().Get("ETag")
+	lastModified := recorder.Header().Get("Last-Modified")
+	assert.NotEmpty(t, etag)
+
+	recorder = get(path+"?include=items", nil)
+	result = internal.BuyList{}
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	assert.Equal(t, 1, len(result.Items))
+	assert.Equal(t, "", result.Items[0].Ingredient.Name)
+
+	recorder = get(path+"?include=", nil)
+	result = internal.BuyList{}
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	assert.Equal(t, 0, len(result.Items))
+
+	recorder = get(path+"?include=owner", nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	recorder = get(path, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Empty(t, recorder.Body.Bytes())
+
+	recorder = get(path, map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+
+	// lists with other relations are other representations
+	recorder = get(path+"?include=items", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+
+	// and so are the renderings, by format and columns
+	recorder = get(path, map[string]string{"If-None-Match": etag, "Accept": internal.MediaMarkdown})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	pdf := get(path, map[string]string{"Accept": internal.MediaPDF}).Header().Get("ETag")
+	assert.NotEqual(t, etag, pdf)
+	recorder = get(path+"?columns=2", map[string]string{"If-None-Match": pdf, "Accept": internal.MediaPDF})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	recorder = get(path, map[string]string{"If-None-Match": pdf, "Accept": internal.MediaPDF})
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+
+	// and so are the ones with changed ingredients
+	time.Sleep(time.Millisecond)
+	ingredients := internal.IngredientService{Database: db}
+	rice := list.Items[0].Ingredient
+	rice.Category = "grains"
+	_, err := ingredients.Update(rice, rice.ID)
+	assert.Nil(t, err)
+	recorder = get(path, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	etag = recorder.Header().Get("ETag")
+
+	// changes on items are a new version of the list
+	service.SetQuantity(uint64(list.ID), uint64(list.Items[0].ID), 5)
+	recorder = get(path, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	service.Delete(uint64(list.ID), 0)
+	recorder = get(path, nil)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestBuyListPagination(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	title := fmt.Sprintf("paged %d", time.Now().UnixNano())
+	created := map[uint]bool{}
+	for i := 0; i < 5; i++ {
+		list, _ := service.Create(internal.BuyList{
+			Owner: testUser,
+			Title: fmt.Sprintf("%s %d", title, i%2),
+			Items: []internal.BuyItem{{Ingredient: internal.Ingredient{Name: "salt"}, Quantity: 1}},
+		})
+		created[list.ID] = true
+	}
+
+	next := "/api/buylist?" + url.Values{
+		"title":  {title},
+		"limit":  {"2"},
+		"sort":   {"-title,id"},
+		"fields": {"id,title"},
+	}.Encode()
+	seen := []map[string]interface{}{}
+	for pages := 0; next != ""; pages++ {
+		assert.Less(t, pages, 3)
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", next, nil)
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "5", recorder.Header().Get("X-Total-Count"))
+
+		var page []map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &page)
+		seen = append(seen, page...)
+
+		next = ""
+		if link := recorder.Header().Get("Link"); link != "" {
+			next = strings.TrimPrefix(strings.Split(link, ">")[0], "<")
+		}
+	}
+
+	assert.Equal(t, 5, len(seen))
+	for i, row := range seen {
+		assert.Equal(t, 2, len(row))
+		assert.True(t, created[uint(row["ID"].(float64))])
+		if i > 0 {
+			previous := seen[i-1]
+			assert.True(t, previous["Title"].(string) > row["Title"].(string) ||
+				(previous["Title"] == row["Title"] && previous["ID"].(float64) < row["ID"].(float64)))
+		}
+	}
+
+	for _, query := range []string{"sort=owner", "limit=0", "fields=secret", "limit=2&cursor=invalid"} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/buylist?"+query, nil)
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, query)
+	}
+}
+
+func TestBuyListFilter(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	milk := "milk " + suffix
+	party, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "party " + suffix,
+		Items: []internal.BuyItem{{Ingredient: internal.Ingredient{Name: milk, Category: "dairy"}, Quantity: 1}},
+	})
+	done, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "week " + suffix,
+		Items: []internal.BuyItem{{Ingredient: internal.Ingredient{Name: "bread " + suffix}, Quantity: 1}},
+	})
+	service.SetPurchased(uint64(done.ID), uint64(done.Items[0].ID), true)
+
+	find := func(query url.Values) ([]uint, int) {
+		query.Set("title", suffix)
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/buylist?"+query.Encode(), nil)
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		var result []internal.BuyList
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+		ids := []uint{}
+		for _, list := range result {
+			ids = append(ids, list.ID)
+		}
+		return ids, recorder.Code
+	}
+
+	today := time.Now().Format("2006-01-02")
+	cases := []struct {
+		query    url.Values
+		expected []uint
+	}{
+		{url.Values{"ingredient": {milk}}, []uint{party.ID}},
+		{url.Values{"ingredient_id": {fmt.Sprint(party.Items[0].IngredientID)}}, []uint{party.ID}},
+		{url.Values{"category": {"Dairy"}}, []uint{party.ID}},
+		{url.Values{"completed": {"true"}}, []uint{done.ID}},
+		{url.Values{"completed": {"false"}}, []uint{party.ID}},
+		{url.Values{"created_from": {today}, "created_to": {today}}, []uint{party.ID, done.ID}},
+		{url.Values{"created_to": {"2000-01-01T00:00:00Z"}}, []uint{}},
+		{url.Values{"filter": {`title ~ "party" and has(ingredient: "` + milk + `")`}}, []uint{party.ID}},
+		{url.Values{"filter": {`not (completed = true) or has(category: "bakery")`}}, []uint{party.ID}},
+		{url.Values{"filter": {`created_at >= "` + today + `" and completed != false`}}, []uint{done.ID}},
+		{url.Values{"filter": {`title ~ "%"`}}, []uint{}},
+	}
+	for _, test := range cases {
+		ids, code := find(test.query)
+		assert.Equal(t, http.StatusOK, code, test.query.Encode())
+		assert.ElementsMatch(t, test.expected, ids, test.query.Encode())
+	}
+
+	for _, filter := range []string{
+		`title = "a"; drop table buy_lists`,
+		`id = 1`,
+		`title < "a"`,
+		`has(owner: "a")`,
+		`(title = "a"`,
+		`created_at > "yesterday"`,
+	} {
+		_, code := find(url.Values{"filter": {filter}})
+		assert.Equal(t, http.StatusBadRequest, code, filter)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	search := func(query string) (internal.SearchResults, int) {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/search?"+url.Values{"q": {query}}.Encode(), nil)
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		var results internal.SearchResults
+		json.Unmarshal(recorder.Body.Bytes(), &results)
+		return results, recorder.Code
+	}
+
+	if _, code := search("anything"); code == http.StatusServiceUnavailable {
+		t.Skip("SQLite built without FTS5, run tests with -tags sqlite_fts5")
+	}
+
+	word := fmt.Sprintf("zq%d", time.Now().UnixNano())
+	service := internal.BuyListService{Database: db}
+	ingredients := &internal.IngredientService{Database: db}
+	ingredient, _ := ingredients.Create(internal.Ingredient{Name: "cilantro", Aliases: []string{word + "coriander"}})
+	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "Tacos " + word,
+		Items: []internal.BuyItem{{IngredientID: int(ingredient.ID), Quantity: 1, Notes: "fresh " + word + " bunch"}},
+	})
+
+	results, code := search(word)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, len(results.BuyLists))
+	assert.Equal(t, list.ID, results.BuyLists[0].ID)
+	assert.Equal(t, "Tacos <mark>"+word+"</mark>", results.BuyLists[0].Highlight)
+	assert.Equal(t, 1, len(results.Items))
+	assert.Equal(t, list.ID, results.Items[0].BuyListID)
+	assert.Equal(t, "cilantro", results.Items[0].Highlight)
+	assert.Contains(t, results.Items[0].Snippet, "<mark>"+word+"</mark>")
+	// words match the start of the alias
+	assert.Equal(t, 1, len(results.Ingredients))
+	assert.Equal(t, ingredient.ID, results.Ingredients[0].ID)
+
+	// lists of other users are not found
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/search?q="+word, nil)
+	router.ServeHTTP(recorder, authorize(req, "auth0|other"))
+	var others internal.SearchResults
+	json.Unmarshal(recorder.Body.Bytes(), &others)
+	assert.Equal(t, 0, len(others.BuyLists))
+	assert.Equal(t, 0, len(others.Items))
+	assert.Equal(t, 1, len(others.Ingredients))
+
+	// changes and deletes are kept on the index
+	list.Title = "Burritos"
+	list.Items[0].Notes = "dried bunch"
+	list, _ = service.Patch(list, uint64(list.ID))
+	results, _ = search(word)
+	assert.Equal(t, 0, len(results.BuyLists))
+	assert.Equal(t, 0, len(results.Items))
+	stored, _ := service.Get(uint64(list.ID))
+	assert.Equal(t, "dried bunch", stored.Items[0].Notes)
+	service.Delete(uint64(list.ID), 0)
+	results, _ = search(word)
+	assert.Equal(t, 0, len(results.Items))
+
+	// search syntax is searched as text
+	_, code = search(`"unbalanced AND (`)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestTrash(t *testing.T) {
+	owner := fmt.Sprintf("trash|%d", time.Now().UnixNano())
+	service := internal.BuyListService{Database: db}
+	trash := internal.TrashService{Database: db}
+	list, _ := service.Create(internal.BuyList{
+		Title: "trashed list",
+		Owner: owner,
+		Items: []internal.BuyItem{
+			{Ingredient: internal.Ingredient{Name: "flour"}, Quantity: 1},
+			{Ingredient: internal.Ingredient{Name: "yeast"}, Quantity: 1},
+		},
+	})
+	// removed before the list was deleted, stays removed on restore
+	service.RemoveItem(uint64(list.ID), uint64(list.Items[1].ID))
+	service.Delete(uint64(list.ID), 0)
+
+	found, err := trash.Find(owner)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(found.BuyLists))
+	assert.Equal(t, list.ID, found.BuyLists[0].ID)
+
+	restored, err := trash.RestoreBuyList(owner, list.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(restored.Items))
+	assert.Equal(t, list.Items[0].ID, restored.Items[0].ID)
+	_, err = trash.RestoreBuyList(owner, list.ID)
+	assert.NotNil(t, err)
+
+	// reminders wait on the trash until the list is restored
+	scheduledFor := time.Now().Add(time.Hour)
+	scheduled, _ := service.Create(internal.BuyList{Title: "scheduled", Owner: owner, ScheduledFor: &scheduledFor,
+		Reminders: []internal.Reminder{{OffsetMinutes: 120}, {OffsetMinutes: 30}}})
+	service.Delete(uint64(scheduled.ID), 0)
+	notifier := &testNotifier{}
+	scheduler := internal.ReminderScheduler{Database: db, Notifier: notifier}
+	scheduler.DispatchDue(context.Background(), time.Now())
+	var waiting int64
+	db.Model(&internal.Reminder{}).Where("buy_list_id = ?", scheduled.ID).Count(&waiting)
+	assert.Equal(t, int64(2), waiting)
+	// the ones that came due meanwhile aren't sent late
+	scheduled, _ = trash.RestoreBuyList(owner, scheduled.ID)
+	assert.Equal(t, 1, len(scheduled.Reminders))
+	assert.Equal(t, uint(30), scheduled.Reminders[0].OffsetMinutes)
+	scheduler.DispatchDue(context.Background(), time.Now())
+	for _, notification := range notifier.notifications {
+		assert.NotEqual(t, scheduled.ID, notification.BuyList.ID)
+	}
+	service.Delete(uint64(scheduled.ID), 0)
+	trash.PurgeBuyList(owner, scheduled.ID)
+
+	// ingredients are only on the trash of the user that deleted them
+	ingredients := internal.IngredientService{Database: db}
+	ingredient, _ := ingredients.Create(internal.Ingredient{Name: fmt.Sprintf("trashed %d", time.Now().UnixNano())})
+	ingredients.Delete(ingredient.ID, 0, owner)
+	found, _ = trash.Find("auth0|other")
+	for _, other := range found.Ingredients {
+		assert.NotEqual(t, ingredient.ID, other.ID)
+	}
+	_, err = trash.RestoreIngredient("auth0|other", ingredient.ID)
+	assert.NotNil(t, err)
+	_, err = trash.PurgeIngredient("auth0|other", ingredient.ID)
+	assert.NotNil(t, err)
+	_, err = trash.RestoreIngredient(owner, ingredient.ID)
+	assert.Nil(t, err)
+
+	// lists not deleted can't be purged
+	_, err = trash.PurgeBuyList(owner, list.ID)
+	assert.NotNil(t, err)
+
+	service.Delete(uint64(list.ID), 0)
+	_, err = trash.PurgeBuyList(owner, list.ID)
+	assert.Nil(t, err)
+	var count int64
+	db.Unscoped().Model(&internal.BuyItem{}).Where("buy_list_id = ?", list.ID).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	// retention purges only records deleted before the date
+	expired, _ := service.Create(internal.BuyList{Title: "expired", Owner: owner})
+	kept, _ := service.Create(internal.BuyList{Title: "kept", Owner: owner})
+	service.Delete(uint64(expired.ID), 0)
+	db.Unscoped().Model(&expired).Update("deleted_at", time.Now().AddDate(0, 0, -40))
+	service.Delete(uint64(kept.ID), 0)
+
+	purged, err := trash.PurgeDeletedBefore(time.Now().AddDate(0, 0, -30))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, purged, 1)
+	found, _ = trash.Find(owner)
+	assert.Equal(t, 1, len(found.BuyLists))
+	assert.Equal(t, kept.ID, found.BuyLists[0].ID)
+}
+
+func TestBuyListDuplicateMergeSplit(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	bread := internal.Ingredient{Name: "bread " + suffix, Category: "bakery"}
+	milk := internal.Ingredient{Name: "milk " + suffix, Category: "dairy"}
+	db.Create(&bread)
+	db.Create(&milk)
+	first, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "first",
+		Items: []internal.BuyItem{
+			{IngredientID: int(bread.ID), Quantity: 2, Purchased: true},
+			{IngredientID: int(milk.ID), Quantity: 1},
+		},
+	})
+	second, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "second",
+		Items: []internal.BuyItem{
+			{IngredientID: int(bread.ID), Quantity: 3},
+			{IngredientID: int(milk.ID), Quantity: 2, Unit: "l"},
+		},
+	})
+
+	post := func(url string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		return recorder
+	}
+	path := "/api/buylist/" + strconv.FormatUint(uint64(first.ID), 10)
+
+	recorder := post(path+"/duplicate", "")
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var duplicate internal.BuyList
+	json.Unmarshal(recorder.Body.Bytes(), &duplicate)
+	assert.Equal(t, "first (copy)", duplicate.Title)
+	assert.Equal(t, 2, len(duplicate.Items))
+	assert.False(t, duplicate.Items[0].Purchased)
+	assert.Equal(t, http.StatusNotFound, post("/api/buylist/999999/duplicate", "").Code)
+
+	body := fmt.Sprintf(`{"Target": %d, "Sources": [%d]}`, first.ID, second.ID)
+	recorder = post("/api/buylist/merge", body)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var merged internal.BuyList
+	json.Unmarshal(recorder.Body.Bytes(), &merged)
+	assert.Equal(t, 3, len(merged.Items))
+	assert.Equal(t, uint(5), merged.Items[0].Quantity)
+	assert.False(t, merged.Items[0].Purchased)
+	// quantities in other units are not summed
+	assert.Equal(t, uint(1), merged.Items[1].Quantity)
+	assert.Equal(t, "l", merged.Items[2].Unit)
+	assert.Equal(t, uint(2), merged.Items[2].Quantity)
+	_, err := service.Get(uint64(second.ID))
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusBadRequest, post("/api/buylist/merge", `{"Target": 1}`).Code)
+
+	recorder = post(path+"/split", `{"ByCategory": true}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var lists []internal.BuyList
+	json.Unmarshal(recorder.Body.Bytes(), &lists)
+	assert.Equal(t, 2, len(lists))
+	assert.Equal(t, "first - bakery", lists[0].Title)
+	assert.Equal(t, 1, len(lists[0].Items))
+	assert.Equal(t, http.StatusBadRequest, post(path+"/split", `{}`).Code)
+
+	for _, list := range append(lists, first, duplicate) {
+		service.Delete(uint64(list.ID), 0)
+	}
+}
+
+func TestBuyListStoreRoute(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	stores := internal.StoreService{Database: db}
+	store, err := stores.Create(internal.Store{
+		Owner: testUser,
+		Name:  "market",
+		Aisles: []internal.Aisle{
+			{Name: "fruits", Categories: []string{"produce"}},
+			{Name: "cold", Categories: []string{"dairy", "Frozen"}},
+		},
+	})
+	assert.Nil(t, err)
+	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "route",
+		Items: []internal.BuyItem{
+			{Ingredient: internal.Ingredient{Name: "ice cream", Category: "frozen"}, Quantity: 1},
+			{Ingredient: internal.Ingredient{Name: "soap", Category: "cleaning"}, Quantity: 1},
+			{Ingredient: internal.Ingredient{Name: "apple", Category: "produce"}, Quantity: 1},
+			{Ingredient: internal.Ingredient{Name: "milk", Category: "dairy"}, Quantity: 1},
+		},
+	})
+	path := fmt.Sprintf("/api/buylist/%d?store=%d", list.ID, store.ID)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	router.ServeHTTP(recorder, authorize(req, testUser))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var route internal.ShoppingRoute
+	json.Unmarshal(recorder.Body.Bytes(), &route)
+	names := []string{}
+	for _, item := range route.Items {
+		names = append(names, item.Ingredient.Name)
+	}
+	assert.Equal(t, []string{"apple", "ice cream", "milk", "soap"}, names)
+	assert.Equal(t, 3, len(route.Sections))
+	assert.Equal(t, "cold", route.Sections[1].Aisle)
+	assert.Equal(t, []uint{list.Items[0].ID, list.Items[3].ID}, route.Sections[1].ItemIDs)
+	assert.Equal(t, internal.UnsortedAisle, route.Sections[2].Aisle)
+
+	// stores are only visible to their owner
+	other, _ := service.Create(internal.BuyList{Owner: "auth0|other", Title: "other route"})
+	recorder = httptest.NewRecorder()
+	otherReq, _ := http.NewRequest("GET", fmt.Sprintf("/api/buylist/%d?store=%d", other.ID, store.ID), nil)
+	router.ServeHTTP(recorder, authorize(otherReq, "auth0|other"))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		recorder = httptest.NewRecorder()
+		otherReq, _ = http.NewRequest(method, fmt.Sprintf("/api/stores/%d", store.ID), strings.NewReader(`{"Name": "taken"}`))
+		router.ServeHTTP(recorder, authorize(otherReq, "auth0|other"))
+		assert.Equal(t, http.StatusNotFound, recorder.Code, method)
+	}
+	recorder = httptest.NewRecorder()
+	otherReq, _ = http.NewRequest("GET", "/api/stores", nil)
+	router.ServeHTTP(recorder, authorize(otherReq, "auth0|other"))
+	assert.NotContains(t, recorder.Body.String(), fmt.Sprintf(`"ID":%d,`, store.ID))
+	service.Delete(uint64(other.ID), 0)
+
+	// aisles are replaced on update
+	store.Aisles = []internal.Aisle{{Name: "cleaning", Categories: []string{"cleaning"}}}
+	store, err = stores.Update(store, uint64(store.ID))
+	assert.Nil(t, err)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, authorize(req, testUser))
+	route = internal.ShoppingRoute{}
+	json.Unmarshal(recorder.Body.Bytes(), &route)
+	assert.Equal(t, "soap", route.Items[0].Ingredient.Name)
+	assert.Equal(t, 2, len(route.Sections))
+
+	stores.Delete(testUser, uint64(store.ID))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, authorize(req, testUser))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	service.Delete(uint64(list.ID), 0)
+}
+
+func TestBuyListPrices(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	stores := internal.StoreService{Database: db}
+	prices := internal.PriceService{Database: db}
+	market, _ := stores.Create(internal.Store{Name: "market", Owner: testUser})
+	grocer, _ := stores.Create(internal.Store{Name: "grocer", Owner: testUser})
+	// stores of other users aren't estimated
+	elsewhere, _ := stores.Create(internal.Store{Name: "elsewhere", Owner: "auth0|other"})
+	list, _ := service.Create(internal.BuyList{
+		Owner: testUser,
+		Title: "prices",
+		Items: []internal.BuyItem{
+			{Ingredient: internal.Ingredient{Name: "rice"}, Quantity: 2, Unit: "kg"},
+			{Ingredient: internal.Ingredient{Name: "beans"}, Quantity: 1, Unit: "kg"},
+			{Ingredient: internal.Ingredient{Name: "flour"}, Quantity: 3, Unit: "pack"},
+		},
+	})
+	rice, beans, flour := list.Items[0], list.Items[1], list.Items[2]
+
+	purchase := func(item internal.BuyItem, body string) int {
+		recorder := httptest.NewRecorder()
+		url := fmt.Sprintf("/api/buylist/%d/items/%d/purchased", list.ID, item.ID)
+		req, _ := http.NewRequest("PUT", url, strings.NewReader(body))
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		return recorder.Code
+	}
+	body := fmt.Sprintf(`{"Purchased": true, "UnitPrice": 4.5, "Unit": "kg", "StoreID": %d}`, market.ID)
+	assert.Equal(t, http.StatusOK, purchase(rice, body))
+	assert.Equal(t, http.StatusBadRequest, purchase(beans, `{"Purchased": true, "UnitPrice": 2}`))
+	assert.Equal(t, http.StatusNotFound, purchase(beans, `{"Purchased": true, "UnitPrice": 2, "StoreID": 999999}`))
+
+	// older observations, the price is rising at the market
+	db.Create(&internal.PriceObservation{IngredientID: uint(rice.IngredientID), StoreID: market.ID, UnitPrice: 3, Unit: "kg", ObservedAt: time.Now().AddDate(0, 0, -20)})
+	db.Create(&internal.PriceObservation{IngredientID: uint(rice.IngredientID), StoreID: grocer.ID, UnitPrice: 5, Unit: "kg", ObservedAt: time.Now()})
+	db.Create(&internal.PriceObservation{IngredientID: uint(beans.IngredientID), StoreID: grocer.ID, UnitPrice: 2, Unit: "kg", ObservedAt: time.Now()})
+	db.Create(&internal.PriceObservation{IngredientID: uint(beans.IngredientID), StoreID: market.ID, UnitPrice: 3, Unit: "kg", ObservedAt: time.Now()})
+	db.Create(&internal.PriceObservation{IngredientID: uint(rice.IngredientID), StoreID: elsewhere.ID, UnitPrice: 1, Unit: "kg", ObservedAt: time.Now()})
+	// priced by weight, but the item is counted in packs
+	db.Create(&internal.PriceObservation{IngredientID: uint(flour.IngredientID), StoreID: market.ID, UnitPrice: 1, Unit: "kg", ObservedAt: time.Now()})
+
+	history, err := prices.History(testUser, uint(rice.IngredientID))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(history.Observations))
+	assert.Equal(t, 2, len(history.Stores))
+	assert.Equal(t, "market", history.Stores[0].Store)
+	assert.Equal(t, 4.5, history.Stores[0].Latest)
+	assert.Equal(t, internal.TrendUp, history.Stores[0].Trend)
+	assert.Equal(t, internal.TrendStable, history.Stores[1].Trend)
+	history, _ = prices.History("auth0|other", uint(rice.IngredientID))
+	assert.Equal(t, 1, len(history.Observations))
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/buylist/%d/best-store", list.ID), nil)
+	router.ServeHTTP(recorder, authorize(req, testUser))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var best internal.BestStore
+	json.Unmarshal(recorder.Body.Bytes(), &best)
+	// market 2*4.5+3 = 12, grocer 2*5+2 = 12, split 2*4.5+2 = 11
+	assert.Equal(t, 12.0, best.Cheapest.Total)
+	assert.Equal(t, []uint{flour.ID}, best.Cheapest.Missing)
+	assert.NotNil(t, best.Split)
+	assert.Equal(t, 11.0, best.Split.Total)
+	assert.Equal(t, 1.0, best.Split.Saving)
+	assert.Equal(t, []uint{rice.ID}, best.Split.Items[market.ID])
+	assert.Equal(t, []uint{flour.ID}, best.Split.Missing)
+	for _, estimate := range best.Estimates {
+		assert.NotEqual(t, elsewhere.ID, estimate.StoreID)
+	}
+
+	// estimated prices of the PDF, flour has none in packs
+	itemPrices, err := prices.ItemPrices(list)
+	assert.Nil(t, err)
+	assert.Equal(t, 4.5, itemPrices[rice.ID])
+	assert.Contains(t, itemPrices, beans.ID)
+	assert.NotContains(t, itemPrices, flour.ID)
+
+	service.Delete(uint64(list.ID), 0)
+	stores.Delete(testUser, uint64(market.ID))
+	stores.Delete(testUser, uint64(grocer.ID))
+	stores.Delete("auth0|other", uint64(elsewhere.ID))
+}
+
+func TestReports(t *testing.T) {
+	owner := fmt.Sprintf("reports|%d", time.Now().UnixNano())
+	service := internal.BuyListService{Database: db}
+	stores := internal.StoreService{Database: db}
+	prices := internal.PriceService{Database: db}
+	store, _ := stores.Create(internal.Store{Name: "reports market", Owner: owner})
+	list, _ := service.Create(internal.BuyList{
+		Title: "reports",
+		Owner: owner,
+		Items: []internal.BuyItem{
+			{Ingredient: internal.Ingredient{Name: "coffee", Category: "drinks"}, Quantity: 2},
+			{Ingredient: internal.Ingredient{Name: "sugar"}, Quantity: 1},
+		},
+	})
+	coffee := list.Items[0]
+	second, _ := service.Create(internal.BuyList{
+		Title: "reports",
+		Owner: owner,
+		Items: []internal.BuyItem{{IngredientID: coffee.IngredientID, Quantity: 1}},
+	})
+
+	purchase := func(listID uint, item internal.BuyItem, price float64, purchasedAt time.Time) {
+		item, _ = service.SetPurchased(uint64(listID), uint64(item.ID), true)
+		db.Model(&item).Update("purchased_at", purchasedAt)
+		item.PurchasedAt = &purchasedAt
+		if price > 0 {
+			prices.Observe(item, store.ID, price, "kg")
+		}
+	}
+	january := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	purchase(list.ID, coffee, 10, january)
+	purchase(list.ID, list.Items[1], 0, january)
+	purchase(second.ID, second.Items[0], 15, january.AddDate(0, 2, 0))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(recorder, authorize(req, owner))
+		return recorder
+	}
+
+	var rows []internal.SpendRow
+	json.Unmarshal(get("/api/reports/monthly").Body.Bytes(), &rows)
+	assert.Equal(t, 3, len(rows))
+	assert.Equal(t, "2024-01", rows[0].Group)
+	assert.Equal(t, int64(2), rows[0].Items)
+	assert.Equal(t, int64(1), rows[0].Priced)
+	assert.Equal(t, 20.0, rows[0].Spend)
+	assert.Equal(t, -100.0, *rows[1].Change)
+	assert.Nil(t, rows[2].Change)
+
+	rows = nil
+	json.Unmarshal(get("/api/reports/categories").Body.Bytes(), &rows)
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, "drinks", rows[0].Group)
+	assert.Equal(t, 35.0, rows[0].Spend)
+	assert.Equal(t, internal.Uncategorized, rows[1].Group)
+
+	rows = nil
+	json.Unmarshal(get("/api/reports/stores").Body.Bytes(), &rows)
+	assert.Equal(t, 1, len(rows))
+	assert.Equal(t, int64(2), rows[0].Items)
+
+	var usage []internal.IngredientUsage
+	json.Unmarshal(get("/api/reports/ingredients").Body.Bytes(), &usage)
+	assert.Equal(t, "coffee", usage[0].Ingredient)
+	assert.Equal(t, int64(2), usage[0].Purchases)
+	assert.Equal(t, 60.0, *usage[0].AverageInterval)
+	assert.Nil(t, usage[1].AverageInterval)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/reports/ingredients?format=csv", nil)
+	router.ServeHTTP(recorder, authorize(req, owner))
+	assert.Equal(t, "text/csv; charset=utf-8", recorder.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "ingredient_id,ingredient,category,purchases,quantity,spend,average_interval", lines[0])
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/reports/monthly?from=yesterday", nil)
+	router.ServeHTTP(recorder, authorize(req, owner))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	// reports only have the purchases of the authenticated user
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/reports/monthly", nil)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/reports/stores?owner="+url.QueryEscape(owner), nil)
+	router.ServeHTTP(recorder, authorize(req, "reports|other"))
+	rows = nil
+	json.Unmarshal(recorder.Body.Bytes(), &rows)
+	for _, row := range rows {
+		assert.NotEqual(t, "reports market", row.Group)
+	}
+
+	service.Delete(uint64(list.ID), 0)
+	service.Delete(uint64(second.ID), 0)
+	stores.Delete(owner, uint64(store.ID))
+}
+
+func TestSuggestions(t *testing.T) {
+	owner := fmt.Sprintf("suggestions|%d", time.Now().UnixNano())
+	service := internal.BuyListService{Database: db}
+	suggestions := internal.SuggestionService{Database: db}
+	eggs := internal.Ingredient{Name: "eggs"}
+	salt := internal.Ingredient{Name: "salt"}
+	db.Create(&eggs)
+	db.Create(&salt)
+
+	lists := []internal.BuyList{}
+	purchase := func(ingredient internal.Ingredient, quantity uint, daysAgo int) {
+		list, _ := service.Create(internal.BuyList{
+			Title: "past",
+			Owner: owner,
+			Items: []internal.BuyItem{{IngredientID: int(ingredient.ID), Quantity: quantity}},
+		})
+		item, _ := service.SetPurchased(uint64(list.ID), uint64(list.Items[0].ID), true)
+		db.Model(&item).Update("purchased_at", time.Now().AddDate(0, 0, -daysAgo))
+		lists = append(lists, list)
+	}
+	purchase(eggs, 12, 22)
+	purchase(eggs, 12, 15)
+	purchase(eggs, 6, 8)
+	purchase(eggs, 12, 1) // restock on a second list the same day
+	purchase(eggs, 0, 1)
+	purchase(salt, 1, 100)
+	purchase(salt, 1, 10)
+
+	due, err := suggestions.Due(owner, 7, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(due))
+	assert.Equal(t, eggs.ID, due[0].IngredientID)
+	assert.Equal(t, 7.0, due[0].Interval)
+	assert.Equal(t, uint(12), due[0].Quantity)
+	assert.Equal(t, 4, due[0].Purchases)
+	assert.Greater(t, due[0].Confidence, 0.5)
+
+	due, _ = suggestions.Due(owner, 0, 0)
+	assert.Equal(t, 0, len(due))
+	due, _ = suggestions.Due(owner, 7, 0.9)
+	assert.Equal(t, 0, len(due))
+
+	list, _ := service.Create(internal.BuyList{Title: "next", Owner: owner})
+	lists = append(lists, list)
+	apply := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/buylist/%d/suggestions/apply?days=7", list.ID), nil)
+		router.ServeHTTP(recorder, authorize(req, owner))
+		return recorder
+	}
+	recorder := apply()
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var items []internal.BuyItem
+	json.Unmarshal(recorder.Body.Bytes(), &items)
+	assert.Equal(t, 1, len(items))
+	assert.Equal(t, "eggs", items[0].Ingredient.Name)
+
+	// already on the list and pending
+	items = nil
+	json.Unmarshal(apply().Body.Bytes(), &items)
+	assert.Equal(t, 0, len(items))
+	due, _ = suggestions.Due(owner, 7, 0)
+	assert.Equal(t, 0, len(due))
+
+	// only the owner of the list can apply suggestions to it
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/api/buylist/%d/suggestions/apply", list.ID), nil)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/buylist/%d/suggestions/apply", list.ID), nil)
+	router.ServeHTTP(recorder, authorize(req, "suggestions|other"))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	for _, list := range lists {
+		service.Delete(uint64(list.ID), 0)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	owner := fmt.Sprintf("budget|%d", time.Now().UnixNano())
+	service := internal.BuyListService{Database: db}
+	settings := internal.UserSettingsService{Database: db}
+	_, err := settings.Save(internal.UserSettings{UserID: owner, MonthlyBudget: -1})
+	assert.ErrorIs(t, err, internal.ErrInvalidBudget)
+	settings.Save(internal.UserSettings{UserID: owner, MonthlyBudget: 20})
+
+	cheese := internal.Ingredient{Name: "cheese"}
+	db.Create(&cheese)
+	db.Create(&internal.PriceObservation{IngredientID: cheese.ID, UnitPrice: 5, Unit: "kg", ObservedAt: time.Now()})
+	listBudget := 12.0
+	list, _ := service.Create(internal.BuyList{Title: "budget", Owner: owner, Budget: &listBudget})
+
+	recorder := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"IngredientID": %d, "Quantity": 2, "Unit": "kg"}`, cheese.ID)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/api/buylist/%d/items", list.ID), strings.NewReader(body))
+	router.ServeHTTP(recorder, authorize(req, owner))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var item BudgetedItem
+	json.Unmarshal(recorder.Body.Bytes(), &item)
+	assert.Equal(t, uint(2), item.Quantity)
+	assert.True(t, item.Budget.Warning)
+	assert.Equal(t, 2.0, item.Budget.List.Remaining)
+	assert.Equal(t, 50.0, item.Budget.Monthly.Percent)
+
+	crossed := []int{}
+	events := &internal.EventBus{}
+	events.Subscribe(func(event internal.Event) {
+		if event.Type == internal.EventBudgetThreshold {
+			crossed = append(crossed, event.Data.(internal.BudgetThresholdCrossed).Threshold)
+		}
+	})
+	budgets := internal.BudgetService{Database: db, Events: events}
+	service.AddItem(uint64(list.ID), internal.BuyItem{IngredientID: int(cheese.ID), Quantity: 2, Unit: "kg"})
+	// priced by weight, not estimated in slices
+	service.AddItem(uint64(list.ID), internal.BuyItem{IngredientID: int(cheese.ID), Quantity: 10, Unit: "slice"})
+	status, err := budgets.Check(list.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 20.0, status.Monthly.Projected)
+	assert.Equal(t, -8.0, status.List.Remaining)
+	assert.Equal(t, []int{80, 100}, crossed)
+
+	// thresholds are notified once a month
+	budgets.Check(list.ID)
+	assert.Equal(t, 2, len(crossed))
+
+	other, _ := service.Create(internal.BuyList{Title: "no budget", Owner: testUser})
+	status, _ = budgets.Check(other.ID)
+	assert.Nil(t, status)
+
+	service.Delete(uint64(list.ID), 0)
+	service.Delete(uint64(other.ID), 0)
+}
+
+func TestBuyListCSV(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	flour := internal.Ingredient{Name: "flour " + suffix, Aliases: []string{"farinha " + suffix}}
+	db.Create(&flour)
+
+	upload := func(file string, fields map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "list.csv")
+		part.Write([]byte(file))
+		for name, value := range fields {
+			form.WriteField(name, value)
+		}
+		form.Close()
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/buylist/import", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		return recorder
+	}
+
+	file := "Lista;Produto;Qtd;Preco\n" +
+		"party " + suffix + ";Farinha " + suffix + ";2;4,50\n" +
+		"party " + suffix + ";candles " + suffix + ";1;\n" +
+		"picnic " + suffix + ";flour " + suffix + ";1;\n"
+	columns := `{"title": "Lista", "ingredient": "Produto", "quantity": "Qtd", "price": "Preco"}`
+	fields := map[string]string{"columns": columns, "delimiter": ";", "dry_run": "true"}
+
+	// prices are only recorded with the store they were observed at
+	recorder := upload(file, fields)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	stores := internal.StoreService{Database: db}
+	store, _ := stores.Create(internal.Store{Name: "csv market " + suffix, Owner: testUser})
+	fields["store"] = strconv.FormatUint(uint64(store.ID), 10)
+
+	recorder = upload(file, fields)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var result internal.ImportResult
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	assert.Equal(t, 3, result.Rows)
+	assert.Equal(t, 2, len(result.Lists))
+	assert.Equal(t, flour.ID, result.Lists[0].Items[0].Ingredient.ID)
+	assert.Equal(t, []string{"candles " + suffix}, result.NewIngredients)
+	var count int64
+	db.Model(&internal.BuyList{}).Where("title = ?", "party "+suffix).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	invalid := "title,ingredient,quantity\nbad,,1.5\n"
+	recorder = upload(invalid, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	result = internal.ImportResult{}
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	assert.Equal(t, 2, len(result.Errors))
+	assert.Equal(t, 2, result.Errors[0].Row)
+	assert.Equal(t, internal.FieldIngredient, result.Errors[0].Field)
+	assert.Equal(t, internal.FieldQuantity, result.Errors[1].Field)
+
+	recorder = upload("name\nmilk\n", nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	delete(fields, "dry_run")
+	recorder = upload(file, fields)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	result = internal.ImportResult{}
+	json.Unmarshal(recorder.Body.Bytes(), &result)
+	party := result.Lists[0]
+	assert.NotZero(t, party.ID)
+	assert.Equal(t, 2, len(party.Items))
+	assert.NotZero(t, party.Items[1].IngredientID)
+
+	recorder = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/buylist/%d/export", party.ID), nil)
+	router.ServeHTTP(recorder, authorize(req, testUser))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", recorder.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	assert.Equal(t, "title,ingredient,quantity,unit,category,price", lines[0])
+	assert.Equal(t, fmt.Sprintf("party %s,flour %s,2,,,4.5", suffix, suffix), lines[1])
+
+	for _, list := range result.Lists {
+		service.Delete(uint64(list.ID), 0)
+	}
+	stores.Delete(testUser, uint64(store.ID))
+}
+
+func TestBuyListRenderings(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	scheduledFor := time.Date(2030, 5, 4, 10, 30, 0, 0, time.Local)
+	list, _ := service.Create(internal.BuyList{
+		Owner:        testUser,
+		Title:        "fridge <door>",
+		ScheduledFor: &scheduledFor,
+		Items: []internal.BuyItem{
+			{Ingredient: internal.Ingredient{Name: "yogurt", Category: "dairy"}, Quantity: 2, Purchased: true},
+			{Ingredient: internal.Ingredient{Name: "rice_white"}, Quantity: 1, Unit: "kg"},
+			{Ingredient: internal.Ingredient{Name: "bread", Category: "bakery"}, Quantity: 1, Notes: "sliced"},
+		},
+	})
+	get := func(accept string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/buylist/%d", list.ID), nil)
+		req.Header.Set("Accept", accept)
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		return recorder
+	}
+
+	recorder := get("text/markdown")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/markdown; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", recorder.Header().Get("Vary"))
+	assert.Equal(t, "# fridge \\<door\\>\n\n_Scheduled for 04/05/2030 10:30_\n"+
+		"\n## bakery\n\n- [ ] 1 x bread _(sliced)_\n"+
+		"\n## dairy\n\n- [x] 2 x yogurt\n"+
+		"\n## uncategorized\n\n- [ ] 1 kg rice\\_white\n", recorder.Body.String())
+
+	recorder = get("text/plain")
+	assert.Equal(t, "fridge <door> - 04/05/2030 10:30\n"+
+		"[ ] 1 x bread (sliced)\n[x] 2 x yogurt\n[ ] 1 kg rice_white\n", recorder.Body.String())
+
+	recorder = get("text/html,application/xhtml+xml;q=0.9")
+	assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "<title>fridge &lt;door&gt;</title>")
+	assert.Contains(t, recorder.Body.String(), `<li class="purchased">2 x yogurt</li>`)
+
+	recorder = get("*/*")
+	assert.Equal(t, "application/json; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+	recorder = get("image/png")
+	assert.Equal(t, http.StatusNotAcceptable, recorder.Code)
+
+	service.Delete(uint64(list.ID), 0)
+}
+
+func TestBuyListPDF(t *testing.T) {
+	service := internal.BuyListService{Database: db}
+	items := []internal.BuyItem{}
+	for i := 0; i < 120; i++ {
+		items = append(items, internal.BuyItem{Ingredient: internal.Ingredient{Name: fmt.Sprintf("pdf item %d", i)}, Quantity: 1})
+	}
+	list, _ := service.Create(internal.BuyList{Title: "pantry (big)", Items: items, Owner: testUser})
+	get := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/buylist/%d%s", list.ID, query), nil)
+		req.Header.Set("Accept", "application/pdf")
+		router.ServeHTTP(recorder, authorize(req, testUser))
+		return recorder
+	}
+
+	recorder := get("?columns=1")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/pdf", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, fmt.Sprintf(`inline; filename="buylist-%d.pdf"`, list.ID), recorder.Header().Get("Content-Disposition"))
+	body := recorder.Body.String()
+	assert.True(t, strings.HasPrefix(body, "%PDF-"))
+	assert.True(t, strings.HasSuffix(body, "%%EOF\n"))
+	assert.Contains(t, body, `(pantry \(big\)) Tj`)
+	assert.Contains(t, body, "/Count 3 ")
+	assert.Contains(t, body, "(Page 3 of 3) Tj")
+
+	recorder = get("")
+	assert.Contains(t, recorder.Body.String(), "/Count 2 ")
+
+	recorder = get("?columns=3")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	var rendered bytes.Buffer
+	short := internal.BuyList{Title: "short", Items: []internal.BuyItem{{Ingredient: internal.Ingredient{Name: "milk"}, Quantity: 2, Unit: "l"}}}
+	short.Items[0].ID = 1
+	err := internal.RenderPDF(&rendered, short, internal.GroupItemsByCategory(short.Items), map[uint]float64{1: 1.25}, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, rendered.String(), "(2 l milk) Tj")
+	assert.Contains(t, rendered.String(), "(2.50) Tj")
+	assert.Contains(t, rendered.String(), "(Estimated total 2.50) Tj")
+	assert.Contains(t, rendered.String(), "/Count 1 ")
+
+	service.Delete(uint64(list.ID), 0)
+}
+
+func TestCalendar(t *testing.T) {
+	owner := fmt.Sprintf("calendar-%d", time.Now().UnixNano())
+	lists := internal.BuyListService{Database: db}
+	calendar := internal.CalendarService{Database: db}
+	scheduledFor := time.Date(2030, 5, 4, 10, 30, 0, 0, time.UTC)
+	scheduled, _ := lists.Create(internal.BuyList{
+		Title:        "market, saturday",
+		Owner:        owner,
+		ScheduledFor: &scheduledFor,
+		Items: []internal.BuyItem{
+			{Ingredient: internal.Ingredient{Name: "calendar apples"}, Quantity: 6},
+			{Ingredient: internal.Ingredient{Name: "calendar flour"}, Quantity: 1, Unit: "kg", Notes: "whole wheat, stone ground"},
+		},
+		Reminders: []internal.Reminder{{OffsetMinutes: 60}, {OffsetMinutes: 24 * 60}},
+	})
+	unscheduled, _ := lists.Create(internal.BuyList{Title: "someday", Owner: owner})
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(recorder, authorize(req, owner))
+		return recorder
+	}
+
+	_, err := calendar.Token(owner)
+	assert.ErrorIs(t, err, internal.ErrCalendarTokenNotFound)
+	token, err := calendar.Rotate(owner)
+	assert.Nil(t, err)
+	assert.Len(t, token.Token, 64)
+
+	recorder := get(token.Path())
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/calendar; charset=utf-8", recorder.Header().Get("Content-Type"))
+	body := recorder.Body.String()
+	assert.True(t, strings.HasPrefix(body, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n"))
+	assert.Contains(t, body, fmt.Sprintf("UID:buylist-%d@buylist\r\n", scheduled.ID))
+	assert.Contains(t, body, "DTSTART:20300504T103000Z\r\n")
+	assert.Contains(t, body, "SUMMARY:market\\, saturday\r\n")
+	for _, line := range strings.Split(body, "\r\n") {
+		assert.LessOrEqual(t, len(line), 75)
+	}
+	unfolded := strings.ReplaceAll(body, "\r\n ", "")
+	assert.Contains(t, unfolded, "DESCRIPTION:[ ] 6 x calendar apples\\n[ ] 1 kg calendar flour (whole wheat\\, stone ground)\r\n")
+	assert.Contains(t, body, "TRIGGER:-PT60M\r\n")
+	assert.Contains(t, body, "TRIGGER:-PT1440M\r\n")
+	assert.Equal(t, 1, strings.Count(body, "BEGIN:VEVENT"))
+	assert.NotContains(t, body, "someday")
+
+	// a new token revokes the previous one
+	rotated, _ := calendar.Rotate(owner)
+	assert.Equal(t, http.StatusNotFound, get(token.Path()).Code)
+	assert.Equal(t, http.StatusOK, get(rotated.Path()).Code)
+	current, _ := calendar.Token(owner)
+	assert.Equal(t, rotated.Token, current.Token)
+
+	assert.Nil(t, calendar.Revoke(owner))
+	assert.Equal(t, http.StatusNotFound, get(rotated.Path()).Code)
+	assert.ErrorIs(t, calendar.Revoke(owner), internal.ErrCalendarTokenNotFound)
+	assert.Equal(t, http.StatusNotFound, get("/api/calendar/"+rotated.Token).Code)
+
+	lists.Delete(uint64(scheduled.ID), 0)
+	lists.Delete(uint64(unscheduled.ID), 0)
+}
+
+func TestArchive(t *testing.T) {
+	suffix := time.Now().UnixNano()
+	owner, restored := fmt.Sprintf("archive-%d", suffix), fmt.Sprintf("archive-restored-%d", suffix)
+	lists := internal.BuyListService{Database: db}
+	settings := internal.UserSettingsService{Database: db}
+	service := internal.ArchiveService{Database: db, Events: &internal.EventBus{}}
+
+	ingredients := internal.IngredientService{Database: db}
+	tomato, _ := ingredients.Create(internal.Ingredient{Name: fmt.Sprintf("archive tomato %d", suffix), Category: "produce"})
+	settings.Save(internal.UserSettings{UserID: owner, Email: "archive@example.com", MonthlyBudget: 300})
+	scheduledFor := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	budget := 40.0
+	list, _ := lists.Create(internal.BuyList{
+		Title:        "archived",
+		Owner:        owner,
+		ScheduledFor: &scheduledFor,
+		Budget:       &budget,
+		Items: []internal.BuyItem{
+			{IngredientID: int(tomato.ID), Quantity: 3, Unit: "kg", Notes: "ripe"},
+			{Ingredient: internal.Ingredient{Name: fmt.Sprintf("archive basil %d", suffix)}, Quantity: 1, Purchased: true},
+		},
+		Reminders: []internal.Reminder{{OffsetMinutes: 90}, {OffsetMinutes: 72 * 60}},
+	})
+
+	archive, err := service.Export(owner)
+	assert.Nil(t, err)
+	assert.Equal(t, internal.ArchiveVersion, archive.Version)
+	assert.Equal(t, "archive@example.com", archive.Settings.Email)
+	assert.Len(t, archive.Ingredients, 2)
+	assert.Len(t, archive.Lists, 1)
+	assert.Equal(t, list.ID, archive.Lists[0].ID)
+	assert.Equal(t, tomato.ID, archive.Lists[0].Items[0].IngredientID)
+	assert.Equal(t, uint(90), archive.Lists[0].Reminders[0].OffsetMinutes)
+
+	// the basil is removed so the import creates it again, the tomato already exists
+	var basil internal.Ingredient
+	db.Where("name = ?", fmt.Sprintf("archive basil %d", suffix)).First(&basil)
+	db.Unscoped().Delete(&basil)
+
+	var file bytes.Buffer
+	assert.Nil(t, archive.WriteZip(&file))
+	read, err := internal.ReadArchive(&file)
+	assert.Nil(t, err)
+	result, err := service.Import(read, restored)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{basil.Name}, result.NewIngredients)
+	assert.True(t, result.Settings)
+
+	imported, err := lists.Get(uint64(result.Lists[list.ID]))
+	assert.Nil(t, err)
+	assert.NotEqual(t, list.ID, imported.ID)
+	assert.Equal(t, restored, imported.Owner)
+	assert.Equal(t, "archived", imported.Title)
+	assert.Equal(t, budget, *imported.Budget)
+	assert.True(t, scheduledFor.Equal(*imported.ScheduledFor))
+	assert.Len(t, imported.Items, 2)
+	assert.Equal(t, int(tomato.ID), imported.Items[0].IngredientID)
+	assert.Equal(t, "ripe", imported.Items[0].Notes)
+	assert.Equal(t, "kg", imported.Items[0].Unit)
+	assert.True(t, imported.Items[1].Purchased)
+	assert.NotEqual(t, int(basil.ID), imported.Items[1].IngredientID)
+	// the reminder due before the import isn't restored
+	assert.Len(t, imported.Reminders, 1)
+	assert.True(t, scheduledFor.Add(-90*time.Minute).Equal(imported.Reminders[0].FireAt))
+	restoredSettings, _ := settings.Get(restored)
+	assert.Equal(t, 300.0, restoredSettings.MonthlyBudget)
+
+	_, err = internal.ReadArchive(strings.NewReader(`{"Version": 99}`))
+	assert.ErrorIs(t, err, internal.ErrInvalidArchive)
+	_, err = internal.ReadArchive(strings.NewReader(`not json`))
+	assert.ErrorIs(t, err, internal.ErrInvalidArchive)
+	_, err = service.Import(internal.Archive{
+		Version: internal.ArchiveVersion,
+		Lists:   []internal.ArchiveList{{ID: 1, Title: "broken", Items: []internal.ArchiveItem{{IngredientID: 7, Quantity: 1}}}},
+	}, restored)
+	assert.ErrorIs(t, err, internal.ErrInvalidArchive)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/export", nil)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	lists.Delete(uint64(list.ID), 0)
+	lists.Delete(uint64(imported.ID), 0)
 }
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/api/middleware"
+	"buylist/internal"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+// FindTrash godoc
+// @Summary Find deleted records
+// @Description Returns the deleted buylists of the user and the ingredients it deleted,
+// most recently deleted first. Records are purged after the retention period.
+// @Produces json
+// @Sucess 200 {object} internal.Trash
+// @Failure 500
+// @Router /api/trash [get]
+func FindTrash(c *gin.Context, service *internal.TrashService) {
+	trash, err := service.Find(auth.UserID(c.Request))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, trash)
+}
+
+// RestoreTrash godoc
+// @Summary Restore a deleted record
+// @Description Restores a buylist, with the items deleted with it, or an ingredient deleted by the user.
+// @Produces json
+// @Sucess 200 {object} internal.BuyList
+// @Failure 400
+// @Failure 404
+// @Failure 500
+// @Router /api/trash/{type}/{id}/restore [post]
+// @Param type path string true "buylist or ingredient"
+// @Param id path int true "record identifier"
+func RestoreTrash(c *gin.Context, service *internal.TrashService) {
+	idNum := c.MustGet("idNum").(uint64)
+
+	var restored interface{}
+	var err error
+	switch c.Param("type") {
+	case internal.TrashBuyList:
+		restored, err = service.RestoreBuyList(auth.UserID(c.Request), uint(idNum))
+	case internal.TrashIngredient:
+		restored, err = service.RestoreIngredient(auth.UserID(c.Request), uint(idNum))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type, must be buylist or ingredient"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, restored)
+}
+
+// PurgeTrash godoc
+// @Summary Permanently delete a deleted record
+// @Description Permanently deletes a buylist, with its items, or an ingredient deleted by the user on the trash.
+// Ingredients used by items of lists can't be purged.
+// @Produces json
+// @Sucess 200 {object} internal.BuyList
+// @Failure 400
+// @Failure 404
+// @Failure 409
+// @Failure 500
+// @Router /api/trash/{type}/{id} [delete]
+// @Param type path string true "buylist or ingredient"
+// @Param id path int true "record identifier"
+func PurgeTrash(c *gin.Context, service *internal.TrashService) {
+	idNum := c.MustGet("idNum").(uint64)
+
+	var purged interface{}
+	var err error
+	switch c.Param("type") {
+	case internal.TrashBuyList:
+		purged, err = service.PurgeBuyList(auth.UserID(c.Request), uint(idNum))
+	case internal.TrashIngredient:
+		purged, err = service.PurgeIngredient(auth.UserID(c.Request), uint(idNum))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type, must be buylist or ingredient"})
+		return
+	}
+
+	if errors.Is(err, internal.ErrIngredientInUse) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, purged)
+}
+
+func GetTrashRoutes(group *gin.RouterGroup, db *gorm.DB, events *internal.EventBus) {
+	service := internal.TrashService{Database: db, Events: events}
+	trash := group.Group("trash")
+	{
+		trash.Use(adapter.Wrap(auth.EnsureValidToken()))
+		trash.GET("", func(c *gin.Context) {
+			FindTrash(c, &service)
+		})
+		trash.POST("/:type/:id/restore", middleware.ValidateId(), func(c *gin.Context) {
+			RestoreTrash(c, &service)
+		})
+		trash.DELETE("/:type/:id", middleware.ValidateId(), func(c *gin.Context) {
+			PurgeTrash(c, &service)
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"buylist/api/auth"
+	"buylist/api/middleware"
+	"buylist/internal"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	adapter "github.com/gwatts/gin-adapter"
+	"gorm.io/gorm"
+)
+
+// NewWebhook is a webhook as created, the only time its Secret is shown.
+type NewWebhook struct {
+	internal.Webhook
+	Secret string
+}
+
+// FindWebhooks godoc
+// @Summary Find webhooks
+// @Description Returns the webhooks registered by the authenticated user.
+// @Produces json
+// @Sucess 200 {array} []internal.Webhook
+// @Failure 500
+// @Router /api/webhooks [get]
+func FindWebhooks(c *gin.Context, service *internal.WebhookService) {
+	webhooks, err := service.Find(auth.UserID(c.Request))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// CreateWebhook godoc
+// @Summary Create webhook
+// @Description Registers an URL that receives the events it is subscribed to:
+// buylist.created, buylist.updated, buylist.deleted, buylist.completed, item.added, item.removed,
+// item.quantity_changed, item.purchased, item.unpurchased, ingredient.created, ingredient.updated,
+// ingredient.deleted, ingredient.restored, budget.threshold_crossed or * for all of them.
+// Events of the user lists are sent to its webhooks. Ingredients are shared by every user, so
+// ingredient events are sent to every webhook subscribed to their type, * doesn't include them.
+// Deliveries are signed with HMAC-SHA256 of the body on X-Buylist-Signature header,
+// using the webhook Secret (generated when not sent). The Secret is only returned here.
+// The URL must be http or https and can't reach loopback, link-local or private addresses.
+// @Accepts json
+// @Produces json
+// @Sucess 201 {object} NewWebhook
+// @Failure 400
+// @Router /api/webhooks [post]
+func CreateWebhook(c *gin.Context, service *internal.WebhookService) {
+	var body NewWebhook
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	webhook := body.Webhook
+	webhook.Secret = body.Secret
+	webhook.UserID = auth.UserID(c.Request)
+	webhook, err := service.Create(webhook)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, NewWebhook{Webhook: webhook, Secret: webhook.Secret})
+}
+
+// DeleteWebhook godoc
+// @Summary Deletes a webhook
+// @Description Receives the identifier of a webhook and deletes it.
+// @Produces json
+// @Sucess 200 {object} internal.Webhook
+// @Failure 400
+// @Failure 404
+// @Router /api/webhooks/{id} [delete]
+// @Param id path int true "webhook identifier"
+func DeleteWebhook(c *gin.Context, service *internal.WebhookService) {
+	idNum := c.MustGet("idNum").(uint64)
+	webhook, err := service.Delete(auth.UserID(c.Request), idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhook)
+}
+
+// FindWebhookDeliveries godoc
+// @Summary Find webhook deliveries
+// @Description Returns the latest deliveries of a webhook with the log of its attempts.
+// @Produces json
+// @Sucess 200 {array} []internal.WebhookDelivery
+// @Failure 400
+// @Failure 404
+// @Router /api/webhooks/{id}/deliveries [get]
+// @Param id path int true "webhook identifier"
+// @Param limit query int false "max number of deliveries returned, 50 by default"
+func FindWebhookDeliveries(c *gin.Context, service *internal.WebhookService) {
+	idNum := c.MustGet("idNum").(uint64)
+	webhook, err := service.Get(auth.UserID(c.Request), idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := 50
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+	}
+
+	deliveries, err := service.Deliveries(webhook, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// RedeliverWebhook godoc
+// @Summary Redeliver a webhook delivery
+// @Description Sends a past delivery of the webhook again.
+// @Produces json
+// @Sucess 200 {object} internal.WebhookDelivery
+// @Failure 400
+// @Failure 404
+// @Router /api/webhooks/{id}/deliveries/{delivery}/redeliver [post]
+// @Param id path int true "webhook identifier"
+// @Param delivery path int true "delivery identifier"
+func RedeliverWebhook(c *gin.Context, service *internal.WebhookService, dispatcher *internal.WebhookDispatcher) {
+	idNum := c.MustGet("idNum").(uint64)
+	webhook, err := service.Get(auth.UserID(c.Request), idNum)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	deliveryID, err := strconv.ParseUint(c.Param("delivery"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery identifier"})
+		return
+	}
+
+	delivery, err := dispatcher.Redeliver(webhook, deliveryID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, delivery)
+}
+
+func GetWebhookRoutes(group *gin.RouterGroup, db *gorm.DB, dispatcher *internal.WebhookDispatcher) {
+	service := internal.WebhookService{Database: db}
+	webhooks := group.Group("webhooks")
+	{
+		webhooks.Use(adapter.Wrap(auth.EnsureValidToken()))
+		webhooks.GET("", func(c *gin.Context) {
+			FindWebhooks(c, &service)
+		})
+		webhooks.POST("", func(c *gin.Context) {
+			CreateWebhook(c, &service)
+		})
+		webhooks.DELETE("/:id", middleware.ValidateId(), func(c *gin.Context) {
+			DeleteWebhook(c, &service)
+		})
+		webhooks.GET("/:id/deliveries", middleware.ValidateId(), func(c *gin.Context) {
+			FindWebhookDeliveries(c, &service)
+		})
+		webhooks.POST("/:id/deliveries/:delivery/redeliver", middleware.ValidateId(), func(c *gin.Context) {
+			RedeliverWebhook(c, &service, dispatcher)
+		})
+	}
+}
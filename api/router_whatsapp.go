@@ -0,0 +1,71 @@
+package api
+
+import (
+	"buylist/api/middleware"
+	"buylist/internal"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type whatsAppCallback struct {
+	Entry []struct {
+		Changes []struct {
+			Value struct {
+				Statuses []struct {
+					ID        string `json:"id"`
+					Status    string `json:"status"`
+					Timestamp string `json:"timestamp"`
+				} `json:"statuses"`
+			} `json:"value"`
+		} `json:"changes"`
+	} `json:"entry"`
+}
+
+// WhatsAppStatus godoc
+// @Summary WhatsApp delivery status callback
+// @Description Receives the delivery status of messages sent by the WhatsApp provider (sent, delivered, read, failed).
+// @Accepts json
+// @Sucess 200
+// @Failure 400
+// @Failure 401
+// @Failure 500
+// @Failure 503
+// @Router /api/whatsapp/status [post]
+func WhatsAppStatus(c *gin.Context, whatsapp *internal.WhatsAppNotifier) {
+	var callback whatsAppCallback
+	if err := c.BindJSON(&callback); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, entry := range callback.Entry {
+		for _, change := range entry.Changes {
+			for _, status := range change.Value.Statuses {
+				updatedAt := time.Now()
+				if seconds, err := strconv.ParseInt(status.Timestamp, 10, 64); err == nil {
+					updatedAt = time.Unix(seconds, 0)
+				}
+
+				err := whatsapp.UpdateStatus(status.ID, status.Status, updatedAt)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+			}
+		}
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func GetWhatsAppRoutes(group *gin.RouterGroup, whatsapp *internal.WhatsAppNotifier) {
+	callbacks := group.Group("whatsapp", middleware.RequireWhatsApp(whatsapp))
+	{
+		callbacks.POST("/status", middleware.ValidateWhatsAppSignature(), func(c *gin.Context) {
+			WhatsAppStatus(c, whatsapp)
+		})
+	}
+}
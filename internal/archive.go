@@ -0,0 +1,359 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Version of the archive format, increased on incompatible changes.
+const ArchiveVersion = 1
+
+// Name of the archive file inside the ZIP archives.
+const ArchiveFile = "buylist-export.json"
+
+// Max size of an imported archive, compressed or not.
+const maxArchiveSize = 32 << 20
+
+// Archive has everything an user owns, to be restored on this or another
+// instance. Identifiers are the ones of the exporting instance, they only
+// relate the items to their ingredients and are replaced on import.
+// Ingredients are shared by every user, so the archive has the ones used
+// by the lists of the user.
+type Archive struct {
+	Version     int
+	ExportedAt  time.Time
+	Settings    *ArchiveSettings `json:",omitempty"`
+	Ingredients []ArchiveIngredient
+	Lists       []ArchiveList
+}
+
+type ArchiveSettings struct {
+	Email            string
+	MonthlyBudget    float64
+	BudgetThresholds []int
+}
+
+type ArchiveIngredient struct {
+	ID         uint
+	Name       string
+	OriginType string
+	Category   string
+	Aliases    []string
+}
+
+type ArchiveList struct {
+	ID           uint
+	Title        string
+	CreatedAt    time.Time
+	ScheduledFor *time.Time
+	Budget       *float64
+	Items        []ArchiveItem
+	Reminders    []ArchiveReminder
+}
+
+type ArchiveItem struct {
+	IngredientID uint
+	Quantity     uint
+	Unit         string
+	Purchased    bool
+	PurchasedAt  *time.Time
+	Position     float64
+	Notes        string
+}
+
+type ArchiveReminder struct {
+	OffsetMinutes uint
+	SentAt        *time.Time
+}
+
+// ArchiveImportResult has the identifiers given to the lists of an archive
+// by their identifier on the archive, the ingredients created because no
+// ingredient had their name and if the settings were restored.
+type ArchiveImportResult struct {
+	Lists          map[uint]uint
+	NewIngredients []string
+	Settings       bool
+}
+
+// ErrInvalidArchive is returned when an imported archive can't be read.
+var ErrInvalidArchive = errors.New("Invalid archive")
+
+type ArchiveService struct {
+	Database *gorm.DB
+	Events   *EventBus
+}
+
+// Export the lists, with their items and reminders, the ingredients of the
+// items and the settings of owner.
+func (service *ArchiveService) Export(owner string) (Archive, error) {
+	archive := Archive{
+		Version:     ArchiveVersion,
+		ExportedAt:  time.Now().UTC(),
+		Ingredients: []ArchiveIngredient{},
+		Lists:       []ArchiveList{},
+	}
+
+	settings, err := (&UserSettingsService{Database: service.Database}).Get(owner)
+	if err != nil {
+		return archive, err
+	}
+	if settings.ID != 0 {
+		archive.Settings = &ArchiveSettings{
+			Email:            settings.Email,
+			MonthlyBudget:    settings.MonthlyBudget,
+			BudgetThresholds: settings.BudgetThresholds,
+		}
+	}
+
+	var lists []BuyList
+	result := preloadList(service.Database).Where("owner = ?", owner).Order("id").Find(&lists)
+	if result.Error != nil {
+		return archive, result.Error
+	}
+
+	exported := map[uint]bool{}
+	for _, list := range lists {
+		archived := ArchiveList{
+			ID:           list.ID,
+			Title:        list.Title,
+			CreatedAt:    list.CreatedAt,
+			ScheduledFor: list.ScheduledFor,
+			Budget:       list.Budget,
+			Items:        []ArchiveItem{},
+			Reminders:    []ArchiveReminder{},
+		}
+		for _, item := range list.Items {
+			archived.Items = append(archived.Items, ArchiveItem{
+				IngredientID: uint(item.IngredientID),
+				Quantity:     item.Quantity,
+				Unit:         item.Unit,
+				Purchased:    item.Purchased,
+				PurchasedAt:  item.PurchasedAt,
+				Position:     item.Position,
+				Notes:        item.Notes,
+			})
+
+			ingredient := item.Ingredient
+			if ingredient.ID == 0 || exported[ingredient.ID] {
+				continue
+			}
+			exported[ingredient.ID] = true
+			archive.Ingredients = append(archive.Ingredients, ArchiveIngredient{
+				ID:         ingredient.ID,
+				Name:       ingredient.Name,
+				OriginType: ingredient.OriginType,
+				Category:   ingredient.Category,
+				Aliases:    ingredient.Aliases,
+			})
+		}
+		for _, reminder := range list.Reminders {
+			archived.Reminders = append(archived.Reminders, ArchiveReminder{
+				OffsetMinutes: reminder.OffsetMinutes,
+				SentAt:        reminder.SentAt,
+			})
+		}
+		archive.Lists = append(archive.Lists, archived)
+	}
+
+	return archive, nil
+}
+
+// WriteZip writes the archive as a ZIP file with the JSON archive on ArchiveFile.
+func (archive Archive) WriteZip(writer io.Writer) error {
+	files := zip.NewWriter(writer)
+	file, err := files.CreateHeader(&zip.FileHeader{Name: ArchiveFile, Method: zip.Deflate, Modified: archive.ExportedAt})
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(file).Encode(archive); err != nil {
+		return err
+	}
+
+	return files.Close()
+}
+
+// ReadArchive reads an archive as written by Export, as JSON or as a ZIP
+// file with ArchiveFile.
+func ReadArchive(reader io.Reader) (Archive, error) {
+	var archive Archive
+	data, err := io.ReadAll(io.LimitReader(reader, maxArchiveSize+1))
+	if err != nil {
+		return archive, err
+	}
+	if len(data) > maxArchiveSize {
+		return archive, fmt.Errorf("%w: larger than %d bytes", ErrInvalidArchive, maxArchiveSize)
+	}
+
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		files, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return archive, fmt.Errorf("%w: %s", ErrInvalidArchive, err)
+		}
+		file, err := files.Open(ArchiveFile)
+		if err != nil {
+			return archive, fmt.Errorf("%w: %s is not on the ZIP file", ErrInvalidArchive, ArchiveFile)
+		}
+		defer file.Close()
+		if data, err = io.ReadAll(io.LimitReader(file, maxArchiveSize+1)); err != nil {
+			return archive, fmt.Errorf("%w: %s", ErrInvalidArchive, err)
+		}
+		if len(data) > maxArchiveSize {
+			return archive, fmt.Errorf("%w: larger than %d bytes", ErrInvalidArchive, maxArchiveSize)
+		}
+	}
+
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return archive, fmt.Errorf("%w: %s", ErrInvalidArchive, err)
+	}
+	if archive.Version < 1 || archive.Version > ArchiveVersion {
+		return archive, fmt.Errorf("%w: unsupported version %d, must be up to %d", ErrInvalidArchive, archive.Version, ArchiveVersion)
+	}
+
+	return archive, nil
+}
+
+// Import the archive for owner. Lists are always created, so importing an
+// archive twice duplicates them. Ingredients are found by name or alias and
+// only created when there is none. Settings on the archive replace the
+// ones of the owner. Reminders not sent that were due before the import are
+// dropped, so they aren't sent late.
+func (service *ArchiveService) Import(archive Archive, owner string) (ArchiveImportResult, error) {
+	result := ArchiveImportResult{Lists: map[uint]uint{}, NewIngredients: []string{}}
+
+	// ingredients of the archive by their identifier on it
+	ingredients := map[uint]*Ingredient{}
+	missing := []*Ingredient{}
+	found := map[string]*Ingredient{}
+	finder := IngredientService{Database: service.Database}
+	for _, archived := range archive.Ingredients {
+		if strings.TrimSpace(archived.Name) == "" {
+			return result, fmt.Errorf("%w: ingredient %d has no name", ErrInvalidArchive, archived.ID)
+		}
+		key := strings.ToLower(archived.Name)
+		ingredient, resolved := found[key]
+		if !resolved {
+			var err error
+			if ingredient, err = finder.FindByName(archived.Name); err != nil {
+				return result, err
+			}
+			if ingredient == nil {
+				ingredient = &Ingredient{
+					Name:       archived.Name,
+					OriginType: archived.OriginType,
+					Category:   archived.Category,
+					Aliases:    archived.Aliases,
+					Version:    1,
+				}
+				missing = append(missing, ingredient)
+			}
+			found[key] = ingredient
+		}
+		ingredients[archived.ID] = ingredient
+	}
+	for _, list := range archive.Lists {
+		for _, item := range list.Items {
+			if _, exists := ingredients[item.IngredientID]; !exists {
+				return result, fmt.Errorf("%w: ingredient %d of list %d is not on the archive", ErrInvalidArchive, item.IngredientID, list.ID)
+			}
+		}
+	}
+
+	lists := []BuyList{}
+	err := service.Database.Transaction(func(tx *gorm.DB) error {
+		for _, ingredient := range missing {
+			if err := tx.Create(ingredient).Error; err != nil {
+				return err
+			}
+			result.NewIngredients = append(result.NewIngredients, ingredient.Name)
+		}
+
+		for _, archived := range archive.Lists {
+			list := BuyList{
+				Title:        archived.Title,
+				Owner:        owner,
+				ScheduledFor: archived.ScheduledFor,
+				Budget:       archived.Budget,
+				Version:      1,
+			}
+			list.CreatedAt = archived.CreatedAt
+			for i, item := range archived.Items {
+				position := item.Position
+				if position == 0 {
+					position = float64(i + 1)
+				}
+				ingredient := ingredients[item.IngredientID]
+				list.Items = append(list.Items, BuyItem{
+					IngredientID: int(ingredient.ID),
+					Ingredient:   *ingredient,
+					Quantity:     item.Quantity,
+					Unit:         item.Unit,
+					Purchased:    item.Purchased,
+					PurchasedAt:  item.PurchasedAt,
+					Position:     position,
+					Notes:        item.Notes,
+				})
+			}
+			for _, reminder := range archived.Reminders {
+				list.Reminders = append(list.Reminders, Reminder{OffsetMinutes: reminder.OffsetMinutes})
+			}
+			planReminders(&list, nil)
+			// reminders sent before the export aren't sent again, nor the
+			// ones due before the import sent late
+			reminders := []Reminder{}
+			for i, reminder := range list.Reminders {
+				reminder.SentAt = archived.Reminders[i].SentAt
+				if reminder.SentAt == nil && reminder.FireAt.Before(time.Now()) {
+					continue
+				}
+				reminders = append(reminders, reminder)
+			}
+			list.Reminders = reminders
+
+			if err := tx.Create(&list).Error; err != nil {
+				return err
+			}
+			result.Lists[archived.ID] = list.ID
+			lists = append(lists, list)
+		}
+
+		if archive.Settings != nil {
+			settings := UserSettings{
+				UserID:           owner,
+				Email:            archive.Settings.Email,
+				MonthlyBudget:    archive.Settings.MonthlyBudget,
+				BudgetThresholds: archive.Settings.BudgetThresholds,
+			}
+			if _, err := (&UserSettingsService{Database: tx}).Save(settings); err != nil {
+				return err
+			}
+			result.Settings = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		result.Lists = map[uint]uint{}
+		result.NewIngredients = []string{}
+		result.Settings = false
+		return result, err
+	}
+
+	ingredientEvents := IngredientService{Events: service.Events}
+	for _, ingredient := range missing {
+		ingredientEvents.publish(EventIngredientCreated, *ingredient)
+	}
+	listEvents := BuyListService{Events: service.Events}
+	for _, list := range lists {
+		listEvents.publish(EventBuyListCreated, list, list)
+	}
+
+	return result, nil
+}
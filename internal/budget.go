@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Percents of the monthly budget that fire EventBudgetThreshold when the
+// user didn't configure its own.
+var DefaultBudgetThresholds = []int{80, 100}
+
+// BudgetUsage is how much of a budget is used. Spent sums the items
+// purchased with a price, Projected adds the estimate of the pending items,
+// with the latest price of their ingredients in their units.
+type BudgetUsage struct {
+	Budget    float64
+	Spent     float64
+	Projected float64
+	Remaining float64 // budget left after the projected spend
+	Percent   float64 // of the budget projected to be spent
+}
+
+// BudgetStatus is the usage of the monthly budget of the owner of a list
+// and of the budget of the list. Warning is set when any of them is
+// projected to reach the first threshold of the owner.
+type BudgetStatus struct {
+	Month   string
+	Monthly *BudgetUsage `json:",omitempty"`
+	List    *BudgetUsage `json:",omitempty"`
+	Warning bool
+}
+
+// BudgetAlert records that the projected spend of a month crossed a
+// threshold, so the event fires once per month and threshold.
+type BudgetAlert struct {
+	gorm.Model
+	UserID    string `gorm:"uniqueIndex:idx_budget_alert"`
+	Month     string `gorm:"uniqueIndex:idx_budget_alert"`
+	Threshold int    `gorm:"uniqueIndex:idx_budget_alert"`
+	Projected float64
+}
+
+type BudgetService struct {
+	Database *gorm.DB
+	Events   *EventBus
+}
+
+// Estimate of an item not purchased yet, with the latest price of its
+// ingredient in the unit of the item. Items without one are not estimated.
+const pendingSpend = "coalesce((select unit_price from price_observations " +
+	"where ingredient_id = buy_items.ingredient_id and unit = buy_items.unit and deleted_at is null " +
+	"order by observed_at desc, id desc limit 1) * buy_items.quantity, 0)"
+
+func newUsage(budget float64, spent float64, pending float64) *BudgetUsage {
+	usage := &BudgetUsage{
+		Budget:    budget,
+		Spent:     roundPrice(spent),
+		Projected: roundPrice(spent + pending),
+	}
+	usage.Remaining = roundPrice(budget - usage.Projected)
+	if budget > 0 {
+		usage.Percent = math.Round(usage.Projected/budget*10000) / 100
+	}
+
+	return usage
+}
+
+func (service *BudgetService) sum(query *gorm.DB, expression string) (float64, error) {
+	var total float64
+	result := query.Select("coalesce(sum(" + expression + "), 0)").Scan(&total)
+	return total, result.Error
+}
+
+// Usage of the monthly budget of the user on the month of date: the items
+// purchased on the month and the pending ones of lists scheduled for the
+// month or not scheduled.
+func (service *BudgetService) monthly(settings UserSettings, date time.Time) (*BudgetUsage, error) {
+	start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.Local)
+	end := start.AddDate(0, 1, 0)
+
+	filter := ReportFilter{Owner: settings.UserID, From: &start, To: &end}
+	spent, err := service.sum(filter.purchases(service.Database), itemSpend)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := service.sum(service.Database.Table("buy_items").
+		Joins("join buy_lists on buy_lists.id = buy_items.buy_list_id and buy_lists.deleted_at is null").
+		Where("buy_items.deleted_at is null and not buy_items.purchased").
+		Where("buy_lists.owner = ?", settings.UserID).
+		Where("buy_lists.scheduled_for is null or (buy_lists.scheduled_for >= ? and buy_lists.scheduled_for < ?)", start, end),
+		pendingSpend)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUsage(settings.MonthlyBudget, spent, pending), nil
+}
+
+// Usage of the budget of the list, of all its items.
+func (service *BudgetService) list(list BuyList) (*BudgetUsage, error) {
+	filter := ReportFilter{}
+	spent, err := service.sum(filter.purchases(service.Database).Where("buy_items.buy_list_id = ?", list.ID), itemSpend)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := service.sum(service.Database.Table("buy_items").
+		Where("buy_items.deleted_at is null and not buy_items.purchased and buy_items.buy_list_id = ?", list.ID),
+		pendingSpend)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUsage(*list.Budget, spent, pending), nil
+}
+
+// Check the budgets of the list and of its owner after a change on the list
+// and publish EventBudgetThreshold for each threshold of the owner the
+// projected month spend crossed. Returns nil when there are no budgets.
+func (service *BudgetService) Check(listID uint) (*BudgetStatus, error) {
+	var list BuyList
+	if err := service.Database.First(&list, listID).Error; err != nil {
+		return nil, err
+	}
+	settings, err := (&UserSettingsService{Database: service.Database}).Get(list.Owner)
+	if err != nil {
+		return nil, err
+	}
+	if settings.MonthlyBudget <= 0 && list.Budget == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	thresholds := settings.Thresholds()
+	status := &BudgetStatus{Month: now.Format("2006-01")}
+	reached := func(usage *BudgetUsage) bool {
+		return usage.Budget > 0 && usage.Percent >= float64(thresholds[0])
+	}
+
+	if list.Budget != nil {
+		if status.List, err = service.list(list); err != nil {
+			return nil, err
+		}
+		status.Warning = status.List.Remaining < 0 || reached(status.List)
+	}
+	if settings.MonthlyBudget <= 0 {
+		return status, nil
+	}
+
+	if status.Monthly, err = service.monthly(settings, now); err != nil {
+		return nil, err
+	}
+	status.Warning = status.Warning || reached(status.Monthly)
+
+	for _, threshold := range thresholds {
+		if status.Monthly.Percent < float64(threshold) {
+			break
+		}
+		if err := service.alert(settings.UserID, status, threshold); err != nil {
+			return nil, err
+		}
+	}
+
+	return status, nil
+}
+
+// Publish the crossing of threshold unless it was already published this month.
+func (service *BudgetService) alert(userID string, status *BudgetStatus, threshold int) error {
+	alert := BudgetAlert{UserID: userID, Month: status.Month, Threshold: threshold, Projected: status.Monthly.Projected}
+	result := service.Database.
+		Where(BudgetAlert{UserID: userID, Month: status.Month, Threshold: threshold}).
+		FirstOrCreate(&alert)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	service.Events.Publish(Event{
+		Type:  EventBudgetThreshold,
+		Owner: userID,
+		Data: BudgetThresholdCrossed{
+			Month:     status.Month,
+			Threshold: threshold,
+			Budget:    status.Monthly.Budget,
+			Projected: status.Monthly.Projected,
+		},
+	})
+	return nil
+}
+
+// BudgetThresholdCrossed is the data of EventBudgetThreshold.
+type BudgetThresholdCrossed struct {
+	Month     string
+	Threshold int // percent of the budget
+	Budget    float64
+	Projected float64
+}
+
+// Thresholds of the monthly budget of the user, lowest first.
+func (settings UserSettings) Thresholds() []int {
+	if len(settings.BudgetThresholds) == 0 {
+		return DefaultBudgetThresholds
+	}
+
+	thresholds := slices.Clone(settings.BudgetThresholds)
+	slices.Sort(thresholds)
+	return thresholds
+}
+
+// ErrInvalidBudget is returned when saving negative budgets or thresholds.
+var ErrInvalidBudget = errors.New("Budgets and their thresholds must be positive")
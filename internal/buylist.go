@@ -1,28 +1,204 @@
 package internal
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"sort"
+	"time"
 
 	"gorm.io/gorm"
 )
 
 type BuyItem struct {
 	gorm.Model
+	Key          string `gorm:"index"`
 	Ingredient   Ingredient
 	IngredientID int
 	Quantity     uint
+	Unit         string // unit of the quantity: kg, l, pack...
 	BuyListID    int
+	Purchased    bool
+	PurchasedAt  *time.Time
+	Position     float64
+	Notes        string
+	Stamps       ItemStamps `gorm:"serializer:json" json:"-"`
+}
+
+// Generate the key that identifies the item on collaborative editing.
+func (item *BuyItem) BeforeCreate(tx *gorm.DB) error {
+	if item.Key == "" {
+		key := make([]byte, 12)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		item.Key = hex.EncodeToString(key)
+	}
+
+	return nil
 }
 
 type BuyList struct {
 	gorm.Model
-	Title string
-	Items []BuyItem
+	Title        string
+	Owner        string
+	ScheduledFor *time.Time
+	Budget       *float64 // optional limit of the cost of the list
+	Items        []BuyItem
+	Reminders    []Reminder
+	Clock        uint64 `json:"-"`
+	Version      uint   `gorm:"not null;default:1"` // increased on every change of the list or its items
+}
+
+// Preload list items, in the list order, and reminders.
+func preloadList(db *gorm.DB) *gorm.DB {
+	return db.
+		Preload("Items", func(db *gorm.DB) *gorm.DB {
+			return db.Order("position, id")
+		}).
+		Preload("Items.Ingredient").
+		Preload("Reminders")
+}
+
+// Position of an item added to the end of the list.
+func (list BuyList) nextPosition() float64 {
+	position := 0.0
+	for _, item := range list.Items {
+		position = max(position, item.Position)
+	}
+
+	return position + 1
+}
+
+const Uncategorized = "uncategorized"
+
+// ItemGroup are the items of a list whose ingredients share the same category.
+type ItemGroup struct {
+	Category string
+	Items    []BuyItem
+}
+
+// Group list items by the category of its ingredients. Groups are sorted by
+// category name and items without category are put on the last group.
+func GroupItemsByCategory(items []BuyItem) []ItemGroup {
+	groups := []ItemGroup{}
+	index := map[string]int{}
+	for _, item := range items {
+		category := item.Ingredient.Category
+		if category == "" {
+			category = Uncategorized
+		}
+
+		i, exists := index[category]
+		if !exists {
+			i = len(groups)
+			index[category] = i
+			groups = append(groups, ItemGroup{Category: category})
+		}
+		groups[i].Items = append(groups[i].Items, item)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Category == Uncategorized || groups[j].Category == Uncategorized {
+			return groups[j].Category == Uncategorized && groups[i].Category != Uncategorized
+		}
+		return groups[i].Category < groups[j].Category
+	})
+
+	return groups
+}
+
+// Completed reports if every item of the list was purchased.
+func (list BuyList) Completed() bool {
+	for _, item := range list.Items {
+		if !item.Purchased {
+			return false
+		}
+	}
+
+	return len(list.Items) > 0
 }
 
 type BuyListService struct {
 	Database *gorm.DB
+	Events   *EventBus
+}
+
+func (service *BuyListService) publish(eventType string, list BuyList, data interface{}) {
+	service.Events.Publish(Event{
+		Type:      eventType,
+		Owner:     list.Owner,
+		BuyListID: list.ID,
+		Data:      data,
+	})
+}
+
+// BuyListFilter selects lists by title, similar to Title, by the date they
+// were created at and by the other fields when set. Empty fields are not used.
+type BuyListFilter struct {
+	Title         string
+	CreatedAt     sql.NullTime
+	CreatedFrom   *time.Time
+	CreatedTo     *time.Time
+	UpdatedSince  *time.Time
+	ScheduledFrom *time.Time
+	ScheduledTo   *time.Time
+	IngredientID  uint
+	Ingredient    string // name of an ingredient on the list
+	Category      string // category of an ingredient on the list
+	Owner         string
+	Completed     *bool
+	Expression    *FilterExpression
+}
+
+func (filter BuyListFilter) apply(query *gorm.DB) *gorm.DB {
+	if filter.Title != "" {
+		query = query.Where("title like ?", "%"+filter.Title+"%")
+	}
+	if filter.CreatedAt.Valid {
+		query = query.Where("created_at >= ?", filter.CreatedAt.Time)
+		query = query.Where("created_at < ?", filter.CreatedAt.Time.AddDate(0, 0, 1))
+	}
+	if filter.CreatedFrom != nil {
+		query = query.Where("buy_lists.created_at >= ?", *filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		query = query.Where("buy_lists.created_at < ?", *filter.CreatedTo)
+	}
+	if filter.UpdatedSince != nil {
+		query = query.Where("buy_lists.updated_at >= ?", *filter.UpdatedSince)
+	}
+	if filter.ScheduledFrom != nil {
+		query = query.Where("buy_lists.scheduled_for >= ?", *filter.ScheduledFrom)
+	}
+	if filter.ScheduledTo != nil {
+		query = query.Where("buy_lists.scheduled_for < ?", *filter.ScheduledTo)
+	}
+	if filter.IngredientID != 0 {
+		query = query.Where(hasIngredientID, filter.IngredientID)
+	}
+	if filter.Ingredient != "" {
+		query = query.Where(hasIngredientName, filter.Ingredient)
+	}
+	if filter.Category != "" {
+		query = query.Where(hasCategory, filter.Category)
+	}
+	if filter.Owner != "" {
+		query = query.Where("buy_lists.owner = ?", filter.Owner)
+	}
+	if filter.Completed != nil && *filter.Completed {
+		query = query.Where(isCompleted)
+	}
+	if filter.Completed != nil && !*filter.Completed {
+		query = query.Where("not " + isCompleted)
+	}
+	if filter.Expression != nil {
+		query = query.Where(filter.Expression.sql, filter.Expression.args...)
+	}
+
+	return query
 }
 
 // Search lists with similar title to parameter title and created at the date passed
@@ -30,14 +206,8 @@ type BuyListService struct {
 // createdAt will not be used if date is null
 func (service *BuyListService) FindByParams(title string, createdAt sql.NullTime) ([]BuyList, error) {
 	lists := []BuyList{}
-	query := service.Database.Model(&BuyList{}).Preload("Items.Ingredient")
-	if title != "" {
-		query = query.Where("title like ?", "%"+title+"%")
-	}
-	if createdAt.Valid {
-		query = query.Where("created_at >= ?", createdAt.Time)
-		query = query.Where("created_at < ?", createdAt.Time.AddDate(0, 0, 1))
-	}
+	query := service.Database.Model(&BuyList{}).Scopes(preloadList)
+	query = BuyListFilter{Title: title, CreatedAt: createdAt}.apply(query)
 
 	result := query.Find(&lists)
 	return lists, result.Error
@@ -45,18 +215,161 @@ func (service *BuyListService) FindByParams(title string, createdAt sql.NullTime
 
 func (service *BuyListService) Find() ([]BuyList, error) {
 	lists := []BuyList{}
-	query := service.Database.Model(&BuyList{}).Preload("Items.Ingredient")
+	query := service.Database.Model(&BuyList{}).Scopes(preloadList)
 
 	result := query.Find(&lists)
 	return lists, result.Error
 }
 
+// Find a page of the lists selected by filter. Items are loaded only with
+// withItems, so pages of lists without their items are lighter.
+func (service *BuyListService) FindPage(filter BuyListFilter, page Page, withItems bool) ([]BuyList, PageResult, error) {
+	query := filter.apply(service.Database.Model(&BuyList{}))
+	preload := preloadList
+	if !withItems {
+		preload = func(db *gorm.DB) *gorm.DB { return db.Preload("Reminders") }
+	}
+
+	return paginate[BuyList](query, "buy_lists", page, preload)
+}
+
+func (service *BuyListService) Get(ID uint64) (BuyList, error) {
+	var list BuyList
+	result := service.Database.Model(&list).Scopes(preloadList).First(&list, ID)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return list, errors.New("List does not exists")
+	}
+
+	return list, result.Error
+}
+
+// Owned fails with ErrBuyListNotFound when the list doesn't exist or isn't
+// of owner, so lists of other users can't be told apart from missing ones.
+func (service *BuyListService) Owned(ID uint64, owner string) error {
+	var count int64
+	result := service.Database.Model(&BuyList{}).Where("id = ? and owner = ?", ID, owner).Count(&count)
+	if result.Error != nil {
+		return result.Error
+	}
+	if count == 0 {
+		return ErrBuyListNotFound
+	}
+
+	return nil
+}
+
+const (
+	IncludeItems           = "items"
+	IncludeItemsIngredient = "items.ingredient"
+	IncludeReminders       = "reminders"
+)
+
+// Relations of a list that can be loaded with it.
+var BuyListIncludes = []string{IncludeItems, IncludeItemsIngredient, IncludeReminders}
+
+// Get the list loading only the relations on include.
+func (service *BuyListService) GetIncluding(ID uint64, include []string) (BuyList, error) {
+	query := service.Database.Model(&BuyList{})
+	for _, relation := range include {
+		switch relation {
+		case IncludeItems:
+			query = query.Preload("Items", func(db *gorm.DB) *gorm.DB {
+				return db.Order("position, id")
+			})
+		case IncludeItemsIngredient:
+			query = query.Preload("Items.Ingredient")
+		case IncludeReminders:
+			query = query.Preload("Reminders")
+		default:
+			return BuyList{}, fmt.Errorf("Unknown relation %s", relation)
+		}
+	}
+
+	var list BuyList
+	result := query.First(&list, ID)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return list, errors.New("List does not exists")
+	}
+
+	return list, result.Error
+}
+
+// Last time the list, any of its items or their ingredients was changed.
+func (service *BuyListService) LastModified(list BuyList) (time.Time, error) {
+	var items []BuyItem
+	result := service.Database.Unscoped().
+		Select("updated_at", "deleted_at").
+		Where("buy_list_id = ?", list.ID).
+		Find(&items)
+
+	if result.Error != nil {
+		return list.UpdatedAt, result.Error
+	}
+
+	// ingredients are shown with the items, so their changes also change the list
+	var ingredients []Ingredient
+	result = service.Database.Unscoped().
+		Select("updated_at").
+		Where("id in (?)", service.Database.Model(&BuyItem{}).Select("ingredient_id").Where("buy_list_id = ?", list.ID)).
+		Find(&ingredients)
+
+	modified := list.UpdatedAt
+	for _, item := range items {
+		if item.UpdatedAt.After(modified) {
+			modified = item.UpdatedAt
+		}
+		if item.DeletedAt.Valid && item.DeletedAt.Time.After(modified) {
+			modified = item.DeletedAt.Time
+		}
+	}
+	for _, ingredient := range ingredients {
+		if ingredient.UpdatedAt.After(modified) {
+			modified = ingredient.UpdatedAt
+		}
+	}
+
+	return modified, result.Error
+}
+
 func (service *BuyListService) Create(list BuyList) (BuyList, error) {
+	planReminders(&list, nil)
+	// identifiers sent would take over the records of other lists
+	list.ID = 0
+	for i := range list.Items {
+		list.Items[i].ID = 0
+		if list.Items[i].Position == 0 {
+			list.Items[i].Position = float64(i + 1)
+		}
+	}
+
+	list.Version = 1
 	result := service.Database.Create(&list)
+	if result.Error == nil {
+		service.publish(EventBuyListCreated, list, list)
+	}
+
 	return list, result.Error
 }
 
+// Update the list when its stored version is list.Version, otherwise fails
+// with ErrVersionConflict. Version 0 updates whatever is stored.
 func (service *BuyListService) Update(list BuyList, ID uint64) (BuyList, error) {
+	return service.update(list, ID, false)
+}
+
+// Patch stores the list as sent: items missing on list are removed, items
+// without ID are added and the others updated. Like Update, the stored
+// version must be list.Version.
+func (service *BuyListService) Patch(list BuyList, ID uint64) (BuyList, error) {
+	list, err := service.update(list, ID, true)
+	if err != nil {
+		return list, err
+	}
+
+	return service.Get(ID)
+}
+
+func (service *BuyListService) update(list BuyList, ID uint64, replaceItems bool) (BuyList, error) {
 	var findBuyList BuyList
 	service.Database.First(&findBuyList, ID)
 
@@ -69,14 +382,130 @@ func (service *BuyListService) Update(list BuyList, ID uint64) (BuyList, error)
 		return list, err
 	}
 
-	result := service.Database.Save(&list)
+	var stored []BuyItem
+	service.Database.Select("id").Where("buy_list_id = ?", ID).Find(&stored)
+	storedItems := map[uint]bool{}
+	for _, item := range stored {
+		storedItems[item.ID] = true
+	}
+	for _, item := range list.Items {
+		if item.ID != 0 && !storedItems[item.ID] {
+			return list, fmt.Errorf("Item %d does not exists on list", item.ID)
+		}
+	}
 
-	return list, result.Error
+	var reminders []Reminder
+	service.Database.Where("buy_list_id = ?", ID).Find(&reminders)
+	planReminders(&list, reminders)
+	list.Owner = findBuyList.Owner
+	list.Clock = findBuyList.Clock
+	list.CreatedAt = findBuyList.CreatedAt
+	list.DeletedAt = findBuyList.DeletedAt
+
+	err = service.Database.Transaction(func(tx *gorm.DB) error {
+		version, err := swapVersion(tx, &BuyList{}, ID, list.Version)
+		if err != nil {
+			return err
+		}
+		list.Version = version
+
+		err = tx.Unscoped().Where("buy_list_id = ?", ID).Delete(&Reminder{}).Error
+		if err != nil {
+			return err
+		}
+
+		if !replaceItems {
+			return tx.Save(&list).Error
+		}
+
+		if err := tx.Omit("Items").Save(&list).Error; err != nil {
+			return err
+		}
+		return replaceListItems(tx, &list)
+	})
+	if err == nil {
+		service.publish(EventBuyListUpdated, list, list)
+	}
+
+	return list, err
+}
+
+// Make the stored items of the list the same as list.Items.
+func replaceListItems(tx *gorm.DB, list *BuyList) error {
+	var stored []BuyItem
+	if err := tx.Where("buy_list_id = ?", list.ID).Find(&stored).Error; err != nil {
+		return err
+	}
+
+	storedByID := map[uint]BuyItem{}
+	position := 0.0
+	for _, item := range stored {
+		storedByID[item.ID] = item
+		position = max(position, item.Position)
+	}
+
+	kept := map[uint]bool{}
+	for i := range list.Items {
+		item := &list.Items[i]
+		item.BuyListID = int(list.ID)
+		if item.IngredientID != 0 {
+			item.Ingredient = Ingredient{}
+		}
+		if item.Purchased && item.PurchasedAt == nil {
+			purchasedAt := time.Now()
+			item.PurchasedAt = &purchasedAt
+		}
+		if !item.Purchased {
+			item.PurchasedAt = nil
+		}
+
+		if item.ID == 0 {
+			item.Key = ""
+			if item.Position == 0 {
+				position++
+				item.Position = position
+			}
+			if err := tx.Create(item).Error; err != nil {
+				return err
+			}
+			continue
+		}
+
+		storedItem, exists := storedByID[item.ID]
+		if !exists {
+			return fmt.Errorf("Item %d does not exists on list", item.ID)
+		}
+		kept[item.ID] = true
+		item.Key = storedItem.Key
+		item.Stamps = storedItem.Stamps
+		item.CreatedAt = storedItem.CreatedAt
+		if item.IngredientID == 0 {
+			item.IngredientID = storedItem.IngredientID
+		}
+		result := tx.Model(item).
+			Select("IngredientID", "Quantity", "Unit", "Purchased", "PurchasedAt", "Position", "Notes").
+			Updates(item)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	for _, item := range stored {
+		if !kept[item.ID] {
+			if err := tx.Delete(&item).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
-func (service *BuyListService) Delete(ID uint64) (BuyList, error) {
+// Delete the list when its stored version is version, version 0 deletes
+// whatever is stored.
+func (service *BuyListService) Delete(ID uint64, version uint) (BuyList, error) {
 	var findBuyList BuyList
-	service.Database.Model(&findBuyList).Preload("Items.Ingredient").First(&findBuyList, ID)
+	service.Database.Model(&findBuyList).Scopes(preloadList).First(&findBuyList, ID)
 
 	var err error
 	if findBuyList.ID == 0 {
@@ -87,7 +516,142 @@ func (service *BuyListService) Delete(ID uint64) (BuyList, error) {
 		return findBuyList, err
 	}
 
-	result := service.Database.Delete(&findBuyList)
+	err = service.Database.Transaction(func(tx *gorm.DB) error {
+		version, err := swapVersion(tx, &BuyList{}, ID, version)
+		if err != nil {
+			return err
+		}
+		findBuyList.Version = version
+
+		if err := tx.Delete(&findBuyList).Error; err != nil {
+			return err
+		}
+		// items go to the trash with the list, so they are restored with it
+		return tx.Where("buy_list_id = ?", ID).Delete(&BuyItem{}).Error
+	})
+	if err == nil {
+		service.publish(EventBuyListDeleted, findBuyList, findBuyList)
+	}
+
+	return findBuyList, err
+}
+
+// Find the list and one of its items.
+func (service *BuyListService) getItem(listID uint64, itemID uint64) (BuyList, *BuyItem, error) {
+	list, err := service.Get(listID)
+	if err != nil {
+		return list, nil, err
+	}
+
+	for i := range list.Items {
+		if uint64(list.Items[i].ID) == itemID {
+			return list, &list.Items[i], nil
+		}
+	}
+
+	return list, nil, errors.New("Item does not exists on list")
+}
+
+// Add an item to the list. The item ingredient is created when the item
+// doesn't reference an existing one by IngredientID.
+func (service *BuyListService) AddItem(listID uint64, item BuyItem) (BuyItem, error) {
+	list, err := service.Get(listID)
+	if err != nil {
+		return item, err
+	}
+
+	item.ID = 0
+	item.Key = ""
+	item.BuyListID = int(list.ID)
+	item.Position = list.nextPosition()
+	if item.IngredientID != 0 {
+		item.Ingredient = Ingredient{}
+	}
+
+	result := service.Database.Create(&item)
+	if result.Error != nil {
+		return item, result.Error
+	}
+	service.Database.Preload("Ingredient").First(&item, item.ID)
+	bumpListVersion(service.Database, list.ID)
+
+	service.publish(EventItemAdded, list, item)
+	return item, nil
+}
+
+// Remove an item from the list.
+func (service *BuyListService) RemoveItem(listID uint64, itemID uint64) (BuyItem, error) {
+	list, item, err := service.getItem(listID, itemID)
+	if err != nil {
+		return BuyItem{}, err
+	}
+
+	result := service.Database.Delete(item)
+	if result.Error != nil {
+		return *item, result.Error
+	}
+	bumpListVersion(service.Database, list.ID)
+
+	service.publish(EventItemRemoved, list, *item)
+	return *item, nil
+}
+
+// Change the quantity of an item of the list.
+func (service *BuyListService) SetQuantity(listID uint64, itemID uint64, quantity uint) (BuyItem, error) {
+	list, item, err := service.getItem(listID, itemID)
+	if err != nil {
+		return BuyItem{}, err
+	}
+
+	if item.Quantity == quantity {
+		return *item, nil
+	}
+
+	item.Quantity = quantity
+	result := service.Database.Model(item).Select("Quantity").Updates(item)
+	if result.Error != nil {
+		return *item, result.Error
+	}
+	bumpListVersion(service.Database, list.ID)
+
+	service.publish(EventItemQuantity, list, *item)
+	return *item, nil
+}
+
+// Mark an item of the list as purchased or not.
+// When the last item of the list is purchased the list is completed.
+func (service *BuyListService) SetPurchased(listID uint64, itemID uint64, purchased bool) (BuyItem, error) {
+	list, item, err := service.getItem(listID, itemID)
+	if err != nil {
+		return BuyItem{}, err
+	}
+
+	if item.Purchased == purchased {
+		return *item, nil
+	}
+
+	item.Purchased = purchased
+	item.PurchasedAt = nil
+	if purchased {
+		purchasedAt := time.Now()
+		item.PurchasedAt = &purchasedAt
+	}
+
+	result := service.Database.Model(item).Select("Purchased", "PurchasedAt").Updates(item)
+	if result.Error != nil {
+		return *item, result.Error
+	}
+	bumpListVersion(service.Database, list.ID)
+
+	if !purchased {
+		service.publish(EventItemUnpurchased, list, *item)
+		return *item, nil
+	}
+
+	service.publish(EventItemPurchased, list, *item)
+	if list.Completed() {
+		service.publish(EventBuyListCompleted, list, list)
+	}
 
-	return findBuyList, result.Error
+	return *item, nil
 }
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// Duration of the event of a scheduled list.
+const calendarEventDuration = "PT1H"
+
+// CalendarToken is the secret of the iCalendar feed of an user, it gives
+// read access to the scheduled lists of the user without authentication.
+type CalendarToken struct {
+	gorm.Model
+	UserID string `gorm:"uniqueIndex"`
+	Token  string `gorm:"uniqueIndex"`
+}
+
+// Path of the feed of the token.
+func (token CalendarToken) Path() string {
+	return "/api/calendar/" + token.Token + ".ics"
+}
+
+var ErrCalendarTokenNotFound = errors.New("Calendar token does not exists")
+
+type CalendarService struct {
+	Database *gorm.DB
+}
+
+// Token of the feed of the user.
+func (service *CalendarService) Token(userID string) (CalendarToken, error) {
+	var token CalendarToken
+	result := service.Database.Where("user_id = ?", userID).First(&token)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return token, ErrCalendarTokenNotFound
+	}
+
+	return token, result.Error
+}
+
+// Create a new token for the user, revoking the one it had.
+func (service *CalendarService) Rotate(userID string) (CalendarToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return CalendarToken{}, err
+	}
+	token := CalendarToken{UserID: userID, Token: hex.EncodeToString(secret)}
+
+	err := service.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&CalendarToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&token).Error
+	})
+	return token, err
+}
+
+// Revoke the token of the user, its feed stops working.
+func (service *CalendarService) Revoke(userID string) error {
+	result := service.Database.Unscoped().Where("user_id = ?", userID).Delete(&CalendarToken{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrCalendarTokenNotFound
+	}
+
+	return result.Error
+}
+
+// Scheduled lists of the owner of the token, with their items and reminders.
+func (service *CalendarService) Feed(secret string) ([]BuyList, error) {
+	var token CalendarToken
+	result := service.Database.Where("token = ?", secret).First(&token)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrCalendarTokenNotFound
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	lists := []BuyList{}
+	result = preloadList(service.Database).
+		Where("owner = ? and scheduled_for is not null", token.UserID).
+		Order("scheduled_for, id").
+		Find(&lists)
+	return lists, result.Error
+}
+
+var calendarEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// Write a content line folded on lines of 75 octets, as RFC 5545 requires.
+func writeCalendarLine(writer io.Writer, line string) error {
+	var folded strings.Builder
+	length := 0
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if length+size > 75 {
+			folded.WriteString("\r\n ")
+			length = 1
+		}
+		folded.WriteRune(r)
+		length += size
+	}
+	folded.WriteString("\r\n")
+
+	_, err := io.WriteString(writer, folded.String())
+	return err
+}
+
+// WriteCalendar writes the lists as an iCalendar with an event on the
+// scheduled date of each one, an alarm for each of its reminders and its
+// items on the description.
+func WriteCalendar(writer io.Writer, lists []BuyList) error {
+	const stamp = "20060102T150405Z"
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//buylist//buylist calendar//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:Shopping trips",
+	}
+	for _, list := range lists {
+		if list.ScheduledFor == nil {
+			continue
+		}
+
+		description := []string{}
+		for _, item := range list.Items {
+			check := " "
+			if item.Purchased {
+				check = "x"
+			}
+			line := fmt.Sprintf("[%s] %s %s", check, itemQuantity(item), item.Ingredient.Name)
+			if item.Notes != "" {
+				line += " (" + item.Notes + ")"
+			}
+			description = append(description, line)
+		}
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:buylist-%d@buylist", list.ID),
+			"DTSTAMP:"+list.UpdatedAt.UTC().Format(stamp),
+			"LAST-MODIFIED:"+list.UpdatedAt.UTC().Format(stamp),
+			fmt.Sprintf("SEQUENCE:%d", list.Version),
+			"DTSTART:"+list.ScheduledFor.UTC().Format(stamp),
+			"DURATION:"+calendarEventDuration,
+			"SUMMARY:"+calendarEscaper.Replace(list.Title),
+		)
+		if len(description) > 0 {
+			lines = append(lines, "DESCRIPTION:"+calendarEscaper.Replace(strings.Join(description, "\n")))
+		}
+		for _, reminder := range list.Reminders {
+			lines = append(lines,
+				"BEGIN:VALARM",
+				"ACTION:DISPLAY",
+				"DESCRIPTION:"+calendarEscaper.Replace(list.Title),
+				fmt.Sprintf("TRIGGER:-PT%dM", reminder.OffsetMinutes),
+				"END:VALARM",
+			)
+		}
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		if err := writeCalendarLine(writer, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	OperationAddItem      = "add_item"
+	OperationRemoveItem   = "remove_item"
+	OperationSetQuantity  = "set_quantity"
+	OperationSetPurchased = "set_purchased"
+	OperationMoveItem     = "move_item"
+)
+
+// Stamp orders concurrent operations: a Lamport clock with the replica that
+// generated the operation as tie breaker.
+type Stamp struct {
+	Clock   uint64
+	Replica string
+}
+
+// After reports if the stamp is more recent than other.
+func (stamp Stamp) After(other Stamp) bool {
+	if stamp.Clock != other.Clock {
+		return stamp.Clock > other.Clock
+	}
+	return stamp.Replica > other.Replica
+}
+
+// ItemStamps are the stamps of the last write on each field of an item.
+type ItemStamps struct {
+	Quantity  Stamp
+	Purchased Stamp
+	Position  Stamp
+}
+
+// Operation is a change made by a client on a list being edited
+// collaboratively. Items are identified by their Key, so clients can refer to
+// items they added before the server answered.
+//
+// Lists are merged as a CRDT: items are an add-wins set where removes are
+// final, and quantity, purchased and position are last-writer-wins registers
+// ordered by Stamp. Applying the same operations in any order gives the same
+// list.
+type Operation struct {
+	Type      string
+	Stamp     Stamp
+	ItemKey   string
+	Item      *BuyItem `json:",omitempty"`
+	Quantity  uint
+	Purchased bool
+	Position  float64
+}
+
+// OperationResult is the outcome of an operation sent by a client. Operations
+// that lost to a concurrent one are applied without changes to the list.
+type OperationResult struct {
+	ItemKey string
+	Applied bool
+	Error   string `json:",omitempty"`
+}
+
+// Apply operations of a client to the list, persisting the merged state.
+// Returns the list after the operations and the result of each operation.
+func (service *BuyListService) ApplyOperations(listID uint64, operations []Operation) (BuyList, []OperationResult, error) {
+	results := make([]OperationResult, len(operations))
+	published := []Event{}
+
+	err := service.Database.Transaction(func(tx *gorm.DB) error {
+		var list BuyList
+		if err := tx.Scopes(preloadList).First(&list, listID).Error; err != nil {
+			return errors.New("List does not exists")
+		}
+
+		for i, operation := range operations {
+			results[i].ItemKey = operation.ItemKey
+			event, err := applyOperation(tx, &list, operation)
+			if err != nil {
+				results[i].Error = err.Error()
+				continue
+			}
+
+			results[i].Applied = event != nil
+			if event != nil {
+				event.Owner = list.Owner
+				event.BuyListID = list.ID
+				published = append(published, *event)
+
+				if event.Type == EventItemPurchased && list.Completed() {
+					published = append(published, Event{
+						Type:      EventBuyListCompleted,
+						Owner:     list.Owner,
+						BuyListID: list.ID,
+						Data:      list,
+					})
+				}
+			}
+			list.Clock = max(list.Clock, operation.Stamp.Clock)
+		}
+
+		if len(published) > 0 {
+			if err := bumpListVersion(tx, list.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&list).Update("clock", list.Clock).Error
+	})
+	if err != nil {
+		return BuyList{}, nil, err
+	}
+
+	for _, event := range published {
+		service.Events.Publish(event)
+	}
+
+	list, err := service.Get(listID)
+	return list, results, err
+}
+
+// Apply one operation on list, returns the event of the change or nil when
+// the operation lost to a more recent one.
+func applyOperation(tx *gorm.DB, list *BuyList, operation Operation) (*Event, error) {
+	if operation.ItemKey == "" {
+		return nil, errors.New("Operation without ItemKey")
+	}
+
+	var item *BuyItem
+	index := -1
+	for i := range list.Items {
+		if list.Items[i].Key == operation.ItemKey {
+			item = &list.Items[i]
+			index = i
+		}
+	}
+
+	if operation.Type == OperationAddItem {
+		if operation.Item == nil {
+			return nil, errors.New("add_item operation without Item")
+		}
+
+		// adding twice or after the item was removed does nothing
+		var count int64
+		tx.Unscoped().Model(&BuyItem{}).Where("buy_list_id = ? and \"key\" = ?", list.ID, operation.ItemKey).Count(&count)
+		if count > 0 {
+			return nil, nil
+		}
+
+		added := *operation.Item
+		added.ID = 0
+		added.Key = operation.ItemKey
+		added.BuyListID = int(list.ID)
+		added.Purchased = false
+		added.PurchasedAt = nil
+		if added.Position == 0 {
+			added.Position = list.nextPosition()
+		}
+		if added.IngredientID != 0 {
+			added.Ingredient = Ingredient{}
+		}
+		added.Stamps = ItemStamps{Quantity: operation.Stamp, Purchased: operation.Stamp, Position: operation.Stamp}
+		if err := tx.Create(&added).Error; err != nil {
+			return nil, err
+		}
+		tx.Preload("Ingredient").First(&added, added.ID)
+
+		list.Items = append(list.Items, added)
+		return &Event{Type: EventItemAdded, Data: added}, nil
+	}
+
+	if item == nil {
+		var count int64
+		tx.Unscoped().Model(&BuyItem{}).Where("buy_list_id = ? and \"key\" = ?", list.ID, operation.ItemKey).Count(&count)
+		if count > 0 {
+			// item was removed, removes win over concurrent changes
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Item %s does not exists on list", operation.ItemKey)
+	}
+
+	var event Event
+	switch operation.Type {
+	case OperationRemoveItem:
+		removed := *item
+		if err := tx.Delete(&removed).Error; err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items[:index], list.Items[index+1:]...)
+		return &Event{Type: EventItemRemoved, Data: removed}, nil
+	case OperationSetQuantity:
+		if !operation.Stamp.After(item.Stamps.Quantity) {
+			return nil, nil
+		}
+		item.Quantity = operation.Quantity
+		item.Stamps.Quantity = operation.Stamp
+		event.Type = EventItemQuantity
+	case OperationSetPurchased:
+		if !operation.Stamp.After(item.Stamps.Purchased) {
+			return nil, nil
+		}
+		item.Purchased = operation.Purchased
+		item.PurchasedAt = nil
+		if item.Purchased {
+			purchasedAt := time.Now()
+			item.PurchasedAt = &purchasedAt
+		}
+		item.Stamps.Purchased = operation.Stamp
+		event.Type = EventItemUnpurchased
+		if item.Purchased {
+			event.Type = EventItemPurchased
+		}
+	case OperationMoveItem:
+		if !operation.Stamp.After(item.Stamps.Position) {
+			return nil, nil
+		}
+		item.Position = operation.Position
+		item.Stamps.Position = operation.Stamp
+		event.Type = EventItemMoved
+	default:
+		return nil, fmt.Errorf("Unknown operation %s", operation.Type)
+	}
+
+	result := tx.Model(item).Select("Quantity", "Purchased", "PurchasedAt", "Position", "Stamps").Updates(item)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	event.Data = *item
+	return &event, nil
+}
@@ -0,0 +1,410 @@
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Fields of a list on CSV files.
+const (
+	FieldTitle      = "title"
+	FieldIngredient = "ingredient"
+	FieldQuantity   = "quantity"
+	FieldUnit       = "unit"
+	FieldCategory   = "category"
+	FieldPrice      = "price"
+)
+
+var CSVFields = []string{FieldTitle, FieldIngredient, FieldQuantity, FieldUnit, FieldCategory, FieldPrice}
+
+// Max number of rows of an imported file.
+const maxImportRows = 5000
+
+// CSVColumns maps the fields of a list to the header of their column on a
+// CSV file. Fields not mapped use their own name as header.
+type CSVColumns map[string]string
+
+// ParseCSVColumns reads columns mapping from a JSON object like
+// {"ingredient": "Product", "quantity": "Qty"}.
+func ParseCSVColumns(data string) (CSVColumns, error) {
+	columns := CSVColumns{}
+	if strings.TrimSpace(data) == "" {
+		return columns, nil
+	}
+	if err := json.Unmarshal([]byte(data), &columns); err != nil {
+		return nil, errors.New("Invalid columns, must be a JSON object of field to header")
+	}
+	for field := range columns {
+		if !slices.Contains(CSVFields, field) {
+			return nil, fmt.Errorf("Invalid column field %s, must be one of %s", field, strings.Join(CSVFields, ","))
+		}
+	}
+
+	return columns, nil
+}
+
+func (columns CSVColumns) header(field string) string {
+	if header, exists := columns[field]; exists {
+		return header
+	}
+	return field
+}
+
+// RowError is an invalid value of a field on a row of an imported file.
+// Rows are counted from 1, the header is row 1.
+type RowError struct {
+	Row     int
+	Field   string
+	Message string
+}
+
+func (err RowError) Error() string {
+	return fmt.Sprintf("Row %d, %s: %s", err.Row, err.Field, err.Message)
+}
+
+// ImportOptions configure the import of a CSV file. Title is the title of
+// the list when the file has no title column. Prices are recorded at
+// StoreID, required when the file has prices. DryRun validates the file
+// without saving anything.
+type ImportOptions struct {
+	Columns   CSVColumns
+	Delimiter rune
+	Title     string
+	StoreID   uint
+	DryRun    bool
+}
+
+// ImportResult has the lists read from a file, saved unless it was a dry
+// run or the file had Errors. NewIngredients are the ingredients that
+// didn't exist, created by the import.
+type ImportResult struct {
+	DryRun         bool
+	Rows           int
+	Lists          []BuyList
+	NewIngredients []string
+	Errors         []RowError
+}
+
+// ErrInvalidImport is returned when an imported file has invalid rows.
+var ErrInvalidImport = errors.New("File has invalid rows")
+
+type CSVService struct {
+	Database *gorm.DB
+	Events   *EventBus
+}
+
+type importRow struct {
+	row      int
+	title    string
+	item     BuyItem
+	category string
+	price    *float64
+}
+
+// Read the rows of the file, reporting invalid values on result.Errors.
+func readImport(reader io.Reader, options ImportOptions, result *ImportResult) ([]importRow, error) {
+	records := csv.NewReader(reader)
+	records.Comma = options.Delimiter
+	records.TrimLeadingSpace = true
+	records.FieldsPerRecord = -1
+
+	header, err := records.Read()
+	if err == io.EOF {
+		return nil, errors.New("File is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CSV file: %w", err)
+	}
+
+	index := map[string]int{}
+	for field := range options.Columns {
+		index[field] = -1
+	}
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		for _, field := range CSVFields {
+			if strings.EqualFold(name, options.Columns.header(field)) {
+				index[field] = i
+			}
+		}
+	}
+	for field, i := range index {
+		if i == -1 {
+			return nil, fmt.Errorf("Column %s of field %s is not on the file", options.Columns.header(field), field)
+		}
+	}
+	if _, exists := index[FieldIngredient]; !exists {
+		return nil, fmt.Errorf("Column %s of field %s is not on the file", options.Columns.header(FieldIngredient), FieldIngredient)
+	}
+
+	rows := []importRow{}
+	for number := 2; ; number++ {
+		record, err := records.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV file: %w", err)
+		}
+		if number > maxImportRows+1 {
+			return nil, fmt.Errorf("File has more than %d rows", maxImportRows)
+		}
+
+		value := func(field string) string {
+			i, exists := index[field]
+			if !exists || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		if strings.Join(record, "") == "" {
+			continue
+		}
+		result.Rows++
+
+		row := importRow{row: number, title: value(FieldTitle), category: value(FieldCategory)}
+		row.item = BuyItem{Quantity: 1, Unit: value(FieldUnit), Ingredient: Ingredient{Name: value(FieldIngredient)}}
+		if row.title == "" {
+			row.title = options.Title
+		}
+		invalid := func(field string, message string) {
+			result.Errors = append(result.Errors, RowError{Row: number, Field: field, Message: message})
+		}
+
+		if row.item.Ingredient.Name == "" {
+			invalid(FieldIngredient, "ingredient is required")
+		}
+		if quantity := value(FieldQuantity); quantity != "" {
+			parsed, err := strconv.ParseFloat(strings.Replace(quantity, ",", ".", 1), 64)
+			if err != nil || parsed <= 0 || parsed != math.Trunc(parsed) {
+				invalid(FieldQuantity, fmt.Sprintf("%s is not a positive whole number", quantity))
+			}
+			row.item.Quantity = uint(parsed)
+		}
+		if price := value(FieldPrice); price != "" {
+			parsed, err := strconv.ParseFloat(strings.Replace(price, ",", ".", 1), 64)
+			if err != nil || parsed < 0 {
+				invalid(FieldPrice, fmt.Sprintf("%s is not a valid price", price))
+			}
+			row.price = &parsed
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// Import the lists of a CSV file, one for each title, owned by owner.
+// Ingredients are found by name or alias and only created when there is
+// none. Nothing is saved on dry runs or when any row is invalid, in that
+// case it fails with ErrInvalidImport and the result has the errors.
+func (service *CSVService) Import(reader io.Reader, owner string, options ImportOptions) (ImportResult, error) {
+	result := ImportResult{DryRun: options.DryRun, Lists: []BuyList{}, NewIngredients: []string{}, Errors: []RowError{}}
+	if options.Delimiter == 0 {
+		options.Delimiter = ','
+	}
+
+	rows, err := readImport(reader, options, &result)
+	if err != nil {
+		return result, err
+	}
+	if result.Rows == 0 {
+		return result, errors.New("File has no rows")
+	}
+	if options.StoreID == 0 && slices.ContainsFunc(rows, func(row importRow) bool { return row.price != nil }) {
+		return result, errors.New("Prices require the store they were observed at")
+	}
+	if options.StoreID != 0 {
+		if err := service.Database.Where("owner = ?", owner).First(&Store{}, options.StoreID).Error; err != nil {
+			return result, errors.New("Store does not exists")
+		}
+	}
+
+	titles := map[string]int{}
+	for i := range rows {
+		if rows[i].title == "" {
+			result.Errors = append(result.Errors, RowError{Row: rows[i].row, Field: FieldTitle, Message: "title is required"})
+			continue
+		}
+		if _, exists := titles[rows[i].title]; !exists {
+			titles[rows[i].title] = len(result.Lists)
+			result.Lists = append(result.Lists, BuyList{Title: rows[i].title, Owner: owner})
+		}
+	}
+
+	if err := service.resolve(rows, &result); err != nil {
+		return result, err
+	}
+	for _, row := range rows {
+		if row.title != "" {
+			list := &result.Lists[titles[row.title]]
+			list.Items = append(list.Items, row.item)
+		}
+	}
+	if len(result.Errors) > 0 {
+		return result, ErrInvalidImport
+	}
+	if options.DryRun {
+		return result, nil
+	}
+
+	return result, service.save(rows, titles, options, &result)
+}
+
+// Find the ingredients of rows by name, the ones not found are created
+// unless it is a dry run.
+func (service *CSVService) resolve(rows []importRow, result *ImportResult) error {
+	ingredients := IngredientService{Database: service.Database, Events: service.Events}
+	found := map[string]*Ingredient{}
+	for i := range rows {
+		name := rows[i].item.Ingredient.Name
+		if name == "" {
+			continue
+		}
+
+		key := strings.ToLower(name)
+		ingredient, resolved := found[key]
+		if !resolved {
+			var err error
+			if ingredient, err = ingredients.FindByName(name); err != nil {
+				return err
+			}
+			if ingredient == nil {
+				ingredient = &Ingredient{Name: name, Category: rows[i].category}
+				result.NewIngredients = append(result.NewIngredients, name)
+			}
+			found[key] = ingredient
+		}
+		rows[i].item.Ingredient = *ingredient
+		rows[i].item.IngredientID = int(ingredient.ID)
+	}
+
+	return nil
+}
+
+// Save the lists of an import with new ingredients and prices.
+func (service *CSVService) save(rows []importRow, titles map[string]int, options ImportOptions, result *ImportResult) error {
+	created := []Ingredient{}
+	err := service.Database.Transaction(func(tx *gorm.DB) error {
+		ingredients := map[string]Ingredient{}
+		for _, name := range result.NewIngredients {
+			ingredient := Ingredient{Name: name, Version: 1}
+			for _, row := range rows {
+				if strings.EqualFold(row.item.Ingredient.Name, name) && row.category != "" {
+					ingredient.Category = row.category
+					break
+				}
+			}
+			if err := tx.Create(&ingredient).Error; err != nil {
+				return err
+			}
+			ingredients[strings.ToLower(name)] = ingredient
+			created = append(created, ingredient)
+		}
+
+		for i := range result.Lists {
+			list := &result.Lists[i]
+			for j := range list.Items {
+				item := &list.Items[j]
+				item.Position = float64(j + 1)
+				if item.IngredientID == 0 {
+					item.Ingredient = ingredients[strings.ToLower(item.Ingredient.Name)]
+					item.IngredientID = int(item.Ingredient.ID)
+				}
+			}
+			list.Version = 1
+			if err := tx.Create(list).Error; err != nil {
+				return err
+			}
+		}
+
+		// items are on the lists in the order of the rows
+		next := map[string]int{}
+		for _, row := range rows {
+			if row.title == "" {
+				continue
+			}
+			list := &result.Lists[titles[row.title]]
+			item := list.Items[next[row.title]]
+			next[row.title]++
+			if row.price == nil {
+				continue
+			}
+
+			observation := PriceObservation{
+				IngredientID: uint(item.IngredientID),
+				StoreID:      options.StoreID,
+				BuyItemID:    item.ID,
+				UnitPrice:    *row.price,
+				Unit:         item.Unit,
+				ObservedAt:   item.CreatedAt,
+			}
+			if err := tx.Create(&observation).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ingredients := IngredientService{Events: service.Events}
+	for _, ingredient := range created {
+		ingredients.publish(EventIngredientCreated, ingredient)
+	}
+	lists := BuyListService{Events: service.Events}
+	for _, list := range result.Lists {
+		lists.publish(EventBuyListCreated, list, list)
+	}
+
+	return nil
+}
+
+// Export writes the items of the list, with the latest price of each, as a
+// CSV file with the columns of CSVFields.
+func (service *CSVService) Export(list BuyList, columns CSVColumns, delimiter rune, writer io.Writer) error {
+	prices, err := (&PriceService{Database: service.Database}).ItemPrices(list)
+	if err != nil {
+		return err
+	}
+
+	records := csv.NewWriter(writer)
+	if delimiter != 0 {
+		records.Comma = delimiter
+	}
+	header := []string{}
+	for _, field := range CSVFields {
+		header = append(header, columns.header(field))
+	}
+	records.Write(header)
+
+	for _, item := range list.Items {
+		price := ""
+		if value, exists := prices[item.ID]; exists {
+			price = strconv.FormatFloat(value, 'f', -1, 64)
+		}
+		records.Write([]string{
+			list.Title,
+			item.Ingredient.Name,
+			strconv.FormatUint(uint64(item.Quantity), 10),
+			item.Unit,
+			item.Ingredient.Category,
+			price,
+		})
+	}
+
+	records.Flush()
+	return records.Error()
+}
@@ -28,5 +28,23 @@ func GetDatabaseConnection() *gorm.DB {
 	instance.AutoMigrate(&internal.Ingredient{})
 	instance.AutoMigrate(&internal.BuyList{})
 	instance.AutoMigrate(&internal.BuyItem{})
+	instance.AutoMigrate(&internal.Reminder{})
+	instance.AutoMigrate(&internal.UserSettings{})
+	instance.AutoMigrate(&internal.OutboxEmail{})
+	instance.AutoMigrate(&internal.ListShare{})
+	instance.AutoMigrate(&internal.PhoneNumber{})
+	instance.AutoMigrate(&internal.WhatsAppMessage{})
+	instance.AutoMigrate(&internal.Webhook{})
+	instance.AutoMigrate(&internal.WebhookDelivery{})
+	instance.AutoMigrate(&internal.WebhookAttempt{})
+	instance.AutoMigrate(&internal.AppliedMutation{})
+	instance.AutoMigrate(&internal.Store{})
+	instance.AutoMigrate(&internal.Aisle{})
+	instance.AutoMigrate(&internal.PriceObservation{})
+	instance.AutoMigrate(&internal.BudgetAlert{})
+	instance.AutoMigrate(&internal.CalendarToken{})
+	if err := internal.MigrateSearch(instance); err != nil {
+		panic("Failed to create search tables: " + err.Error())
+	}
 	return instance
 }
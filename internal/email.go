@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmlTemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	textTemplate "text/template"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OutboxEmail is an email waiting to be sent. Emails are stored before
+// sending so the ones that failed are retried later instead of being lost.
+type OutboxEmail struct {
+	gorm.Model
+	Kind          string
+	To            string
+	Subject       string
+	Message       []byte
+	Attempts      uint
+	NextAttemptAt time.Time
+	SentAt        *time.Time
+	LastError     string
+}
+
+type emailData struct {
+	Notification
+	ScheduledFor string
+	Groups       []ItemGroup
+}
+
+var emailSubjects = map[string]*textTemplate.Template{
+	NotificationReminder: textTemplate.Must(textTemplate.New("subject").Parse(
+		`Reminder: {{.BuyList.Title}}{{if .ScheduledFor}} on {{.ScheduledFor}}{{end}}`)),
+	NotificationShareInvite: textTemplate.Must(textTemplate.New("subject").Parse(
+		`A copy of a buy list was sent to you: {{.BuyList.Title}}`)),
+}
+
+var emailTextTemplate = textTemplate.Must(textTemplate.New("text").Parse(
+	`{{if eq .Kind "share_invite"}}Here is a copy of the buy list "{{.BuyList.Title}}".
+{{else}}Don't forget your buy list "{{.BuyList.Title}}"{{if .ScheduledFor}} scheduled for {{.ScheduledFor}}{{end}}.
+{{end}}{{range .Groups}}
+{{.Category}}
+{{range .Items}}  [ ] {{.Quantity}} x {{.Ingredient.Name}}
+{{end}}{{end}}`))
+
+var emailHTMLTemplate = htmlTemplate.Must(htmlTemplate.New("html").Parse(
+	`<!DOCTYPE html>
+<html>
+<body>
+{{if eq .Kind "share_invite"}}<p>Here is a copy of the buy list <strong>{{.BuyList.Title}}</strong>.</p>
+{{else}}<p>Don't forget your buy list <strong>{{.BuyList.Title}}</strong>{{if .ScheduledFor}} scheduled for {{.ScheduledFor}}{{end}}.</p>
+{{end}}{{range .Groups}}<h3>{{.Category}}</h3>
+<ul>
+{{range .Items}}<li>&#9744; {{.Quantity}} x {{.Ingredient.Name}}</li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+// EmailNotifier sends notifications as emails through a SMTP server.
+// Notifications are put on an outbox table and sent from there, failed
+// sends are retried with exponential backoff.
+type EmailNotifier struct {
+	Database    *gorm.DB
+	Addr        string
+	Auth        smtp.Auth
+	From        string
+	MaxAttempts uint
+	Backoff     time.Duration
+	// Function used to deliver messages, smtp.SendMail by default
+	SendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// Create an EmailNotifier configured by SMTP_* environment variables.
+func NewEmailNotifier(db *gorm.DB) *EmailNotifier {
+	host := os.Getenv("SMTP_HOST")
+	var auth smtp.Auth
+	if os.Getenv("SMTP_USERNAME") != "" {
+		auth = smtp.PlainAuth("", os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	return &EmailNotifier{
+		Database: db,
+		Addr:     net.JoinHostPort(host, os.Getenv("SMTP_PORT")),
+		Auth:     auth,
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
+
+func (notifier *EmailNotifier) Notify(ctx context.Context, notification Notification) error {
+	to := notification.Recipient
+	if to == "" {
+		service := UserSettingsService{Database: notifier.Database}
+		settings, err := service.Get(notification.Owner)
+		if err != nil {
+			return err
+		}
+		to = settings.Email
+	}
+
+	if to == "" {
+		// user didn't configure an email to be notified
+		return nil
+	}
+
+	email, err := notifier.render(notification, to)
+	if err != nil {
+		return err
+	}
+
+	email.NextAttemptAt = time.Now()
+	result := notifier.Database.Create(&email)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	// first attempt is done right away, if it fails email stays on outbox
+	// to be sent by FlushOutbox
+	if err := notifier.deliver(&email, time.Now()); err != nil {
+		log.Printf("Email %d to %s will be retried: %v", email.ID, email.To, err)
+	}
+
+	return nil
+}
+
+func (notifier *EmailNotifier) Channel() string {
+	return "email"
+}
+
+// Run sends pending emails of the outbox every interval until ctx is done.
+func (notifier *EmailNotifier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := notifier.FlushOutbox(time.Now()); err != nil {
+			log.Printf("Error sending outbox emails: %v", err)
+		}
+	}
+}
+
+// FlushOutbox tries to send every pending email whose next attempt is due.
+// Returns how many emails were sent.
+func (notifier *EmailNotifier) FlushOutbox(now time.Time) (int, error) {
+	emails := []OutboxEmail{}
+	result := notifier.Database.
+		Where("sent_at is null and next_attempt_at <= ? and attempts < ?", now, notifier.maxAttempts()).
+		Order("next_attempt_at").
+		Find(&emails)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	sent := 0
+	for i := range emails {
+		err := notifier.deliver(&emails[i], now)
+		if err == nil {
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+func (notifier *EmailNotifier) maxAttempts() uint {
+	if notifier.MaxAttempts == 0 {
+		return 8
+	}
+	return notifier.MaxAttempts
+}
+
+// Send the email and store the result of the attempt.
+func (notifier *EmailNotifier) deliver(email *OutboxEmail, now time.Time) error {
+	sendMail := notifier.SendMail
+	if sendMail == nil {
+		sendMail = smtp.SendMail
+	}
+
+	email.Attempts++
+	err := sendMail(notifier.Addr, notifier.Auth, notifier.From, []string{email.To}, email.Message)
+	if err != nil {
+		backoff := notifier.Backoff
+		if backoff == 0 {
+			backoff = time.Minute
+		}
+		email.LastError = err.Error()
+		email.NextAttemptAt = now.Add(backoff << (email.Attempts - 1))
+	} else {
+		sentAt := now
+		email.SentAt = &sentAt
+		email.LastError = ""
+	}
+
+	result := notifier.Database.Model(email).Select("Attempts", "NextAttemptAt", "SentAt", "LastError").Updates(email)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return err
+}
+
+// Render the notification as a multipart MIME message with text and html versions.
+func (notifier *EmailNotifier) render(notification Notification, to string) (OutboxEmail, error) {
+	subjectTemplate, exists := emailSubjects[notification.Kind]
+	if !exists {
+		return OutboxEmail{}, fmt.Errorf("No email template for %s notification", notification.Kind)
+	}
+
+	data := emailData{
+		Notification: notification,
+		Groups:       GroupItemsByCategory(notification.BuyList.Items),
+	}
+	if notification.BuyList.ScheduledFor != nil {
+		data.ScheduledFor = notification.BuyList.ScheduledFor.Format("02/01/2006 15:04")
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := subjectTemplate.Execute(&subject, data); err != nil {
+		return OutboxEmail{}, err
+	}
+	if err := emailTextTemplate.Execute(&text, data); err != nil {
+		return OutboxEmail{}, err
+	}
+	if err := emailHTMLTemplate.Execute(&html, data); err != nil {
+		return OutboxEmail{}, err
+	}
+
+	var message bytes.Buffer
+	body := multipart.NewWriter(&message)
+	headers := []string{
+		"From: " + notifier.From,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject.String()),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + body.Boundary(),
+	}
+	message.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	parts := []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	}
+	for _, part := range parts {
+		writer, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return OutboxEmail{}, err
+		}
+		writer.Write(part.content)
+	}
+	body.Close()
+
+	return OutboxEmail{
+		Kind:    notification.Kind,
+		To:      to,
+		Subject: subject.String(),
+		Message: message.Bytes(),
+	}, nil
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	EventBuyListCreated     = "buylist.created"
+	EventBuyListUpdated     = "buylist.updated"
+	EventBuyListDeleted     = "buylist.deleted"
+	EventBuyListCompleted   = "buylist.completed"
+	EventBuyListRestored    = "buylist.restored"
+	EventItemAdded          = "item.added"
+	EventItemRemoved        = "item.removed"
+	EventItemQuantity       = "item.quantity_changed"
+	EventItemPurchased      = "item.purchased"
+	EventItemUnpurchased    = "item.unpurchased"
+	EventItemMoved          = "item.moved"
+	EventIngredientCreated  = "ingredient.created"
+	EventIngredientUpdated  = "ingredient.updated"
+	EventIngredientDeleted  = "ingredient.deleted"
+	EventIngredientRestored = "ingredient.restored"
+	EventBudgetThreshold    = "budget.threshold_crossed"
+)
+
+var EventTypes = []string{
+	EventBuyListCreated,
+	EventBuyListUpdated,
+	EventBuyListDeleted,
+	EventBuyListCompleted,
+	EventBuyListRestored,
+	EventItemAdded,
+	EventItemRemoved,
+	EventItemQuantity,
+	EventItemPurchased,
+	EventItemUnpurchased,
+	EventItemMoved,
+	EventIngredientCreated,
+	EventIngredientUpdated,
+	EventIngredientDeleted,
+	EventIngredientRestored,
+	EventBudgetThreshold,
+}
+
+// Event is something that happened to a list or ingredient, published by
+// the services. Owner is the user that owns the list, ingredient events
+// have no owner since ingredients are shared by all users.
+type Event struct {
+	ID         string
+	Type       string
+	OccurredAt time.Time
+	Owner      string
+	BuyListID  uint
+	Data       interface{}
+}
+
+// EventBus delivers events published by services to its subscribers.
+// A nil EventBus discards the events.
+type EventBus struct {
+	lock        sync.RWMutex
+	subscribers []func(Event)
+}
+
+func (bus *EventBus) Subscribe(subscriber func(Event)) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.subscribers = append(bus.subscribers, subscriber)
+}
+
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+
+	if event.ID == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		event.ID = hex.EncodeToString(id)
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now()
+	}
+
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+	for _, subscriber := range bus.subscribers {
+		subscriber(event)
+	}
+}
@@ -0,0 +1,380 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Max length and nesting of filter expressions, so a request can't make the
+// parser or the database do unbounded work.
+const (
+	maxFilterLength = 1000
+	maxFilterDepth  = 20
+)
+
+// Conditions on the items of a list, used by filters to select the lists
+// with some ingredient or category.
+const (
+	itemsOfList = "select 1 from buy_items where buy_items.buy_list_id = buy_lists.id and buy_items.deleted_at is null"
+
+	itemsWithIngredient = "select 1 from buy_items join ingredients on ingredients.id = buy_items.ingredient_id " +
+		"where buy_items.buy_list_id = buy_lists.id and buy_items.deleted_at is null"
+
+	hasIngredientID   = "exists (" + itemsOfList + " and buy_items.ingredient_id = ?)"
+	hasIngredientName = "exists (" + itemsWithIngredient + " and lower(ingredients.name) = lower(?))"
+	hasCategory       = "exists (" + itemsWithIngredient + " and lower(ingredients.category) = lower(?))"
+	isCompleted       = "(exists (" + itemsOfList + ") and not exists (" + itemsOfList + " and not buy_items.purchased))"
+)
+
+// Parse a date on ISO 8601: a date with time and zone, a date with time on
+// local zone or only the date.
+func ParseISODate(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if date, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			// dates are stored on local time
+			return date.Local(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid date %s, must be on ISO 8601 format", value)
+}
+
+// FilterError is an error on a filter expression at the Position character.
+type FilterError struct {
+	Position int
+	Message  string
+}
+
+func (err *FilterError) Error() string {
+	return fmt.Sprintf("Invalid filter at position %d: %s", err.Position, err.Message)
+}
+
+// FilterExpression is a boolean expression selecting buy lists, e.g.
+//
+//	title ~ "party" and (has(ingredient: "milk") or not completed = true)
+//
+// Comparisons are on the fields title, owner (=, != and ~ that matches
+// part of the text), created_at, updated_at, scheduled_for (=, !=, <, <=, >,
+// >= with ISO 8601 dates) and completed (= and != with true or false).
+// has(ingredient: "name"), has(ingredient: ID) and has(category: "name")
+// select lists with an item of the ingredient or category. Conditions are
+// combined with and, or, not and parentheses.
+//
+// Fields and operators are checked against fixed lists and values are always
+// passed as query arguments, so expressions can't inject SQL.
+type FilterExpression struct {
+	sql  string
+	args []interface{}
+}
+
+func ParseFilter(expression string) (*FilterExpression, error) {
+	if len(expression) > maxFilterLength {
+		return nil, &FilterError{Position: maxFilterLength, Message: "expression is too long"}
+	}
+
+	tokens, err := lexFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens}
+	filter := &FilterExpression{}
+	filter.sql, err = parser.parseOr(filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != tokenEnd {
+		return nil, &FilterError{Position: token.position, Message: fmt.Sprintf("unexpected %q", token.text)}
+	}
+
+	return filter, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenOpen
+	tokenClose
+	tokenColon
+)
+
+type filterToken struct {
+	kind     tokenKind
+	text     string
+	position int
+}
+
+func lexFilter(expression string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		char := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(char):
+			i++
+			continue
+		case char == '(':
+			tokens = append(tokens, filterToken{tokenOpen, "(", start})
+			i++
+		case char == ')':
+			tokens = append(tokens, filterToken{tokenClose, ")", start})
+			i++
+		case char == ':':
+			tokens = append(tokens, filterToken{tokenColon, ":", start})
+			i++
+		case char == '"':
+			var text strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				text.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, &FilterError{Position: start, Message: "unterminated string"}
+			}
+			i++
+			tokens = append(tokens, filterToken{tokenString, text.String(), start})
+		case strings.ContainsRune("=!~<>", char):
+			i++
+			if i < len(runes) && runes[i] == '=' && char != '=' && char != '~' {
+				i++
+			}
+			operator := string(runes[start:i])
+			if operator == "!" {
+				return nil, &FilterError{Position: start, Message: "unknown operator !"}
+			}
+			tokens = append(tokens, filterToken{tokenOperator, operator, start})
+		case unicode.IsDigit(char):
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenNumber, string(runes[start:i]), start})
+		case unicode.IsLetter(char) || char == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenIdent, strings.ToLower(string(runes[start:i])), start})
+		default:
+			return nil, &FilterError{Position: start, Message: fmt.Sprintf("unexpected character %q", char)}
+		}
+	}
+
+	return append(tokens, filterToken{tokenEnd, "end of filter", len(runes)}), nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+func (parser *filterParser) peek() filterToken {
+	return parser.tokens[parser.next]
+}
+
+func (parser *filterParser) take() filterToken {
+	token := parser.tokens[parser.next]
+	if token.kind != tokenEnd {
+		parser.next++
+	}
+	return token
+}
+
+func (parser *filterParser) expect(kind tokenKind, description string) (filterToken, error) {
+	token := parser.take()
+	if token.kind != kind {
+		return token, &FilterError{Position: token.position, Message: fmt.Sprintf("expected %s, got %q", description, token.text)}
+	}
+	return token, nil
+}
+
+func (parser *filterParser) parseOr(filter *FilterExpression, depth int) (string, error) {
+	conditions := []string{}
+	for {
+		condition, err := parser.parseAnd(filter, depth)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+
+		if token := parser.peek(); token.kind != tokenIdent || token.text != "or" {
+			break
+		}
+		parser.take()
+	}
+
+	return "(" + strings.Join(conditions, " or ") + ")", nil
+}
+
+func (parser *filterParser) parseAnd(filter *FilterExpression, depth int) (string, error) {
+	conditions := []string{}
+	for {
+		condition, err := parser.parseUnary(filter, depth)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+
+		if token := parser.peek(); token.kind != tokenIdent || token.text != "and" {
+			break
+		}
+		parser.take()
+	}
+
+	return "(" + strings.Join(conditions, " and ") + ")", nil
+}
+
+func (parser *filterParser) parseUnary(filter *FilterExpression, depth int) (string, error) {
+	token := parser.peek()
+	if depth > maxFilterDepth {
+		return "", &FilterError{Position: token.position, Message: "expression is nested too deep"}
+	}
+
+	switch {
+	case token.kind == tokenIdent && token.text == "not":
+		parser.take()
+		condition, err := parser.parseUnary(filter, depth+1)
+		return "not " + condition, err
+	case token.kind == tokenOpen:
+		parser.take()
+		condition, err := parser.parseOr(filter, depth+1)
+		if err != nil {
+			return "", err
+		}
+		_, err = parser.expect(tokenClose, ")")
+		return condition, err
+	case token.kind == tokenIdent && token.text == "has":
+		return parser.parseHas(filter)
+	case token.kind == tokenIdent:
+		return parser.parseComparison(filter)
+	}
+
+	return "", &FilterError{Position: token.position, Message: fmt.Sprintf("expected condition, got %q", token.text)}
+}
+
+// has(ingredient: "milk"), has(ingredient: 12) or has(category: "dairy")
+func (parser *filterParser) parseHas(filter *FilterExpression) (string, error) {
+	parser.take()
+	if _, err := parser.expect(tokenOpen, "("); err != nil {
+		return "", err
+	}
+	key, err := parser.expect(tokenIdent, "ingredient or category")
+	if err != nil {
+		return "", err
+	}
+	if _, err := parser.expect(tokenColon, ":"); err != nil {
+		return "", err
+	}
+	value := parser.take()
+
+	var condition string
+	switch {
+	case key.text == "ingredient" && value.kind == tokenNumber:
+		id, err := strconv.ParseUint(value.text, 10, 32)
+		if err != nil {
+			return "", &FilterError{Position: value.position, Message: "invalid ingredient identifier"}
+		}
+		condition = hasIngredientID
+		filter.args = append(filter.args, id)
+	case key.text == "ingredient" && value.kind == tokenString:
+		condition = hasIngredientName
+		filter.args = append(filter.args, value.text)
+	case key.text == "category" && value.kind == tokenString:
+		condition = hasCategory
+		filter.args = append(filter.args, value.text)
+	case key.text != "ingredient" && key.text != "category":
+		return "", &FilterError{Position: key.position, Message: fmt.Sprintf("expected ingredient or category, got %q", key.text)}
+	default:
+		return "", &FilterError{Position: value.position, Message: fmt.Sprintf("invalid value %q for %s", value.text, key.text)}
+	}
+
+	_, err = parser.expect(tokenClose, ")")
+	return condition, err
+}
+
+var filterFields = map[string]string{
+	"title":         "text",
+	"owner":         "text",
+	"created_at":    "date",
+	"updated_at":    "date",
+	"scheduled_for": "date",
+	"completed":     "bool",
+}
+
+var filterOperators = map[string][]string{
+	"text": {"=", "!=", "~"},
+	"date": {"=", "!=", "<", "<=", ">", ">="},
+	"bool": {"=", "!="},
+}
+
+func (parser *filterParser) parseComparison(filter *FilterExpression) (string, error) {
+	field := parser.take()
+	kind, exists := filterFields[field.text]
+	if !exists {
+		return "", &FilterError{Position: field.position, Message: fmt.Sprintf("unknown field %q", field.text)}
+	}
+
+	operator, err := parser.expect(tokenOperator, "operator")
+	if err != nil {
+		return "", err
+	}
+	valid := false
+	for _, allowed := range filterOperators[kind] {
+		valid = valid || allowed == operator.text
+	}
+	if !valid {
+		return "", &FilterError{Position: operator.position, Message: fmt.Sprintf("operator %s can't be used on %s", operator.text, field.text)}
+	}
+
+	value := parser.take()
+	switch kind {
+	case "text":
+		if value.kind != tokenString {
+			return "", &FilterError{Position: value.position, Message: fmt.Sprintf("expected string, got %q", value.text)}
+		}
+		if operator.text == "~" {
+			filter.args = append(filter.args, "%"+escapeLike(value.text)+"%")
+			return fmt.Sprintf("buy_lists.%s like ? escape '\\'", field.text), nil
+		}
+		filter.args = append(filter.args, value.text)
+	case "date":
+		if value.kind != tokenString {
+			return "", &FilterError{Position: value.position, Message: fmt.Sprintf("expected date string, got %q", value.text)}
+		}
+		date, err := ParseISODate(value.text)
+		if err != nil {
+			return "", &FilterError{Position: value.position, Message: err.Error()}
+		}
+		filter.args = append(filter.args, date)
+	case "bool":
+		if value.kind != tokenIdent || (value.text != "true" && value.text != "false") {
+			return "", &FilterError{Position: value.position, Message: fmt.Sprintf("expected true or false, got %q", value.text)}
+		}
+		completed := (value.text == "true") == (operator.text == "=")
+		if completed {
+			return isCompleted, nil
+		}
+		return "not " + isCompleted, nil
+	}
+
+	operatorSQL := operator.text
+	if operatorSQL == "!=" {
+		operatorSQL = "<>"
+	}
+	return fmt.Sprintf("buy_lists.%s %s ?", field.text, operatorSQL), nil
+}
+
+// Escape the wildcards of a like pattern.
+func escapeLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// ListEvent is an event of a buy list numbered in the order it was
+// published on the list. Seq is used by clients to resume a stream.
+type ListEvent struct {
+	Seq uint64
+	Event
+}
+
+// ListHub keeps the latest events of each buy list in memory and forwards
+// new ones to the clients subscribed to the list. History of deleted lists
+// is dropped, and the one of lists without subscribers and events for
+// maxAge, so clients resuming after that reload the list.
+type ListHub struct {
+	lock        sync.Mutex
+	historySize int
+	maxAge      time.Duration
+	swept       time.Time
+	seq         map[uint]uint64
+	history     map[uint][]ListEvent
+	published   map[uint]time.Time
+	subscribers map[uint]map[chan ListEvent]struct{}
+}
+
+// Create a hub that keeps up to historySize events of each list for maxAge.
+func NewListHub(historySize int, maxAge time.Duration) *ListHub {
+	return &ListHub{
+		historySize: historySize,
+		maxAge:      maxAge,
+		seq:         map[uint]uint64{},
+		history:     map[uint][]ListEvent{},
+		published:   map[uint]time.Time{},
+		subscribers: map[uint]map[chan ListEvent]struct{}{},
+	}
+}
+
+// Publish the event to the subscribers of its list. Events that don't
+// belong to a list are ignored.
+func (hub *ListHub) Publish(event Event) {
+	if event.BuyListID == 0 {
+		return
+	}
+
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	hub.seq[event.BuyListID]++
+	listEvent := ListEvent{Seq: hub.seq[event.BuyListID], Event: event}
+
+	history := append(hub.history[event.BuyListID], listEvent)
+	if len(history) > hub.historySize {
+		history = history[len(history)-hub.historySize:]
+	}
+	hub.history[event.BuyListID] = history
+	hub.published[event.BuyListID] = event.OccurredAt
+
+	for subscriber := range hub.subscribers[event.BuyListID] {
+		select {
+		case subscriber <- listEvent:
+		default:
+			// slow client, it will notice the gap on Seq and resume the stream
+		}
+	}
+
+	if event.Type == EventBuyListDeleted {
+		hub.forget(event.BuyListID)
+	}
+	if event.OccurredAt.Sub(hub.swept) >= hub.maxAge {
+		hub.expire(event.OccurredAt)
+	}
+}
+
+// Drop the history of the lists without subscribers and events since maxAge.
+func (hub *ListHub) expire(now time.Time) {
+	hub.swept = now
+	for listID, publishedAt := range hub.published {
+		if now.Sub(publishedAt) > hub.maxAge && len(hub.subscribers[listID]) == 0 {
+			hub.forget(listID)
+		}
+	}
+}
+
+func (hub *ListHub) forget(listID uint) {
+	delete(hub.seq, listID)
+	delete(hub.history, listID)
+	delete(hub.published, listID)
+}
+
+// Subscribe to the events of a list published after the lastSeq event.
+// Returns the events already published after lastSeq and the channel of new ones.
+// Complete is false when some events after lastSeq are not on memory anymore,
+// so the client must reload the list. Cancel must be called to stop receiving.
+func (hub *ListHub) Subscribe(listID uint, lastSeq uint64) (missed []ListEvent, complete bool, events <-chan ListEvent, cancel func()) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	complete = true
+	history := hub.history[listID]
+	if lastSeq > hub.seq[listID] {
+		// sequence is from before a restart
+		complete = false
+	} else if len(history) > 0 && history[0].Seq > lastSeq+1 {
+		complete = false
+	}
+
+	for _, event := range history {
+		if event.Seq > lastSeq {
+			missed = append(missed, event)
+		}
+	}
+
+	events, cancel = hub.listen(listID)
+	return missed, complete, events, cancel
+}
+
+// Listen to the new events of a list. Cancel must be called to stop receiving.
+func (hub *ListHub) Listen(listID uint) (events <-chan ListEvent, cancel func()) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	return hub.listen(listID)
+}
+
+func (hub *ListHub) listen(listID uint) (<-chan ListEvent, func()) {
+	channel := make(chan ListEvent, 32)
+	if hub.subscribers[listID] == nil {
+		hub.subscribers[listID] = map[chan ListEvent]struct{}{}
+	}
+	hub.subscribers[listID][channel] = struct{}{}
+
+	cancel := func() {
+		hub.lock.Lock()
+		defer hub.lock.Unlock()
+		delete(hub.subscribers[listID], channel)
+		if len(hub.subscribers[listID]) == 0 {
+			delete(hub.subscribers, listID)
+		}
+	}
+
+	return channel, cancel
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"errors"
+	"strings"
 
 	"gorm.io/gorm"
 )
@@ -9,19 +10,35 @@ import (
 type Ingredient struct {
 	gorm.Model
 	Name       string
-	OriginType string // animal, plant, condiment, spice, chemical
+	OriginType string   // animal, plant, condiment, spice, chemical
+	Category   string   // section of the market: bakery, dairy, frozen...
+	Aliases    []string `gorm:"serializer:json"`    // other names the ingredient is known by
+	Version    uint     `gorm:"not null;default:1"` // increased on every change
+	DeletedBy  string   `json:"-"`                  // user that deleted it, the only one that can restore or purge it
 }
 
 type IngredientService struct {
 	Database *gorm.DB
+	Events   *EventBus
 }
 
-func (service *IngredientService) Create(name string, originType string) (Ingredient, error) {
-	ingredient := Ingredient{Name: name, OriginType: originType}
+func (service *IngredientService) publish(eventType string, ingredient Ingredient) {
+	service.Events.Publish(Event{Type: eventType, Data: ingredient})
+}
+
+func (service *IngredientService) Create(ingredient Ingredient) (Ingredient, error) {
+	ingredient.Version = 1
 	result := service.Database.Create(&ingredient)
+	if result.Error == nil {
+		service.publish(EventIngredientCreated, ingredient)
+	}
+
 	return ingredient, result.Error
 }
 
+// Update the ingredient when its stored version is ingredient.Version,
+// otherwise fails with ErrVersionConflict. Version 0 updates whatever is stored.
+// Creation and deletion are kept as stored.
 func (service *IngredientService) Update(ingredient Ingredient, ID uint) (Ingredient, error) {
 	var findIngredient Ingredient
 	service.Database.First(&findIngredient, ID)
@@ -34,13 +51,30 @@ func (service *IngredientService) Update(ingredient Ingredient, ID uint) (Ingred
 	if err != nil {
 		return ingredient, err
 	}
+	ingredient.ID = findIngredient.ID
+	ingredient.CreatedAt = findIngredient.CreatedAt
+	ingredient.DeletedAt = findIngredient.DeletedAt
+	ingredient.DeletedBy = findIngredient.DeletedBy
+
+	err = service.Database.Transaction(func(tx *gorm.DB) error {
+		version, err := swapVersion(tx, &Ingredient{}, uint64(ID), ingredient.Version)
+		if err != nil {
+			return err
+		}
+		ingredient.Version = version
+
+		return tx.Save(&ingredient).Error
+	})
+	if err == nil {
+		service.publish(EventIngredientUpdated, ingredient)
+	}
 
-	result := service.Database.Save(&ingredient)
-
-	return ingredient, result.Error
+	return ingredient, err
 }
 
-func (service *IngredientService) Delete(ID uint) (Ingredient, error) {
+// Delete the ingredient when its stored version is version, version 0
+// deletes whatever is stored.
+func (service *IngredientService) Delete(ID uint, version uint, userID string) (Ingredient, error) {
 	var findIngredient Ingredient
 	service.Database.First(&findIngredient, ID)
 
@@ -53,9 +87,57 @@ func (service *IngredientService) Delete(ID uint) (Ingredient, error) {
 		return findIngredient, err
 	}
 
-	result := service.Database.Delete(&findIngredient)
+	err = service.Database.Transaction(func(tx *gorm.DB) error {
+		version, err := swapVersion(tx, &Ingredient{}, uint64(ID), version)
+		if err != nil {
+			return err
+		}
+		findIngredient.Version = version
+		findIngredient.DeletedBy = userID
+
+		if err := tx.Model(&findIngredient).Update("deleted_by", userID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&findIngredient).Error
+	})
+	if err == nil {
+		service.publish(EventIngredientDeleted, findIngredient)
+	}
+
+	return findIngredient, err
+}
 
-	return findIngredient, result.Error
+func (service *IngredientService) Get(ID uint) (Ingredient, error) {
+	var ingredient Ingredient
+	result := service.Database.First(&ingredient, ID)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return ingredient, errors.New("Ingredient does not exists")
+	}
+
+	return ingredient, result.Error
+}
+
+// FindByName finds the ingredient with the name, or an alias, equal to name
+// ignoring case. Returns nil when there is none.
+func (service *IngredientService) FindByName(name string) (*Ingredient, error) {
+	name = strings.TrimSpace(name)
+	var ingredients []Ingredient
+	result := service.Database.
+		Where("lower(name) = lower(?)", name).
+		Or("exists (select 1 from json_each(ingredients.aliases) where lower(json_each.value) = lower(?))", name).
+		Order("id").
+		Find(&ingredients)
+	if result.Error != nil || len(ingredients) == 0 {
+		return nil, result.Error
+	}
+
+	// the name is a better match than an alias
+	for i := range ingredients {
+		if strings.EqualFold(ingredients[i].Name, name) {
+			return &ingredients[i], nil
+		}
+	}
+	return &ingredients[0], nil
 }
 
 func (service *IngredientService) Find() ([]Ingredient, error) {
@@ -65,18 +147,37 @@ func (service *IngredientService) Find() ([]Ingredient, error) {
 	return findIngredient, result.Error
 }
 
+// IngredientFilter selects ingredients with name and origin type similar to
+// Name and OriginType. Empty fields are not used.
+type IngredientFilter struct {
+	Name       string
+	OriginType string
+}
+
+func (filter IngredientFilter) apply(query *gorm.DB) *gorm.DB {
+	if filter.Name != "" {
+		query = query.Where("name like ?", "%"+filter.Name+"%")
+	}
+	if filter.OriginType != "" {
+		query = query.Where("origin_type like ?", "%"+filter.OriginType+"%")
+	}
+
+	return query
+}
+
 // Search ingredients with a name (or) and originType that is similar to param name provided.
 // If any param is an empty string "" it will not be used.
 func (service *IngredientService) FindByParams(name string, originType string) ([]Ingredient, error) {
 	findIngredient := []Ingredient{}
 	query := service.Database.Model(&Ingredient{})
-	if name != "" {
-		query = query.Where("name like ?", "%"+name+"%")
-	}
-	if originType != "" {
-		query = query.Where("origin_type like ?", "%"+originType+"%")
-	}
+	query = IngredientFilter{Name: name, OriginType: originType}.apply(query)
 	result := query.Find(&findIngredient)
 
 	return findIngredient, result.Error
 }
+
+// Find a page of the ingredients selected by filter.
+func (service *IngredientService) FindPage(filter IngredientFilter, page Page) ([]Ingredient, PageResult, error) {
+	query := filter.apply(service.Database.Model(&Ingredient{}))
+	return paginate[Ingredient](query, "ingredients", page, nil)
+}
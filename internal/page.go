@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Fields collections can be sorted by.
+var (
+	BuyListSortFields    = []string{"id", "title", "created_at", "updated_at"}
+	IngredientSortFields = []string{"id", "name", "origin_type", "category", "created_at", "updated_at"}
+)
+
+// ErrInvalidCursor is returned when the page cursor wasn't created by a
+// previous page with the same sort.
+var ErrInvalidCursor = errors.New("Invalid page cursor")
+
+type Sort struct {
+	Field      string
+	Descending bool
+}
+
+// Page selects the rows of a collection sorted by Sort that come after the
+// row of Cursor. Limit 0 returns every row.
+type Page struct {
+	Limit  int
+	Cursor string
+	Sort   []Sort
+}
+
+// PageResult has the total of rows of the collection and the cursor of the
+// next page, empty on the last page.
+type PageResult struct {
+	Total int64
+	Next  string
+}
+
+// Parse a comma separated list of fields, prefixed by - when sorted on
+// descending order, e.g. "-created_at,title".
+func ParseSort(sort string, fields []string) ([]Sort, error) {
+	sorts := []Sort{}
+	for _, field := range strings.Split(sort, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		descending := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(strings.TrimPrefix(field, "-"), "+")
+		valid := false
+		for _, sortField := range fields {
+			valid = valid || sortField == field
+		}
+		if !valid {
+			return nil, fmt.Errorf("Invalid sort field %s, must be one of %s", field, strings.Join(fields, ","))
+		}
+		sorts = append(sorts, Sort{Field: field, Descending: descending})
+	}
+
+	return sorts, nil
+}
+
+// Name of the struct field of a column, e.g. created_at is CreatedAt.
+func structField(column string) string {
+	name := ""
+	for _, part := range strings.Split(column, "_") {
+		if part == "id" {
+			name += "ID"
+		} else if part != "" {
+			name += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+
+	return name
+}
+
+// Read the rows of query on page. Rows are sorted by the page fields and then
+// by id, the cursor has the values of these fields on the last row read so
+// the next page starts after it even when rows are added or removed.
+// Preload is applied only when reading the rows, not when counting them.
+func paginate[T any](query *gorm.DB, table string, page Page, preload func(*gorm.DB) *gorm.DB) ([]T, PageResult, error) {
+	rows := []T{}
+	var result PageResult
+	if err := query.Session(&gorm.Session{}).Count(&result.Total).Error; err != nil {
+		return rows, result, err
+	}
+
+	sorts := page.Sort
+	hasID := false
+	for _, sort := range sorts {
+		hasID = hasID || sort.Field == "id"
+	}
+	if !hasID {
+		sorts = append(append([]Sort{}, sorts...), Sort{Field: "id"})
+	}
+
+	query = query.Session(&gorm.Session{})
+	for _, sort := range sorts {
+		order := table + "." + sort.Field
+		if sort.Descending {
+			order += " desc"
+		}
+		query = query.Order(order)
+	}
+
+	if page.Cursor != "" {
+		values, err := decodeCursor[T](page.Cursor, sorts)
+		if err != nil {
+			return rows, result, err
+		}
+		condition, args := afterCursor(table, sorts, values)
+		query = query.Where(condition, args...)
+	}
+
+	if page.Limit > 0 {
+		query = query.Limit(page.Limit + 1)
+	}
+	if preload != nil {
+		query = preload(query)
+	}
+	if err := query.Find(&rows).Error; err != nil {
+		return rows, result, err
+	}
+
+	if page.Limit > 0 && len(rows) > page.Limit {
+		rows = rows[:page.Limit]
+		next, err := encodeCursor(rows[len(rows)-1], sorts)
+		if err != nil {
+			return rows, result, err
+		}
+		result.Next = next
+	}
+
+	return rows, result, nil
+}
+
+// Condition of the rows after the cursor values on sort order: for each
+// field, the rows equal on the previous fields and after on the field.
+func afterCursor(table string, sorts []Sort, values []interface{}) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+	for i, sort := range sorts {
+		parts := []string{}
+		for j := 0; j < i; j++ {
+			parts = append(parts, fmt.Sprintf("%s.%s = ?", table, sorts[j].Field))
+			args = append(args, values[j])
+		}
+		operator := ">"
+		if sort.Descending {
+			operator = "<"
+		}
+		parts = append(parts, fmt.Sprintf("%s.%s %s ?", table, sort.Field, operator))
+		args = append(args, values[i])
+		conditions = append(conditions, "("+strings.Join(parts, " and ")+")")
+	}
+
+	return "(" + strings.Join(conditions, " or ") + ")", args
+}
+
+// Cursor has the fields the page was sorted by and their values on the last
+// row of the page.
+type pageCursor struct {
+	Fields []string
+	Values []json.RawMessage
+}
+
+func sortFields(sorts []Sort) []string {
+	fields := make([]string, len(sorts))
+	for i, sort := range sorts {
+		fields[i] = sort.Field
+		if sort.Descending {
+			fields[i] = "-" + sort.Field
+		}
+	}
+
+	return fields
+}
+
+func encodeCursor[T any](row T, sorts []Sort) (string, error) {
+	value := reflect.ValueOf(row)
+	cursor := pageCursor{Fields: sortFields(sorts), Values: make([]json.RawMessage, len(sorts))}
+	for i, sort := range sorts {
+		fieldValue, err := json.Marshal(value.FieldByName(structField(sort.Field)).Interface())
+		if err != nil {
+			return "", err
+		}
+		cursor.Values[i] = fieldValue
+	}
+
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor[T any](encoded string, sorts []Sort) ([]interface{}, error) {
+	invalid := ErrInvalidCursor
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, invalid
+	}
+
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || len(cursor.Values) != len(sorts) {
+		return nil, invalid
+	}
+	if strings.Join(cursor.Fields, ",") != strings.Join(sortFields(sorts), ",") {
+		return nil, fmt.Errorf("%w, it was created with another sort", ErrInvalidCursor)
+	}
+
+	rowType := reflect.TypeOf(*new(T))
+	values := make([]interface{}, len(sorts))
+	for i, sort := range sorts {
+		field, exists := rowType.FieldByName(structField(sort.Field))
+		if !exists {
+			return nil, invalid
+		}
+		value := reflect.New(field.Type)
+		if err := json.Unmarshal(cursor.Values[i], value.Interface()); err != nil {
+			return nil, invalid
+		}
+		values[i] = value.Elem().Interface()
+		if at, isTime := values[i].(time.Time); isTime {
+			// dates are stored on local time
+			values[i] = at.Local()
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,437 @@
+// Package patch applies partial updates to JSON documents, as JSON Merge
+// Patch (RFC 7396) or JSON Patch (RFC 6902).
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// Error of a patch that is invalid or can't be applied. Operation is the index
+// of the failed JSON Patch operation, -1 when the error isn't of an operation,
+// and Path is the JSON pointer where it failed.
+type Error struct {
+	Operation int
+	Path      string
+	Message   string
+}
+
+func (err *Error) Error() string {
+	if err.Operation >= 0 {
+		return fmt.Sprintf("operation %d on %q: %s", err.Operation, err.Path, err.Message)
+	}
+	return fmt.Sprintf("%q: %s", err.Path, err.Message)
+}
+
+// Patch is a change to apply on a JSON document.
+type Patch interface {
+	Apply(document []byte) ([]byte, error)
+}
+
+// Parse a patch of the content type passed.
+func Parse(contentType string, data []byte) (Patch, error) {
+	switch contentType {
+	case MergePatchType:
+		return ParseMergePatch(data)
+	case JSONPatchType:
+		return ParseJSONPatch(data)
+	}
+
+	return nil, fmt.Errorf("Unsupported patch type %s", contentType)
+}
+
+func decode(data []byte) (interface{}, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&value); err != nil {
+		return nil, &Error{Operation: -1, Path: "", Message: "invalid JSON: " + err.Error()}
+	}
+	if decoder.More() {
+		return nil, &Error{Operation: -1, Path: "", Message: "invalid JSON: data after the document"}
+	}
+
+	return value, nil
+}
+
+// Unmarshal the patched document into v. Values of the wrong type are
+// reported with the path of the field.
+func Unmarshal(document []byte, v interface{}) error {
+	err := json.Unmarshal(document, v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		path := ""
+		if typeErr.Field != "" {
+			path = "/" + strings.ReplaceAll(typeErr.Field, ".", "/")
+		}
+		return &Error{Operation: -1, Path: path, Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)}
+	}
+	if err != nil {
+		return &Error{Operation: -1, Path: "", Message: err.Error()}
+	}
+
+	return nil
+}
+
+// MergePatch is a JSON Merge Patch: objects are merged recursively, null
+// removes a member and any other value replaces the target.
+type MergePatch struct {
+	value interface{}
+}
+
+func ParseMergePatch(data []byte) (*MergePatch, error) {
+	value, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MergePatch{value: value}, nil
+}
+
+func (patch *MergePatch) Apply(document []byte) ([]byte, error) {
+	target, err := decode(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergePatch(target, patch.value))
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, isObject := patch.(map[string]interface{})
+	if !isObject {
+		return patch
+	}
+
+	targetObject, isObject := target.(map[string]interface{})
+	if !isObject {
+		targetObject = map[string]interface{}{}
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergePatch(targetObject[name], value)
+		}
+	}
+
+	return targetObject
+}
+
+type operation struct {
+	Op    string
+	Path  string
+	From  string
+	Value interface{}
+}
+
+// JSONPatch is a sequence of JSON Patch operations applied in order.
+// The patch fails as a whole when any operation fails.
+type JSONPatch struct {
+	operations []operation
+}
+
+func ParseJSONPatch(data []byte) (*JSONPatch, error) {
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, &Error{Operation: -1, Path: "", Message: "JSON Patch must be an array of operations"}
+	}
+
+	patch := &JSONPatch{}
+	for i, member := range raw {
+		var op operation
+		for _, field := range []struct {
+			name     string
+			required bool
+			target   *string
+		}{
+			{"op", true, &op.Op},
+			{"path", true, &op.Path},
+			{"from", false, &op.From},
+		} {
+			value, exists := member[field.name]
+			if !exists {
+				if field.required {
+					return nil, &Error{Operation: i, Path: "", Message: fmt.Sprintf("missing %q member", field.name)}
+				}
+				continue
+			}
+			if err := json.Unmarshal(value, field.target); err != nil {
+				return nil, &Error{Operation: i, Path: "", Message: fmt.Sprintf("%q member must be a string", field.name)}
+			}
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			value, exists := member["value"]
+			if !exists {
+				return nil, &Error{Operation: i, Path: op.Path, Message: fmt.Sprintf("missing \"value\" member on %s", op.Op)}
+			}
+			json.Unmarshal(value, &op.Value)
+		case "move", "copy":
+			if _, exists := member["from"]; !exists {
+				return nil, &Error{Operation: i, Path: op.Path, Message: fmt.Sprintf("missing \"from\" member on %s", op.Op)}
+			}
+			if _, err := parsePointer(op.From); err != nil {
+				return nil, &Error{Operation: i, Path: op.From, Message: err.Error()}
+			}
+		case "remove":
+		default:
+			return nil, &Error{Operation: i, Path: op.Path, Message: fmt.Sprintf("unknown operation %q", op.Op)}
+		}
+
+		if _, err := parsePointer(op.Path); err != nil {
+			return nil, &Error{Operation: i, Path: op.Path, Message: err.Error()}
+		}
+		patch.operations = append(patch.operations, op)
+	}
+
+	return patch, nil
+}
+
+func (patch *JSONPatch) Apply(document []byte) ([]byte, error) {
+	target, err := decode(document)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range patch.operations {
+		target, err = applyOperation(target, op)
+		if err != nil {
+			var patchErr *Error
+			if errors.As(err, &patchErr) {
+				patchErr.Operation = i
+			}
+			return nil, err
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+func applyOperation(target interface{}, op operation) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	switch op.Op {
+	case "add":
+		return add(target, path, "", op.Value)
+	case "remove":
+		target, _, err := remove(target, path, "")
+		return target, err
+	case "replace":
+		if len(path) == 0 {
+			return op.Value, nil
+		}
+		target, _, err := remove(target, path, "")
+		if err != nil {
+			return nil, err
+		}
+		return add(target, path, "", op.Value)
+	case "move":
+		from, _ := parsePointer(op.From)
+		if op.Path != op.From && strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, &Error{Path: op.From, Message: "can't move a value into itself"}
+		}
+		target, value, err := remove(target, from, "")
+		if err != nil {
+			return nil, err
+		}
+		return add(target, path, "", value)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		value, err := get(target, from, "")
+		if err != nil {
+			return nil, err
+		}
+		return add(target, path, "", deepCopy(value))
+	case "test":
+		value, err := get(target, path, "")
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, op.Value) {
+			return nil, &Error{Path: op.Path, Message: "test failed, value is different"}
+		}
+		return target, nil
+	}
+
+	return nil, &Error{Path: op.Path, Message: fmt.Sprintf("unknown operation %q", op.Op)}
+}
+
+// Parse a JSON pointer (RFC 6901) into its reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if pointer[0] != '/' {
+		return nil, errors.New("JSON pointer must start with /")
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func escapeToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// Index of an array element, when end is true "-" and the array length are
+// accepted to refer to the position after the last element.
+func arrayIndex(token string, length int, end bool, path string) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.TrimLeft(token, "0123456789") != "" {
+		return 0, &Error{Path: path, Message: fmt.Sprintf("invalid array index %q", token)}
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index > length || (index == length && !end) {
+		return 0, &Error{Path: path, Message: fmt.Sprintf("array index %s out of range", token)}
+	}
+
+	return index, nil
+}
+
+func get(target interface{}, path []string, prefix string) (interface{}, error) {
+	if len(path) == 0 {
+		return target, nil
+	}
+
+	current := prefix + "/" + escapeToken(path[0])
+	switch node := target.(type) {
+	case map[string]interface{}:
+		child, exists := node[path[0]]
+		if !exists {
+			return nil, &Error{Path: current, Message: "path does not exists"}
+		}
+		return get(child, path[1:], current)
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(node), false, current)
+		if err != nil {
+			return nil, err
+		}
+		return get(node[index], path[1:], current)
+	}
+
+	return nil, &Error{Path: prefix, Message: "value is not an object or array"}
+}
+
+// Add value on path, returning the changed target.
+func add(target interface{}, path []string, prefix string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	current := prefix + "/" + escapeToken(path[0])
+	switch node := target.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			node[path[0]] = value
+			return node, nil
+		}
+		child, exists := node[path[0]]
+		if !exists {
+			return nil, &Error{Path: current, Message: "path does not exists"}
+		}
+		child, err := add(child, path[1:], current, value)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = child
+		return node, nil
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(node), len(path) == 1, current)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 1 {
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		child, err := add(node[index], path[1:], current, value)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = child
+		return node, nil
+	}
+
+	return nil, &Error{Path: prefix, Message: "value is not an object or array"}
+}
+
+// Remove the value on path, returning the changed target and the value removed.
+func remove(target interface{}, path []string, prefix string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, &Error{Path: prefix, Message: "can't remove the whole document"}
+	}
+
+	current := prefix + "/" + escapeToken(path[0])
+	switch node := target.(type) {
+	case map[string]interface{}:
+		child, exists := node[path[0]]
+		if !exists {
+			return nil, nil, &Error{Path: current, Message: "path does not exists"}
+		}
+		if len(path) == 1 {
+			delete(node, path[0])
+			return node, child, nil
+		}
+		child, removed, err := remove(child, path[1:], current)
+		if err != nil {
+			return nil, nil, err
+		}
+		node[path[0]] = child
+		return node, removed, nil
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(node), false, current)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := node[index]
+			return append(node[:index], node[index+1:]...), removed, nil
+		}
+		child, removed, err := remove(node[index], path[1:], current)
+		if err != nil {
+			return nil, nil, err
+		}
+		node[index] = child
+		return node, removed, nil
+	}
+
+	return nil, nil, &Error{Path: prefix, Message: "value is not an object or array"}
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(node))
+		for name, child := range node {
+			copied[name] = deepCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(node))
+		for i, child := range node {
+			copied[i] = deepCopy(child)
+		}
+		return copied
+	}
+
+	return value
+}
@@ -0,0 +1,207 @@
+// Package pdf writes simple PDF documents: text on the standard Helvetica
+// fonts, lines and rectangles. Coordinates are in points from the top left
+// corner of the page.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Page sizes in points.
+const (
+	A4Width  = 595.28
+	A4Height = 841.89
+)
+
+// Widths of the Helvetica glyphs of the characters 32 to 126, in thousandths
+// of the font size. Helvetica-Bold is measured as 5% wider.
+var helveticaWidths = [...]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+const boldWidthFactor = 1.05
+
+// Document is a PDF document being drawn, page by page.
+type Document struct {
+	Width   float64
+	Height  float64
+	pages   []*bytes.Buffer
+	current int
+}
+
+func New(width float64, height float64) *Document {
+	return &Document{Width: width, Height: height}
+}
+
+// AddPage starts a new page and draws on it.
+func (document *Document) AddPage() {
+	document.pages = append(document.pages, &bytes.Buffer{})
+	document.current = len(document.pages) - 1
+}
+
+// SelectPage draws on the page of index i, counted from 0.
+func (document *Document) SelectPage(i int) {
+	if i >= 0 && i < len(document.pages) {
+		document.current = i
+	}
+}
+
+// Pages is the number of pages of the document.
+func (document *Document) Pages() int {
+	return len(document.pages)
+}
+
+func (document *Document) page() *bytes.Buffer {
+	if len(document.pages) == 0 {
+		document.AddPage()
+	}
+	return document.pages[document.current]
+}
+
+// Encode text on WinAnsiEncoding, the encoding of the standard fonts.
+// Characters out of Latin-1 are replaced by ?.
+func encode(text string) []byte {
+	encoded := []byte{}
+	for _, r := range text {
+		if r > 0xff {
+			r = '?'
+		}
+		if r < 0x20 || (r >= 0x7f && r < 0xa0) {
+			r = ' '
+		}
+		encoded = append(encoded, byte(r))
+	}
+
+	return encoded
+}
+
+func charWidth(char byte) int {
+	switch {
+	case char >= 32 && char <= 126:
+		return helveticaWidths[char-32]
+	case char >= 0xc0 && char <= 0xde:
+		// accented capitals are as wide as their letter
+		return 722
+	default:
+		return 556
+	}
+}
+
+// TextWidth is the width of text on the font size.
+func TextWidth(text string, size float64, bold bool) float64 {
+	width := 0
+	for _, char := range encode(text) {
+		width += charWidth(char)
+	}
+
+	factor := 1.0
+	if bold {
+		factor = boldWidthFactor
+	}
+	return float64(width) * size / 1000 * factor
+}
+
+// Truncate text with an ellipsis to fit on width.
+func Truncate(text string, width float64, size float64, bold bool) string {
+	if TextWidth(text, size, bold) <= width {
+		return text
+	}
+
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		truncated := strings.TrimRightFunc(string(runes), unicode.IsSpace) + "..."
+		if TextWidth(truncated, size, bold) <= width {
+			return truncated
+		}
+	}
+	return ""
+}
+
+func escape(text []byte) string {
+	var escaped strings.Builder
+	for _, char := range text {
+		if char == '\\' || char == '(' || char == ')' {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(char)
+	}
+	return escaped.String()
+}
+
+// Text draws text with its baseline at y.
+func (document *Document) Text(x float64, y float64, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(document.page(), "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n",
+		font, size, x, document.Height-y, escape(encode(text)))
+}
+
+// Line draws a line of width points.
+func (document *Document) Line(x1 float64, y1 float64, x2 float64, y2 float64, width float64) {
+	fmt.Fprintf(document.page(), "%.2f w %.2f %.2f m %.2f %.2f l S\n",
+		width, x1, document.Height-y1, x2, document.Height-y2)
+}
+
+// Rect draws the border of a rectangle with its top left corner at x, y.
+func (document *Document) Rect(x float64, y float64, width float64, height float64, lineWidth float64) {
+	fmt.Fprintf(document.page(), "%.2f w %.2f %.2f %.2f %.2f re S\n",
+		lineWidth, x, document.Height-y-height, width, height)
+}
+
+// Gray sets the gray level, 0 black to 1 white, of what is drawn next.
+func (document *Document) Gray(level float64) {
+	fmt.Fprintf(document.page(), "%.2f g %.2f G\n", level, level)
+}
+
+// Write the document as a PDF file.
+func (document *Document) Write(writer io.Writer) error {
+	if len(document.pages) == 0 {
+		document.AddPage()
+	}
+
+	var file bytes.Buffer
+	offsets := []int{}
+	object := func(content string) {
+		offsets = append(offsets, file.Len())
+		fmt.Fprintf(&file, "%d 0 obj\n%s\nendobj\n", len(offsets), content)
+	}
+
+	file.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// 1 catalog, 2 pages, 3 and 4 fonts, then each page and its content
+	kids := []string{}
+	for i := range document.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 5+i*2))
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range document.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			document.Width, document.Height, 6+i*2))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := file.Len()
+	fmt.Fprintf(&file, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&file, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&file, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := writer.Write(file.Bytes())
+	return err
+}
@@ -0,0 +1,374 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Directions of a price trend.
+const (
+	TrendUp     = "up"
+	TrendDown   = "down"
+	TrendStable = "stable"
+)
+
+// Percent of change below which a price is considered stable.
+const stableChange = 5.0
+
+// PriceObservation is the price an ingredient was bought for at a store.
+type PriceObservation struct {
+	gorm.Model
+	IngredientID uint `gorm:"index"`
+	StoreID      uint `gorm:"index"`
+	BuyItemID    uint
+	UnitPrice    float64
+	Unit         string // kg, l, unit...
+	ObservedAt   time.Time
+}
+
+// StorePrice summarizes the prices of an ingredient at a store in one unit.
+// Change is the percent the price changed over the observations, from a
+// linear fit of them, and Trend its direction.
+type StorePrice struct {
+	StoreID    uint
+	Store      string
+	Unit       string
+	Latest     float64
+	ObservedAt time.Time
+	Average    float64
+	Minimum    float64
+	Trend      string
+	Change     float64
+}
+
+type PriceHistory struct {
+	IngredientID uint
+	Observations []PriceObservation // oldest first
+	Stores       []StorePrice
+}
+
+// StoreEstimate is the cost of a list at a store using the latest price of
+// each ingredient there in the unit of the item. Missing has the items
+// without price at the store in their unit.
+type StoreEstimate struct {
+	StoreID uint
+	Store   string
+	Total   float64
+	Missing []uint
+}
+
+// StoreSplit is the cost of buying each item of a list on the cheaper of
+// two stores. Items has the identifiers of the items bought at each store.
+type StoreSplit struct {
+	Stores  [2]uint
+	Total   float64
+	Items   map[uint][]uint
+	Missing []uint
+	Saving  float64 // compared to the cheapest store
+}
+
+// BestStore has the estimates of a list at every store, cheapest first.
+// Cheapest is the store that prices most items at the lowest total, Split
+// is set when buying on two stores is better than that.
+type BestStore struct {
+	Estimates []StoreEstimate
+	Cheapest  *StoreEstimate
+	Split     *StoreSplit
+}
+
+type PriceService struct {
+	Database *gorm.DB
+}
+
+// Record the price an item was purchased for at a store.
+func (service *PriceService) Observe(item BuyItem, storeID uint, unitPrice float64, unit string) (PriceObservation, error) {
+	if unitPrice < 0 {
+		return PriceObservation{}, errors.New("Price can't be negative")
+	}
+
+	var store Store
+	if err := service.Database.First(&store, storeID).Error; err != nil {
+		return PriceObservation{}, errors.New("Store does not exists")
+	}
+
+	observation := PriceObservation{
+		IngredientID: uint(item.IngredientID),
+		StoreID:      storeID,
+		BuyItemID:    item.ID,
+		UnitPrice:    unitPrice,
+		Unit:         unit,
+		ObservedAt:   time.Now(),
+	}
+	if item.PurchasedAt != nil {
+		observation.ObservedAt = *item.PurchasedAt
+	}
+	result := service.Database.Create(&observation)
+
+	return observation, result.Error
+}
+
+// History of the prices of an ingredient seen on the stores of owner with a
+// summary by store.
+func (service *PriceService) History(owner string, ingredientID uint) (PriceHistory, error) {
+	history := PriceHistory{IngredientID: ingredientID, Stores: []StorePrice{}}
+	result := service.Database.
+		Where("ingredient_id = ?", ingredientID).
+		Where("store_id in (select id from stores where owner = ?)", owner).
+		Order("observed_at, id").
+		Find(&history.Observations)
+	if result.Error != nil {
+		return history, result.Error
+	}
+
+	names, err := service.storeNames()
+	if err != nil {
+		return history, err
+	}
+
+	type key struct {
+		store uint
+		unit  string
+	}
+	groups := map[key][]PriceObservation{}
+	keys := []key{}
+	for _, observation := range history.Observations {
+		k := key{observation.StoreID, observation.Unit}
+		if _, exists := groups[k]; !exists {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], observation)
+	}
+	for _, k := range keys {
+		price := summarize(groups[k])
+		price.Store = names[k.store]
+		history.Stores = append(history.Stores, price)
+	}
+
+	return history, nil
+}
+
+func (service *PriceService) storeNames() (map[uint]string, error) {
+	var stores []Store
+	result := service.Database.Unscoped().Select("id", "name").Find(&stores)
+
+	names := map[uint]string{}
+	for _, store := range stores {
+		names[store.ID] = store.Name
+	}
+	return names, result.Error
+}
+
+// Summarize observations of one store and unit, oldest first.
+func summarize(observations []PriceObservation) StorePrice {
+	latest := observations[len(observations)-1]
+	price := StorePrice{
+		StoreID:    latest.StoreID,
+		Unit:       latest.Unit,
+		Latest:     latest.UnitPrice,
+		ObservedAt: latest.ObservedAt,
+		Minimum:    math.Inf(1),
+		Trend:      TrendStable,
+	}
+
+	// least squares fit of the price over the days since the first observation
+	first := observations[0].ObservedAt
+	var sumX, sumY, sumXY, sumXX float64
+	for _, observation := range observations {
+		x := observation.ObservedAt.Sub(first).Hours() / 24
+		y := observation.UnitPrice
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+		price.Minimum = math.Min(price.Minimum, y)
+	}
+	n := float64(len(observations))
+	price.Average = sumY / n
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return price
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	intercept := (sumY - slope*sumX) / n
+	days := latest.ObservedAt.Sub(first).Hours() / 24
+	start, end := intercept, intercept+slope*days
+	if start <= 0 {
+		return price
+	}
+
+	price.Change = math.Round((end-start)/start*10000) / 100
+	if price.Change > stableChange {
+		price.Trend = TrendUp
+	} else if price.Change < -stableChange {
+		price.Trend = TrendDown
+	}
+
+	return price
+}
+
+// Estimate the cost of every item of the list, Quantity times the latest
+// unit price of its ingredient in the Unit of the item, at each store of the
+// list owner and find the best ones. Prices in other units are not converted.
+func (service *PriceService) BestStore(list BuyList) (BestStore, error) {
+	best := BestStore{Estimates: []StoreEstimate{}}
+
+	var stores []Store
+	if err := service.Database.Where("owner = ?", list.Owner).Order("id").Find(&stores).Error; err != nil {
+		return best, err
+	}
+
+	ingredients := []uint{}
+	for _, item := range list.Items {
+		ingredients = append(ingredients, uint(item.IngredientID))
+	}
+	var observations []PriceObservation
+	result := service.Database.
+		Where("ingredient_id in ?", ingredients).
+		Order("observed_at, id").
+		Find(&observations)
+	if result.Error != nil {
+		return best, result.Error
+	}
+
+	// latest price of each ingredient and unit by store
+	latest := map[uint]map[priceKey]float64{}
+	for _, observation := range observations {
+		if latest[observation.StoreID] == nil {
+			latest[observation.StoreID] = map[priceKey]float64{}
+		}
+		latest[observation.StoreID][priceKey{observation.IngredientID, observation.Unit}] = observation.UnitPrice
+	}
+
+	for _, store := range stores {
+		estimate := StoreEstimate{StoreID: store.ID, Store: store.Name, Missing: []uint{}}
+		for _, item := range list.Items {
+			price, exists := latest[store.ID][itemPriceKey(item)]
+			if !exists {
+				estimate.Missing = append(estimate.Missing, item.ID)
+				continue
+			}
+			estimate.Total += price * float64(item.Quantity)
+		}
+		estimate.Total = roundPrice(estimate.Total)
+		best.Estimates = append(best.Estimates, estimate)
+	}
+
+	// most items priced first, then cheapest
+	sort.SliceStable(best.Estimates, func(i, j int) bool {
+		a, b := best.Estimates[i], best.Estimates[j]
+		if len(a.Missing) != len(b.Missing) {
+			return len(a.Missing) < len(b.Missing)
+		}
+		return a.Total < b.Total
+	})
+	if len(best.Estimates) == 0 || len(best.Estimates[0].Missing) == len(list.Items) {
+		return best, nil
+	}
+	best.Cheapest = &best.Estimates[0]
+
+	for i := range stores {
+		for j := i + 1; j < len(stores); j++ {
+			split := splitStores(list, stores[i].ID, stores[j].ID, latest)
+			if !betterSplit(split, best) {
+				continue
+			}
+			split.Saving = roundPrice(best.Cheapest.Total - split.Total)
+			best.Split = &split
+		}
+	}
+
+	return best, nil
+}
+
+// Prices of an ingredient are only comparable in the same unit.
+type priceKey struct {
+	ingredient uint
+	unit       string
+}
+
+func itemPriceKey(item BuyItem) priceKey {
+	return priceKey{uint(item.IngredientID), item.Unit}
+}
+
+// Buy each item on the cheaper of the two stores.
+func splitStores(list BuyList, first uint, second uint, latest map[uint]map[priceKey]float64) StoreSplit {
+	split := StoreSplit{
+		Stores:  [2]uint{first, second},
+		Items:   map[uint][]uint{first: {}, second: {}},
+		Missing: []uint{},
+	}
+	for _, item := range list.Items {
+		key := itemPriceKey(item)
+		firstPrice, firstExists := latest[first][key]
+		secondPrice, secondExists := latest[second][key]
+
+		store, price := first, firstPrice
+		switch {
+		case !firstExists && !secondExists:
+			split.Missing = append(split.Missing, item.ID)
+			continue
+		case !firstExists || (secondExists && secondPrice < firstPrice):
+			store, price = second, secondPrice
+		}
+		split.Items[store] = append(split.Items[store], item.ID)
+		split.Total += price * float64(item.Quantity)
+	}
+	split.Total = roundPrice(split.Total)
+
+	return split
+}
+
+// A split is only worth it when both stores are used and it prices more
+// items, or as many for less, than the cheapest store and the best split so far.
+func betterSplit(split StoreSplit, best BestStore) bool {
+	if len(split.Items[split.Stores[0]]) == 0 || len(split.Items[split.Stores[1]]) == 0 {
+		return false
+	}
+
+	better := func(missing int, total float64) bool {
+		if len(split.Missing) != missing {
+			return len(split.Missing) < missing
+		}
+		return split.Total < total
+	}
+	if !better(len(best.Cheapest.Missing), best.Cheapest.Total) {
+		return false
+	}
+
+	return best.Split == nil || better(len(best.Split.Missing), best.Split.Total)
+}
+
+// Latest price of each item of the list in its unit: the one it was
+// purchased for or else the latest of its ingredient. Items without a price
+// in their unit are left out.
+func (service *PriceService) ItemPrices(list BuyList) (map[uint]float64, error) {
+	var rows []struct {
+		ID    uint
+		Price *float64
+	}
+	result := service.Database.Table("buy_items").
+		Select("buy_items.id, coalesce("+
+			"(select unit_price from price_observations where buy_item_id = buy_items.id and unit = buy_items.unit and deleted_at is null "+
+			"order by id desc limit 1), "+
+			"(select unit_price from price_observations where ingredient_id = buy_items.ingredient_id and unit = buy_items.unit and deleted_at is null "+
+			"order by observed_at desc, id desc limit 1)) as price").
+		Where("buy_items.buy_list_id = ? and buy_items.deleted_at is null", list.ID).
+		Scan(&rows)
+
+	prices := map[uint]float64{}
+	for _, row := range rows {
+		if row.Price != nil {
+			prices[row.ID] = *row.Price
+		}
+	}
+	return prices, result.Error
+}
+
+func roundPrice(price float64) float64 {
+	return math.Round(price*100) / 100
+}
@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	NotificationReminder    = "reminder"
+	NotificationShareInvite = "share_invite"
+)
+
+// Reminder is a pending notification of a scheduled buy list. It fires
+// OffsetMinutes before the list ScheduledFor date. Reminders are stored on
+// database so pending ones survive application restarts.
+type Reminder struct {
+	gorm.Model
+	BuyListID     int
+	OffsetMinutes uint
+	FireAt        time.Time
+	SentAt        *time.Time
+	Attempts      uint
+	LastError     string
+	Channels      []string `gorm:"serializer:json"` // channels that already delivered it
+}
+
+// Notification is the event delivered to a Notifier.
+// Recipient is only set when it is not the owner of the list (share invites).
+type Notification struct {
+	Kind      string
+	Owner     string
+	Recipient string
+	BuyList   BuyList
+	Reminder  *Reminder
+}
+
+// Notifier delivers notifications to the user through some channel
+// (log, email, whatsapp...).
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// LogNotifier only writes notifications to the application log.
+type LogNotifier struct{}
+
+func (notifier LogNotifier) Notify(ctx context.Context, notification Notification) error {
+	log.Printf("%s notification for list %d (%s) of user %q",
+		notification.Kind, notification.BuyList.ID, notification.BuyList.Title, notification.Owner)
+	return nil
+}
+
+func (notifier LogNotifier) Channel() string {
+	return "log"
+}
+
+// ChannelNotifier is a Notifier that tells the name of its channel.
+// Notifiers that don't are identified by their type.
+type ChannelNotifier interface {
+	Notifier
+	Channel() string
+}
+
+func notifierChannel(notifier Notifier) string {
+	if named, ok := notifier.(ChannelNotifier); ok {
+		return named.Channel()
+	}
+	return fmt.Sprintf("%T", notifier)
+}
+
+// MultiNotifier sends notifications through all of its notifiers.
+// Channels that delivered a reminder are recorded on it, so when another
+// channel fails and the reminder is retried it is not sent twice through them.
+type MultiNotifier []Notifier
+
+func (notifiers MultiNotifier) Notify(ctx context.Context, notification Notification) error {
+	var errs []error
+	for _, notifier := range notifiers {
+		channel := notifierChannel(notifier)
+		if notification.Reminder != nil && slices.Contains(notification.Reminder.Channels, channel) {
+			continue
+		}
+
+		if err := notifier.Notify(ctx, notification); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", channel, err))
+			continue
+		}
+		if notification.Reminder != nil {
+			notification.Reminder.Channels = append(notification.Reminder.Channels, channel)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Set the fire date of list reminders based on its scheduled date.
+// Existing reminders whose fire date didn't change keep their delivery state
+// so they are not sent twice.
+func planReminders(list *BuyList, existing []Reminder) {
+	if list.ScheduledFor == nil {
+		list.Reminders = nil
+		return
+	}
+
+	sent := make(map[uint]Reminder, len(existing))
+	for _, reminder := range existing {
+		sent[reminder.OffsetMinutes] = reminder
+	}
+
+	for i := range list.Reminders {
+		reminder := &list.Reminders[i]
+		reminder.ID = 0
+		reminder.FireAt = list.ScheduledFor.Add(-time.Duration(reminder.OffsetMinutes) * time.Minute)
+		reminder.SentAt = nil
+		reminder.Attempts = 0
+		reminder.LastError = ""
+		reminder.Channels = nil
+
+		old, exists := sent[reminder.OffsetMinutes]
+		if exists && old.FireAt.Equal(reminder.FireAt) {
+			reminder.SentAt = old.SentAt
+			reminder.Attempts = old.Attempts
+			reminder.LastError = old.LastError
+			reminder.Channels = old.Channels
+		}
+	}
+}
+
+// ReminderScheduler periodically looks for due reminders on database and
+// sends them through Notifier.
+type ReminderScheduler struct {
+	Database    *gorm.DB
+	Notifier    Notifier
+	Interval    time.Duration
+	MaxAttempts uint
+}
+
+// Run dispatches due reminders every Interval until ctx is done.
+func (scheduler *ReminderScheduler) Run(ctx context.Context) {
+	interval := scheduler.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := scheduler.DispatchDue(ctx, time.Now()); err != nil {
+			log.Printf("Error dispatching reminders: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchDue sends every reminder with fire date before now that was not sent yet.
+// Returns how many reminders were sent.
+func (scheduler *ReminderScheduler) DispatchDue(ctx context.Context, now time.Time) (int, error) {
+	maxAttempts := scheduler.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = 5
+	}
+
+	// reminders of lists on the trash wait for the list to be restored
+	reminders := []Reminder{}
+	result := scheduler.Database.
+		Where("sent_at is null and fire_at <= ? and attempts < ?", now, maxAttempts).
+		Where("buy_list_id in (?)", scheduler.Database.Model(&BuyList{}).Select("id")).
+		Order("fire_at").
+		Find(&reminders)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	sent := 0
+	for _, reminder := range reminders {
+		var list BuyList
+		scheduler.Database.Scopes(preloadList).First(&list, reminder.BuyListID)
+		if list.ID == 0 {
+			// list was purged, reminder is not needed anymore
+			scheduler.Database.Delete(&reminder)
+			continue
+		}
+
+		reminder.Attempts++
+		err := scheduler.Notifier.Notify(ctx, Notification{
+			Kind:     NotificationReminder,
+			Owner:    list.Owner,
+			BuyList:  list,
+			Reminder: &reminder,
+		})
+		if err != nil {
+			reminder.LastError = err.Error()
+		} else {
+			sentAt := now
+			reminder.SentAt = &sentAt
+			reminder.LastError = ""
+			sent++
+		}
+
+		result := scheduler.Database.Model(&reminder).Select("Attempts", "SentAt", "LastError", "Channels").Updates(&reminder)
+		if result.Error != nil {
+			return sent, result.Error
+		}
+	}
+
+	return sent, nil
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	htmlTemplate "html/template"
+	"io"
+	"strings"
+	textTemplate "text/template"
+)
+
+// Media types lists are rendered as, besides JSON.
+const (
+	MediaMarkdown = "text/markdown"
+	MediaText     = "text/plain"
+	MediaHTML     = "text/html"
+)
+
+type renderData struct {
+	BuyList
+	ScheduledFor string
+	Groups       []ItemGroup
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"#", `\#`, "<", `\<`, ">", `\>`, "|", `\|`,
+)
+
+// Quantity of an item with its unit, or "x" when it has none.
+func itemQuantity(item BuyItem) string {
+	if item.Unit == "" {
+		return fmt.Sprintf("%d x", item.Quantity)
+	}
+	return fmt.Sprintf("%d %s", item.Quantity, item.Unit)
+}
+
+var renderFuncs = textTemplate.FuncMap{
+	"md":       markdownEscaper.Replace,
+	"quantity": itemQuantity,
+}
+
+var listMarkdownTemplate = textTemplate.Must(textTemplate.New("markdown").Funcs(renderFuncs).Parse(
+	`# {{md .Title}}
+{{if .ScheduledFor}}
+_Scheduled for {{.ScheduledFor}}_
+{{end}}{{range .Groups}}
+## {{md .Category}}
+
+{{range .Items}}- [{{if .Purchased}}x{{else}} {{end}}] {{quantity .}} {{md .Ingredient.Name}}{{if .Notes}} _({{md .Notes}})_{{end}}
+{{end}}{{end}}`))
+
+var listTextTemplate = textTemplate.Must(textTemplate.New("text").Funcs(renderFuncs).Parse(
+	`{{.Title}}{{if .ScheduledFor}} - {{.ScheduledFor}}{{end}}
+{{range .Groups}}{{range .Items}}[{{if .Purchased}}x{{else}} {{end}}] {{quantity .}} {{.Ingredient.Name}}{{if .Notes}} ({{.Notes}}){{end}}
+{{end}}{{end}}`))
+
+var listHTMLTemplate = htmlTemplate.Must(htmlTemplate.New("html").Funcs(htmlTemplate.FuncMap(renderFuncs)).Parse(
+	`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #000; }
+h1 { font-size: 1.6em; margin-bottom: 0; }
+.scheduled { color: #444; margin-top: 0.2em; }
+.groups { columns: 2; column-gap: 2em; }
+section { break-inside: avoid; margin-bottom: 1em; }
+h2 { font-size: 1.1em; text-transform: capitalize; border-bottom: 1px solid #000; }
+ul { list-style: none; padding: 0; margin: 0; }
+li { padding: 0.2em 0; font-size: 1.1em; }
+li::before { content: "\2610"; margin-right: 0.5em; }
+li.purchased { text-decoration: line-through; color: #666; }
+li.purchased::before { content: "\2611"; }
+.notes { font-size: 0.8em; color: #444; }
+@media print {
+  body { margin: 0; }
+  @page { margin: 1.5cm; }
+}
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .ScheduledFor}}<p class="scheduled">{{.ScheduledFor}}</p>
+{{end}}<div class="groups">
+{{range .Groups}}<section>
+<h2>{{.Category}}</h2>
+<ul>
+{{range .Items}}<li{{if .Purchased}} class="purchased"{{end}}>{{quantity .}} {{.Ingredient.Name}}{{if .Notes}} <span class="notes">{{.Notes}}</span>{{end}}</li>
+{{end}}</ul>
+</section>
+{{end}}</div>
+</body>
+</html>
+`))
+
+// RenderList writes the list as mediaType, one of MediaMarkdown, MediaText
+// or MediaHTML, with its items on groups.
+func RenderList(writer io.Writer, mediaType string, list BuyList, groups []ItemGroup) error {
+	data := renderData{BuyList: list, Groups: groups}
+	if list.ScheduledFor != nil {
+		data.ScheduledFor = list.ScheduledFor.Format("02/01/2006 15:04")
+	}
+
+	switch mediaType {
+	case MediaMarkdown:
+		return listMarkdownTemplate.Execute(writer, data)
+	case MediaText:
+		return listTextTemplate.Execute(writer, data)
+	case MediaHTML:
+		return listHTMLTemplate.Execute(writer, data)
+	}
+
+	return fmt.Errorf("Unknown media type %s", mediaType)
+}
+
+// Groups of the items of the route by aisle, in walking order.
+func (route ShoppingRoute) Groups() []ItemGroup {
+	items := map[uint]BuyItem{}
+	for _, item := range route.Items {
+		items[item.ID] = item
+	}
+
+	groups := []ItemGroup{}
+	for _, section := range route.Sections {
+		group := ItemGroup{Category: section.Aisle}
+		for _, ID := range section.ItemIDs {
+			group.Items = append(group.Items, items[ID])
+		}
+		groups = append(groups, group)
+	}
+
+	return groups
+}
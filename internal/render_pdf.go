@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"buylist/internal/pdf"
+	"fmt"
+	"io"
+)
+
+// Media type of lists rendered as PDF.
+const MediaPDF = "application/pdf"
+
+// Layout of lists on PDF pages, in points.
+const (
+	pdfMargin      = 40.0
+	pdfColumnGap   = 24.0
+	pdfTitleSize   = 18.0
+	pdfHeadingSize = 11.0
+	pdfTextSize    = 10.0
+	pdfSmallSize   = 8.0
+	pdfRowHeight   = 16.0
+	pdfHeading     = 24.0 // height of a group heading
+	pdfCheckbox    = 8.0
+	pdfPriceWidth  = 50.0
+)
+
+// Cursor of the flow of a PDF list through the columns and pages.
+type pdfFlow struct {
+	document *pdf.Document
+	title    string
+	columns  int
+	column   int
+	y        float64
+	top      float64
+}
+
+func (flow *pdfFlow) width() float64 {
+	return (flow.document.Width - 2*pdfMargin - pdfColumnGap*float64(flow.columns-1)) / float64(flow.columns)
+}
+
+func (flow *pdfFlow) x() float64 {
+	return pdfMargin + float64(flow.column)*(flow.width()+pdfColumnGap)
+}
+
+func (flow *pdfFlow) bottom() float64 {
+	return flow.document.Height - pdfMargin - pdfSmallSize*2
+}
+
+// Move to the next column, or the next page after the last column, when
+// height doesn't fit on the current one. Reports if it moved.
+func (flow *pdfFlow) ensure(height float64) bool {
+	if flow.y+height <= flow.bottom() {
+		return false
+	}
+
+	flow.column++
+	if flow.column == flow.columns {
+		flow.column = 0
+		flow.document.AddPage()
+		flow.document.Text(pdfMargin, pdfMargin+pdfTextSize, pdfTextSize, true,
+			pdf.Truncate(flow.title+" (continued)", flow.document.Width-2*pdfMargin, pdfTextSize, true))
+		flow.document.Line(pdfMargin, pdfMargin+pdfTextSize+6, flow.document.Width-pdfMargin, pdfMargin+pdfTextSize+6, 0.5)
+		flow.top = pdfMargin + pdfTextSize + 18
+	}
+	flow.y = flow.top
+	return true
+}
+
+func (flow *pdfFlow) heading(text string) {
+	flow.y += pdfHeading
+	flow.document.Text(flow.x(), flow.y-8, pdfHeadingSize, true, pdf.Truncate(text, flow.width(), pdfHeadingSize, true))
+	flow.document.Line(flow.x(), flow.y-4, flow.x()+flow.width(), flow.y-4, 0.5)
+}
+
+func (flow *pdfFlow) item(item BuyItem, price *float64) {
+	flow.y += pdfRowHeight
+	x, baseline := flow.x(), flow.y-4
+
+	flow.document.Rect(x, baseline-pdfCheckbox, pdfCheckbox, pdfCheckbox, 0.7)
+	if item.Purchased {
+		flow.document.Line(x+1.5, baseline-pdfCheckbox+1.5, x+pdfCheckbox-1.5, baseline-1.5, 0.7)
+		flow.document.Line(x+1.5, baseline-1.5, x+pdfCheckbox-1.5, baseline-pdfCheckbox+1.5, 0.7)
+		flow.document.Gray(0.45)
+	}
+
+	text := itemQuantity(item) + " " + item.Ingredient.Name
+	if item.Notes != "" {
+		text += " (" + item.Notes + ")"
+	}
+	textX := x + pdfCheckbox + 6
+	flow.document.Text(textX, baseline, pdfTextSize, false,
+		pdf.Truncate(text, flow.width()-(textX-x)-pdfPriceWidth, pdfTextSize, false))
+
+	if price != nil {
+		formatted := fmt.Sprintf("%.2f", *price)
+		flow.document.Text(x+flow.width()-pdf.TextWidth(formatted, pdfTextSize, false), baseline, pdfTextSize, false, formatted)
+	}
+	flow.document.Gray(0)
+}
+
+// RenderPDF writes the list as an A4 PDF with its items on groups and the
+// estimated price of each item, from prices of the unit by item identifier.
+// With columns 0 the list uses two columns when it doesn't fit on one page.
+func RenderPDF(writer io.Writer, list BuyList, groups []ItemGroup, prices map[uint]float64, columns int) error {
+	document := pdf.New(pdf.A4Width, pdf.A4Height)
+	document.AddPage()
+
+	y := pdfMargin + pdfTitleSize
+	document.Text(pdfMargin, y, pdfTitleSize, true, pdf.Truncate(list.Title, document.Width-2*pdfMargin, pdfTitleSize, true))
+	if list.ScheduledFor != nil {
+		y += pdfTextSize + 8
+		document.Text(pdfMargin, y, pdfTextSize, false, "Scheduled for "+list.ScheduledFor.Format("02/01/2006 15:04"))
+	}
+	y += 10
+	document.Line(pdfMargin, y, document.Width-pdfMargin, y, 1)
+
+	flow := &pdfFlow{document: document, title: list.Title, columns: columns, y: y, top: y}
+	if columns <= 0 {
+		height := 0.0
+		for _, group := range groups {
+			height += pdfHeading + pdfRowHeight*float64(len(group.Items))
+		}
+		flow.columns = 1
+		if y+height+pdfRowHeight*2 > flow.bottom() {
+			flow.columns = 2
+		}
+	}
+
+	total, priced, count := 0.0, 0, 0
+	for _, group := range groups {
+		// a heading stays with at least its first item
+		flow.ensure(pdfHeading + pdfRowHeight)
+		flow.heading(group.Category)
+		for _, item := range group.Items {
+			if flow.ensure(pdfRowHeight) {
+				flow.heading(group.Category + " (continued)")
+			}
+
+			var price *float64
+			if unitPrice, exists := prices[item.ID]; exists {
+				estimate := unitPrice * float64(item.Quantity)
+				price = &estimate
+				total += estimate
+				priced++
+			}
+			flow.item(item, price)
+			count++
+		}
+	}
+
+	if priced > 0 {
+		flow.ensure(pdfRowHeight * 2)
+		flow.y += pdfRowHeight * 1.5
+		summary := fmt.Sprintf("Estimated total %.2f", total)
+		if priced < count {
+			summary += fmt.Sprintf(" (%d of %d items priced)", priced, count)
+		}
+		document.Text(flow.x()+flow.width()-pdf.TextWidth(summary, pdfTextSize, true), flow.y, pdfTextSize, true, summary)
+	}
+
+	pages := document.Pages()
+	for i := 0; i < pages; i++ {
+		document.SelectPage(i)
+		number := fmt.Sprintf("Page %d of %d", i+1, pages)
+		document.Gray(0.45)
+		document.Text((document.Width-pdf.TextWidth(number, pdfSmallSize, false))/2, document.Height-pdfMargin, pdfSmallSize, false, number)
+		document.Gray(0)
+	}
+
+	return document.Write(writer)
+}
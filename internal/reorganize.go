@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ErrBuyListNotFound is returned when a list to duplicate, merge or split
+// doesn't exist.
+var ErrBuyListNotFound = errors.New("List does not exists")
+
+// SplitOptions choose the items moved to new lists: the items of ItemIDs or
+// of Categories go to one new list, with ByCategory each category goes to
+// its own list. Items without category stay on the list.
+type SplitOptions struct {
+	ItemIDs    []uint
+	Categories []string
+	ByCategory bool
+	Title      string // title of the new list, when only one is created
+}
+
+func getList(tx *gorm.DB, ID uint64) (BuyList, error) {
+	var list BuyList
+	result := tx.Scopes(preloadList).First(&list, ID)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return list, fmt.Errorf("%w: %d", ErrBuyListNotFound, ID)
+	}
+
+	return list, result.Error
+}
+
+// Move an item to the end of another list.
+func moveItem(tx *gorm.DB, item *BuyItem, to *BuyList) error {
+	item.BuyListID = int(to.ID)
+	item.Position = to.nextPosition()
+	if err := tx.Model(item).Select("BuyListID", "Position").Updates(item).Error; err != nil {
+		return err
+	}
+
+	to.Items = append(to.Items, *item)
+	return nil
+}
+
+// Duplicate the list as a new list of owner with the same items, none of
+// them purchased. The new list isn't scheduled.
+func (service *BuyListService) Duplicate(ID uint64, title string, owner string) (BuyList, error) {
+	var duplicate BuyList
+	err := service.Database.Transaction(func(tx *gorm.DB) error {
+		list, err := getList(tx, ID)
+		if err != nil {
+			return err
+		}
+
+		duplicate = BuyList{Title: title, Owner: owner, Budget: list.Budget, Version: 1}
+		if duplicate.Title == "" {
+			duplicate.Title = list.Title + " (copy)"
+		}
+		for _, item := range list.Items {
+			duplicate.Items = append(duplicate.Items, BuyItem{
+				IngredientID: item.IngredientID,
+				Quantity:     item.Quantity,
+				Position:     item.Position,
+				Unit:         item.Unit,
+				Notes:        item.Notes,
+			})
+		}
+
+		return tx.Create(&duplicate).Error
+	})
+	if err != nil {
+		return duplicate, err
+	}
+
+	duplicate, err = service.Get(uint64(duplicate.ID))
+	if err == nil {
+		service.publish(EventBuyListCreated, duplicate, duplicate)
+	}
+
+	return duplicate, err
+}
+
+// Merge the items of the source lists into the target list and delete the
+// sources. Items of an ingredient already on the target in the same unit are
+// consolidated on one item with the sum of quantities, purchased only when
+// all were. Items in other units are moved.
+func (service *BuyListService) Merge(targetID uint64, sourceIDs []uint64) (BuyList, error) {
+	var sources []BuyList
+	err := service.Database.Transaction(func(tx *gorm.DB) error {
+		target, err := getList(tx, targetID)
+		if err != nil {
+			return err
+		}
+
+		for _, sourceID := range sourceIDs {
+			if sourceID == targetID {
+				return errors.New("List can't be merged into itself")
+			}
+			source, err := getList(tx, sourceID)
+			if err != nil {
+				return err
+			}
+			if source.Owner != target.Owner {
+				return errors.New("Only lists of the same owner can be merged")
+			}
+
+			for i := range source.Items {
+				item := &source.Items[i]
+				index := slices.IndexFunc(target.Items, func(targetItem BuyItem) bool {
+					return targetItem.IngredientID == item.IngredientID && targetItem.Unit == item.Unit
+				})
+				if index < 0 {
+					if err := moveItem(tx, item, &target); err != nil {
+						return err
+					}
+					continue
+				}
+
+				consolidated := &target.Items[index]
+				consolidated.Quantity += item.Quantity
+				consolidated.Purchased = consolidated.Purchased && item.Purchased
+				if !consolidated.Purchased {
+					consolidated.PurchasedAt = nil
+				}
+				if item.Notes != "" && !strings.Contains(consolidated.Notes, item.Notes) {
+					consolidated.Notes = strings.TrimPrefix(consolidated.Notes+"; "+item.Notes, "; ")
+				}
+				result := tx.Model(consolidated).Select("Quantity", "Purchased", "PurchasedAt", "Notes").Updates(consolidated)
+				if result.Error != nil {
+					return result.Error
+				}
+				if err := tx.Delete(item).Error; err != nil {
+					return err
+				}
+			}
+
+			if err := tx.Delete(&source).Error; err != nil {
+				return err
+			}
+			sources = append(sources, source)
+		}
+
+		return bumpListVersion(tx, target.ID)
+	})
+	if err != nil {
+		return BuyList{}, err
+	}
+
+	target, err := service.Get(targetID)
+	if err != nil {
+		return target, err
+	}
+	for _, source := range sources {
+		service.publish(EventBuyListDeleted, source, source)
+	}
+	service.publish(EventBuyListUpdated, target, target)
+
+	return target, nil
+}
+
+// Split items of the list into new lists, with the same owner, schedule and
+// reminders. Returns the new lists.
+func (service *BuyListService) Split(ID uint64, options SplitOptions) ([]BuyList, error) {
+	created := []BuyList{}
+	var list BuyList
+	err := service.Database.Transaction(func(tx *gorm.DB) error {
+		var err error
+		list, err = getList(tx, ID)
+		if err != nil {
+			return err
+		}
+
+		// items of each new list, by the key of the list
+		groups := map[string][]int{}
+		keys := []string{}
+		addToGroup := func(key string, index int) {
+			if _, exists := groups[key]; !exists {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], index)
+		}
+
+		for i, item := range list.Items {
+			category := strings.ToLower(item.Ingredient.Category)
+			switch {
+			case len(options.ItemIDs) > 0:
+				if slices.Contains(options.ItemIDs, item.ID) {
+					addToGroup("", i)
+				}
+			case len(options.Categories) > 0:
+				if slices.ContainsFunc(options.Categories, func(selected string) bool {
+					return strings.EqualFold(selected, category)
+				}) {
+					addToGroup(strings.Join(options.Categories, ", "), i)
+				}
+			case options.ByCategory && category != "":
+				addToGroup(category, i)
+			}
+		}
+
+		for _, itemID := range options.ItemIDs {
+			if !slices.ContainsFunc(list.Items, func(item BuyItem) bool { return item.ID == itemID }) {
+				return fmt.Errorf("Item %d does not exists on list", itemID)
+			}
+		}
+		if len(keys) == 0 {
+			return errors.New("No items to split from the list")
+		}
+
+		for _, key := range keys {
+			split := BuyList{
+				Owner:        list.Owner,
+				ScheduledFor: list.ScheduledFor,
+				Version:      1,
+			}
+			switch {
+			case options.Title != "" && len(keys) == 1:
+				split.Title = options.Title
+			case key == "":
+				split.Title = list.Title + " (split)"
+			default:
+				split.Title = list.Title + " - " + key
+			}
+			for _, reminder := range list.Reminders {
+				split.Reminders = append(split.Reminders, Reminder{OffsetMinutes: reminder.OffsetMinutes})
+			}
+			// reminders already sent for the list aren't sent again
+			planReminders(&split, list.Reminders)
+			if err := tx.Create(&split).Error; err != nil {
+				return err
+			}
+
+			for _, index := range groups[key] {
+				if err := moveItem(tx, &list.Items[index], &split); err != nil {
+					return err
+				}
+			}
+			created = append(created, split)
+		}
+
+		return bumpListVersion(tx, list.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range created {
+		created[i], err = service.Get(uint64(created[i].ID))
+		if err != nil {
+			return created, err
+		}
+		service.publish(EventBuyListCreated, created[i], created[i])
+	}
+	list, err = service.Get(ID)
+	if err == nil {
+		service.publish(EventBuyListUpdated, list, list)
+	}
+
+	return created, err
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ReportFilter selects the purchases on reports: items purchased on lists
+// of Owner between From and To. Empty fields are not used.
+type ReportFilter struct {
+	Owner string
+	From  *time.Time
+	To    *time.Time
+}
+
+// SpendRow is the spending of a group of purchases. Spend only sums the
+// Priced items, the ones purchased with a price. Change is the percent the
+// spend changed from the previous month, on monthly reports.
+type SpendRow struct {
+	Group  string
+	Items  int64
+	Priced int64
+	Spend  float64
+	Change *float64 `json:",omitempty"`
+}
+
+// IngredientUsage is how often an ingredient is purchased.
+// AverageInterval is the mean of days between purchases, nil with a single
+// purchase.
+type IngredientUsage struct {
+	IngredientID    uint
+	Ingredient      string
+	Category        string
+	Purchases       int64
+	Quantity        int64
+	Spend           float64
+	AverageInterval *float64
+}
+
+type ReportService struct {
+	Database *gorm.DB
+}
+
+// Spend of an item, with the latest price it was purchased for.
+const itemSpend = "coalesce(price_observations.unit_price * buy_items.quantity, 0)"
+
+// Purchased items selected by filter with their list, ingredient and price.
+func (filter ReportFilter) purchases(db *gorm.DB) *gorm.DB {
+	query := db.Table("buy_items").
+		Joins("join buy_lists on buy_lists.id = buy_items.buy_list_id and buy_lists.deleted_at is null").
+		Joins("join ingredients on ingredients.id = buy_items.ingredient_id").
+		Joins("left join price_observations on price_observations.id = " +
+			"(select max(id) from price_observations where buy_item_id = buy_items.id and deleted_at is null)").
+		Where("buy_items.deleted_at is null and buy_items.purchased and buy_items.purchased_at is not null")
+
+	if filter.Owner != "" {
+		query = query.Where("buy_lists.owner = ?", filter.Owner)
+	}
+	if filter.From != nil {
+		query = query.Where("buy_items.purchased_at >= ?", filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("buy_items.purchased_at < ?", filter.To)
+	}
+
+	return query
+}
+
+func (service *ReportService) spend(filter ReportFilter, group string, extra func(*gorm.DB) *gorm.DB) ([]SpendRow, error) {
+	rows := []SpendRow{}
+	query := filter.purchases(service.Database).
+		Select(group + " as `group`, count(*) as items, count(price_observations.id) as priced, " +
+			"round(sum(" + itemSpend + "), 2) as spend").
+		Group("`group`").
+		Order("`group`")
+	if extra != nil {
+		query = extra(query)
+	}
+	result := query.Scan(&rows)
+
+	return rows, result.Error
+}
+
+// Spend by month, on the months between the first and the last purchase,
+// with the change from the previous month.
+func (service *ReportService) Monthly(filter ReportFilter) ([]SpendRow, error) {
+	// dates are stored on local time as text, the month is their prefix
+	found, err := service.spend(filter, "substr(buy_items.purchased_at, 1, 7)", nil)
+	if err != nil || len(found) == 0 {
+		return found, err
+	}
+
+	months := map[string]SpendRow{}
+	for _, row := range found {
+		months[row.Group] = row
+	}
+	first, _ := time.Parse("2006-01", found[0].Group)
+	last, _ := time.Parse("2006-01", found[len(found)-1].Group)
+
+	rows := []SpendRow{}
+	for month := first; !month.After(last); month = month.AddDate(0, 1, 0) {
+		row, exists := months[month.Format("2006-01")]
+		if !exists {
+			row = SpendRow{Group: month.Format("2006-01")}
+		}
+		if len(rows) > 0 && rows[len(rows)-1].Spend > 0 {
+			previous := rows[len(rows)-1].Spend
+			change := math.Round((row.Spend-previous)/previous*10000) / 100
+			row.Change = &change
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// Spend by ingredient category.
+func (service *ReportService) Categories(filter ReportFilter) ([]SpendRow, error) {
+	return service.spend(filter, "coalesce(nullif(ingredients.category, ''), '"+Uncategorized+"')", nil)
+}
+
+// Spend by store, only of the items purchased with a price.
+func (service *ReportService) Stores(filter ReportFilter) ([]SpendRow, error) {
+	return service.spend(filter, "stores.name", func(query *gorm.DB) *gorm.DB {
+		return query.Joins("join stores on stores.id = price_observations.store_id")
+	})
+}
+
+// Ingredients purchased most often, at most limit of them.
+func (service *ReportService) Ingredients(filter ReportFilter, limit int) ([]IngredientUsage, error) {
+	rows := []IngredientUsage{}
+	result := filter.purchases(service.Database).
+		Select("ingredients.id as ingredient_id, ingredients.name as ingredient, ingredients.category, " +
+			"count(*) as purchases, sum(buy_items.quantity) as quantity, " +
+			"round(sum(" + itemSpend + "), 2) as spend, " +
+			"case when count(*) > 1 then round((julianday(max(buy_items.purchased_at)) - " +
+			"julianday(min(buy_items.purchased_at))) / (count(*) - 1), 1) end as average_interval").
+		Group("ingredients.id").
+		Order("purchases desc, ingredients.name").
+		Limit(limit).
+		Scan(&rows)
+
+	return rows, result.Error
+}
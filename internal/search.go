@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"gorm.io/gorm"
+)
+
+// ErrSearchUnavailable is returned when SQLite was built without FTS5, it
+// requires building with the sqlite_fts5 tag.
+var ErrSearchUnavailable = errors.New("Search is not available, SQLite was built without FTS5")
+
+// Set when the search tables were created, hooks only index records then.
+var searchEnabled atomic.Bool
+
+const (
+	highlightStart = "<mark>"
+	highlightEnd   = "</mark>"
+)
+
+// Full text tables of the searched records, each row has the id of the
+// record as rowid.
+var searchTables = []struct {
+	name    string
+	columns string
+	fill    string
+}{
+	{"buy_lists_fts", "title", "select id, title from buy_lists where deleted_at is null"},
+	{"buy_items_fts", "notes", "select id, notes from buy_items where deleted_at is null"},
+	{"ingredients_fts", "name, aliases", "select id, name, coalesce(aliases, '') from ingredients where deleted_at is null"},
+}
+
+// Create the full text search tables and index the records stored. Indexes
+// are built again on every start, so they have the changes made while search
+// was disabled. Search is disabled when SQLite doesn't have FTS5.
+func MigrateSearch(db *gorm.DB) error {
+	for _, table := range searchTables {
+		err := db.Exec(fmt.Sprintf("create virtual table if not exists %s using fts5(%s, tokenize = 'unicode61 remove_diacritics 2')", table.name, table.columns)).Error
+		if err == nil {
+			// tables created by a build with FTS5 exist even without the module
+			err = db.Exec(fmt.Sprintf("delete from %s", table.name)).Error
+		}
+		if err != nil && strings.Contains(err.Error(), "no such module") {
+			log.Printf("Full text search disabled: %v", err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = db.Exec(fmt.Sprintf("insert into %s(rowid, %s) %s", table.name, table.columns, table.fill)).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	searchEnabled.Store(true)
+	return nil
+}
+
+// Replace the indexed values of a record.
+func indexRecord(tx *gorm.DB, table string, id uint, columns string, values ...interface{}) error {
+	if !searchEnabled.Load() || id == 0 {
+		return nil
+	}
+
+	db := tx.Session(&gorm.Session{NewDB: true})
+	if err := db.Exec(fmt.Sprintf("delete from %s where rowid = ?", table), id).Error; err != nil {
+		return err
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	args := append([]interface{}{id}, values...)
+	return db.Exec(fmt.Sprintf("insert into %s(rowid, %s) values (?, %s)", table, columns, placeholders), args...).Error
+}
+
+func unindexRecord(tx *gorm.DB, table string, id uint) error {
+	if !searchEnabled.Load() || id == 0 {
+		return nil
+	}
+
+	return tx.Session(&gorm.Session{NewDB: true}).Exec(fmt.Sprintf("delete from %s where rowid = ?", table), id).Error
+}
+
+func (list *BuyList) AfterSave(tx *gorm.DB) error {
+	return indexRecord(tx, "buy_lists_fts", list.ID, "title", list.Title)
+}
+
+func (list *BuyList) AfterDelete(tx *gorm.DB) error {
+	return unindexRecord(tx, "buy_lists_fts", list.ID)
+}
+
+func (item *BuyItem) AfterSave(tx *gorm.DB) error {
+	return indexRecord(tx, "buy_items_fts", item.ID, "notes", item.Notes)
+}
+
+func (item *BuyItem) AfterDelete(tx *gorm.DB) error {
+	return unindexRecord(tx, "buy_items_fts", item.ID)
+}
+
+func (ingredient *Ingredient) AfterSave(tx *gorm.DB) error {
+	return indexRecord(tx, "ingredients_fts", ingredient.ID, "name, aliases", ingredient.Name, strings.Join(ingredient.Aliases, " "))
+}
+
+func (ingredient *Ingredient) AfterDelete(tx *gorm.DB) error {
+	return unindexRecord(tx, "ingredients_fts", ingredient.ID)
+}
+
+// SearchResult is a record matching the search. Highlight is the main text
+// of the record and Snippet the part that matched best, both with the
+// matched terms between <mark> tags. Lower Rank are better matches.
+type SearchResult struct {
+	ID        uint
+	BuyListID uint `json:",omitempty"`
+	Highlight string
+	Snippet   string
+	Rank      float64
+}
+
+// SearchResults are the records matching a search grouped by type, each
+// group sorted by rank.
+type SearchResults struct {
+	BuyLists    []SearchResult
+	Items       []SearchResult
+	Ingredients []SearchResult
+}
+
+type SearchService struct {
+	Database *gorm.DB
+}
+
+// Convert the text typed by the user on a FTS5 query where every word must
+// match the start of a word of the record. Words are quoted, so characters
+// of the FTS5 syntax are searched as text.
+func searchQuery(text string) string {
+	terms := []string{}
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, "\""+strings.ReplaceAll(word, "\"", "\"\"")+"\"*")
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// Search lists of the owner by title, their items by notes and ingredients
+// by name and aliases. Returns up to limit records of each type.
+func (service *SearchService) Search(text string, owner string, limit int) (SearchResults, error) {
+	results := SearchResults{BuyLists: []SearchResult{}, Items: []SearchResult{}, Ingredients: []SearchResult{}}
+	if !searchEnabled.Load() {
+		return results, ErrSearchUnavailable
+	}
+
+	query := searchQuery(text)
+	if query == "" {
+		return results, nil
+	}
+
+	marks := fmt.Sprintf("'%s', '%s'", highlightStart, highlightEnd)
+	result := service.Database.Raw(`
+		select buy_lists.id as id, highlight(buy_lists_fts, 0, `+marks+`) as highlight,
+			snippet(buy_lists_fts, 0, `+marks+`, '…', 12) as snippet, bm25(buy_lists_fts) as rank
+		from buy_lists_fts
+		join buy_lists on buy_lists.id = buy_lists_fts.rowid and buy_lists.deleted_at is null
+		where buy_lists_fts match ? and buy_lists.owner = ?
+		order by bm25(buy_lists_fts) limit ?`, query, owner, limit).Scan(&results.BuyLists)
+	if result.Error != nil {
+		return results, result.Error
+	}
+
+	// items are shown with the name of their ingredient, only items of lists
+	// not deleted are found
+	result = service.Database.Raw(`
+		select buy_items.id as id, buy_items.buy_list_id as buy_list_id,
+			coalesce(ingredients.name, '') as highlight,
+			snippet(buy_items_fts, 0, `+marks+`, '…', 12) as snippet, bm25(buy_items_fts) as rank
+		from buy_items_fts
+		join buy_items on buy_items.id = buy_items_fts.rowid and buy_items.deleted_at is null
+		join buy_lists on buy_lists.id = buy_items.buy_list_id and buy_lists.deleted_at is null
+		left join ingredients on ingredients.id = buy_items.ingredient_id
+		where buy_items_fts match ? and buy_lists.owner = ?
+		order by bm25(buy_items_fts) limit ?`, query, owner, limit).Scan(&results.Items)
+	if result.Error != nil {
+		return results, result.Error
+	}
+
+	// matches on name rank better than on aliases
+	result = service.Database.Raw(`
+		select ingredients.id as id, highlight(ingredients_fts, 0, `+marks+`) as highlight,
+			snippet(ingredients_fts, -1, `+marks+`, '…', 12) as snippet, bm25(ingredients_fts, 2.0, 1.0) as rank
+		from ingredients_fts
+		join ingredients on ingredients.id = ingredients_fts.rowid and ingredients.deleted_at is null
+		where ingredients_fts match ?
+		order by bm25(ingredients_fts, 2.0, 1.0) limit ?`, query, limit).Scan(&results.Ingredients)
+
+	return results, result.Error
+}
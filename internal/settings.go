@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"errors"
+	"net/mail"
+	"slices"
+
+	"gorm.io/gorm"
+)
+
+// UserSettings are the preferences of an user, identified by the subject
+// of its authentication token.
+type UserSettings struct {
+	gorm.Model
+	UserID           string `gorm:"uniqueIndex"`
+	Email            string
+	MonthlyBudget    float64 // grocery budget of a month, 0 for no budget
+	BudgetThresholds []int   `gorm:"serializer:json"` // percents of the budget that notify the user
+}
+
+var ErrInvalidEmail = errors.New("Email must be a valid address")
+
+type UserSettingsService struct {
+	Database *gorm.DB
+}
+
+// Get the settings of the user. If the user never saved settings returns
+// empty settings for it.
+func (service *UserSettingsService) Get(userID string) (UserSettings, error) {
+	settings := UserSettings{UserID: userID}
+	result := service.Database.Where("user_id = ?", userID).First(&settings)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return settings, nil
+	}
+
+	return settings, result.Error
+}
+
+func (service *UserSettingsService) Save(settings UserSettings) (UserSettings, error) {
+	if settings.MonthlyBudget < 0 || slices.ContainsFunc(settings.BudgetThresholds, func(threshold int) bool { return threshold <= 0 }) {
+		return settings, ErrInvalidBudget
+	}
+	if settings.Email != "" {
+		// only the address, notifications are sent to it as is
+		address, err := mail.ParseAddress(settings.Email)
+		if err != nil || address.Address != settings.Email {
+			return settings, ErrInvalidEmail
+		}
+	}
+
+	stored, err := service.Get(settings.UserID)
+	if err != nil {
+		return settings, err
+	}
+
+	settings.Model = stored.Model
+	result := service.Database.Save(&settings)
+	return settings, result.Error
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Copies of lists a user can email in shareWindow.
+const (
+	maxSharesPerWindow = 10
+	shareWindow        = 24 * time.Hour
+)
+
+// ErrShareLimit is returned when the user emailed too many copies of lists.
+var ErrShareLimit = errors.New("Too many lists emailed, try again later")
+
+// ListShare records a copy of a list emailed by its owner.
+type ListShare struct {
+	gorm.Model
+	BuyListID uint   `gorm:"index"`
+	Owner     string `gorm:"index"`
+	Recipient string
+}
+
+type ShareService struct {
+	Database *gorm.DB
+}
+
+// Record the copy of the list emailed to recipient. Returns ErrShareLimit
+// when the owner already emailed maxSharesPerWindow copies in shareWindow.
+func (service *ShareService) Record(list BuyList, recipient string) (ListShare, error) {
+	share := ListShare{BuyListID: list.ID, Owner: list.Owner, Recipient: recipient}
+	err := service.Database.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		result := tx.Model(&ListShare{}).
+			Where("owner = ? and created_at > ?", list.Owner, time.Now().Add(-shareWindow)).
+			Count(&count)
+		if result.Error != nil {
+			return result.Error
+		}
+		if count >= maxSharesPerWindow {
+			return ErrShareLimit
+		}
+
+		return tx.Create(&share).Error
+	})
+
+	return share, err
+}
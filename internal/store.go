@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Name of the route section with the items whose category isn't on any
+// aisle of the store.
+const UnsortedAisle = "unsorted"
+
+// Store is a store of a user with its aisles, only visible to its Owner.
+type Store struct {
+	gorm.Model
+	Owner  string  `gorm:"index"`
+	Name   string  `binding:"required"`
+	Aisles []Aisle // in walking order
+}
+
+// Aisle or section of a store with the ingredient categories found on it.
+type Aisle struct {
+	gorm.Model
+	StoreID    uint
+	Name       string   `binding:"required"`
+	Position   int      // walking order in the store
+	Categories []string `gorm:"serializer:json"`
+}
+
+// Group of items of a list found on the same aisle.
+type RouteSection struct {
+	Aisle   string
+	ItemIDs []uint
+}
+
+// ShoppingRoute is a list with its items sorted in the walking order of a
+// store, grouped by aisle. Items with a category that isn't mapped to an
+// aisle are on the last section, UnsortedAisle.
+type ShoppingRoute struct {
+	BuyList
+	Store    string
+	Sections []RouteSection
+}
+
+type StoreService struct {
+	Database *gorm.DB
+}
+
+func preloadAisles(db *gorm.DB) *gorm.DB {
+	return db.Order("position, id")
+}
+
+// Number the aisles in the order they were sent.
+func (store *Store) numberAisles() {
+	for i := range store.Aisles {
+		store.Aisles[i].Position = i
+	}
+}
+
+func (service *StoreService) Find(owner string) ([]Store, error) {
+	stores := []Store{}
+	result := service.Database.Preload("Aisles", preloadAisles).Where("owner = ?", owner).Find(&stores)
+
+	return stores, result.Error
+}
+
+// Get the store of the owner, stores of other users don't exist for it.
+func (service *StoreService) Get(owner string, ID uint64) (Store, error) {
+	var store Store
+	result := service.Database.Preload("Aisles", preloadAisles).Where("owner = ?", owner).First(&store, ID)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return store, errors.New("Store does not exists")
+	}
+
+	return store, result.Error
+}
+
+func (service *StoreService) Create(store Store) (Store, error) {
+	store.numberAisles()
+	result := service.Database.Create(&store)
+
+	return store, result.Error
+}
+
+// Update the store of store.Owner replacing its aisles by store.Aisles.
+func (service *StoreService) Update(store Store, ID uint64) (Store, error) {
+	stored, err := service.Get(store.Owner, ID)
+	if err != nil {
+		return store, err
+	}
+
+	store.ID = stored.ID
+	store.CreatedAt = stored.CreatedAt
+	store.numberAisles()
+	err = service.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Aisles").Save(&store).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("store_id = ?", store.ID).Delete(&Aisle{}).Error; err != nil {
+			return err
+		}
+		for i := range store.Aisles {
+			store.Aisles[i].ID = 0
+			store.Aisles[i].StoreID = store.ID
+		}
+		if len(store.Aisles) == 0 {
+			return nil
+		}
+
+		return tx.Create(&store.Aisles).Error
+	})
+
+	return store, err
+}
+
+func (service *StoreService) Delete(owner string, ID uint64) (Store, error) {
+	store, err := service.Get(owner, ID)
+	if err != nil {
+		return store, err
+	}
+
+	err = service.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("store_id = ?", store.ID).Delete(&Aisle{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(&store).Error
+	})
+
+	return store, err
+}
+
+// Route sorts the items of list, with their ingredients loaded, in the
+// walking order of store. Items on the same aisle keep the list order.
+func (store Store) Route(list BuyList) ShoppingRoute {
+	aisles := map[string]int{}
+	for i, aisle := range store.Aisles {
+		for _, category := range aisle.Categories {
+			key := strings.ToLower(strings.TrimSpace(category))
+			if _, exists := aisles[key]; !exists {
+				aisles[key] = i
+			}
+		}
+	}
+
+	unsorted := len(store.Aisles)
+	aisleOf := func(item BuyItem) int {
+		if aisle, exists := aisles[strings.ToLower(strings.TrimSpace(item.Ingredient.Category))]; exists {
+			return aisle
+		}
+		return unsorted
+	}
+	sort.SliceStable(list.Items, func(i, j int) bool {
+		return aisleOf(list.Items[i]) < aisleOf(list.Items[j])
+	})
+
+	route := ShoppingRoute{BuyList: list, Store: store.Name, Sections: []RouteSection{}}
+	last := -1
+	for _, item := range list.Items {
+		aisle := aisleOf(item)
+		if aisle != last {
+			name := UnsortedAisle
+			if aisle < unsorted {
+				name = store.Aisles[aisle].Name
+			}
+			route.Sections = append(route.Sections, RouteSection{Aisle: name})
+			last = aisle
+		}
+		section := &route.Sections[len(route.Sections)-1]
+		section.ItemIDs = append(section.ItemIDs, item.ID)
+	}
+
+	return route
+}
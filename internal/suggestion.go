@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Purchases older than this many intervals mean the ingredient isn't
+// bought anymore, the confidence of its suggestion decreases from there.
+const lapsedIntervals = 2.0
+
+// Suggestion is an ingredient the owner is probably running out of.
+// Interval is the typical number of days between its purchases and DueAt
+// the last purchase plus that interval. Confidence, from 0 to 1, grows with
+// the number of purchases and how regular they are.
+type Suggestion struct {
+	IngredientID uint
+	Ingredient   string
+	Category     string
+	Quantity     uint // typical quantity purchased
+	Purchases    int
+	LastPurchase time.Time
+	Interval     float64
+	DueAt        time.Time
+	Confidence   float64
+}
+
+type SuggestionService struct {
+	Database *gorm.DB
+	Events   *EventBus
+}
+
+type purchase struct {
+	IngredientID uint
+	Quantity     uint
+	PurchasedAt  time.Time
+}
+
+func median(values []float64) float64 {
+	sorted := slices.Clone(values)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[middle]
+	}
+	return (sorted[middle-1] + sorted[middle]) / 2
+}
+
+// Learn the repurchase interval of every ingredient purchased on lists of
+// owner and predict when each is due again. Needs at least two purchases on
+// different days of the ingredient.
+func (service *SuggestionService) predict(owner string, now time.Time) ([]Suggestion, error) {
+	var purchases []purchase
+	result := service.Database.Table("buy_items").
+		Select("buy_items.ingredient_id, buy_items.quantity, buy_items.purchased_at").
+		Joins("join buy_lists on buy_lists.id = buy_items.buy_list_id and buy_lists.deleted_at is null").
+		Where("buy_items.deleted_at is null and buy_items.purchased and buy_items.purchased_at is not null").
+		Where("buy_lists.owner = ?", owner).
+		Order("buy_items.purchased_at").
+		Scan(&purchases)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	byIngredient := map[uint][]purchase{}
+	for _, purchase := range purchases {
+		previous := byIngredient[purchase.IngredientID]
+		// purchases on the same day are the same restock
+		if len(previous) > 0 && sameDay(previous[len(previous)-1].PurchasedAt, purchase.PurchasedAt) {
+			previous[len(previous)-1].Quantity += purchase.Quantity
+			continue
+		}
+		byIngredient[purchase.IngredientID] = append(previous, purchase)
+	}
+
+	suggestions := []Suggestion{}
+	for ingredientID, history := range byIngredient {
+		if len(history) < 2 {
+			continue
+		}
+		suggestions = append(suggestions, suggest(ingredientID, history, now))
+	}
+	if err := service.describe(suggestions); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if !suggestions[i].DueAt.Equal(suggestions[j].DueAt) {
+			return suggestions[i].DueAt.Before(suggestions[j].DueAt)
+		}
+		return suggestions[i].IngredientID < suggestions[j].IngredientID
+	})
+	return suggestions, nil
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	a, b = a.Local(), b.Local()
+	return a.YearDay() == b.YearDay() && a.Year() == b.Year()
+}
+
+// Suggestion of an ingredient from its purchases, oldest first. The interval
+// is the median of the days between purchases, robust to a forgotten
+// restock. Confidence is the product of:
+//   - sample: n/(n+2) for n intervals, more purchases are more reliable;
+//   - regularity: 1/(1+cv), cv the coefficient of variation of the intervals;
+//   - freshness: decreases once the ingredient is lapsedIntervals overdue.
+func suggest(ingredientID uint, history []purchase, now time.Time) Suggestion {
+	intervals := []float64{}
+	quantities := []float64{}
+	for i, purchase := range history {
+		quantities = append(quantities, float64(purchase.Quantity))
+		if i > 0 {
+			intervals = append(intervals, purchase.PurchasedAt.Sub(history[i-1].PurchasedAt).Hours()/24)
+		}
+	}
+
+	last := history[len(history)-1].PurchasedAt
+	interval := median(intervals)
+	suggestion := Suggestion{
+		IngredientID: ingredientID,
+		Quantity:     uint(math.Round(median(quantities))),
+		Purchases:    len(history),
+		LastPurchase: last,
+		Interval:     math.Round(interval*10) / 10,
+		DueAt:        last.Add(time.Duration(interval * 24 * float64(time.Hour))),
+	}
+
+	n := float64(len(intervals))
+	mean := 0.0
+	for _, value := range intervals {
+		mean += value
+	}
+	mean /= n
+	variance := 0.0
+	for _, value := range intervals {
+		variance += (value - mean) * (value - mean)
+	}
+	cv := math.Sqrt(variance/n) / mean
+
+	sample := n / (n + 2)
+	regularity := 1 / (1 + cv)
+	freshness := 1.0
+	if elapsed := now.Sub(last).Hours() / 24 / interval; elapsed > lapsedIntervals {
+		freshness = lapsedIntervals / elapsed
+	}
+	suggestion.Confidence = math.Round(sample*regularity*freshness*100) / 100
+
+	return suggestion
+}
+
+// Fill the name and category of the ingredients of suggestions.
+func (service *SuggestionService) describe(suggestions []Suggestion) error {
+	ids := []uint{}
+	for _, suggestion := range suggestions {
+		ids = append(ids, suggestion.IngredientID)
+	}
+	var ingredients []Ingredient
+	if err := service.Database.Unscoped().Find(&ingredients, ids).Error; err != nil {
+		return err
+	}
+
+	byID := map[uint]Ingredient{}
+	for _, ingredient := range ingredients {
+		byID[ingredient.ID] = ingredient
+	}
+	for i := range suggestions {
+		suggestions[i].Ingredient = byID[suggestions[i].IngredientID].Name
+		suggestions[i].Category = byID[suggestions[i].IngredientID].Category
+	}
+
+	return nil
+}
+
+// Due returns the ingredients of owner due in the next days, with at least
+// minConfidence, that aren't pending on a list of owner.
+func (service *SuggestionService) Due(owner string, days int, minConfidence float64) ([]Suggestion, error) {
+	var pending []uint
+	result := service.Database.Model(&BuyItem{}).
+		Joins("join buy_lists on buy_lists.id = buy_items.buy_list_id and buy_lists.deleted_at is null").
+		Where("buy_lists.owner = ? and not buy_items.purchased", owner).
+		Distinct().
+		Pluck("buy_items.ingredient_id", &pending)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return service.due(owner, days, minConfidence, pending)
+}
+
+func (service *SuggestionService) due(owner string, days int, minConfidence float64, exclude []uint) ([]Suggestion, error) {
+	now := time.Now()
+	suggestions, err := service.predict(owner, now)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := map[uint]bool{}
+	for _, ID := range exclude {
+		excluded[ID] = true
+	}
+	horizon := now.AddDate(0, 0, days)
+	due := []Suggestion{}
+	for _, suggestion := range suggestions {
+		if suggestion.DueAt.After(horizon) || suggestion.Confidence < minConfidence || excluded[suggestion.IngredientID] {
+			continue
+		}
+		due = append(due, suggestion)
+	}
+
+	return due, nil
+}
+
+// Apply adds the ingredients due for the owner of the list, that aren't on
+// it yet, as items with their typical quantity. With ingredientIDs only
+// those of them are added. Returns the items added.
+func (service *SuggestionService) Apply(listID uint64, days int, minConfidence float64, ingredientIDs []uint) ([]BuyItem, error) {
+	var list BuyList
+	items := []BuyItem{}
+	err := service.Database.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if list, err = getList(tx, listID); err != nil {
+			return err
+		}
+
+		onList := []uint{}
+		for _, item := range list.Items {
+			onList = append(onList, uint(item.IngredientID))
+		}
+		learner := SuggestionService{Database: tx}
+		suggestions, err := learner.due(list.Owner, days, minConfidence, onList)
+		if err != nil {
+			return err
+		}
+
+		chosen := map[uint]bool{}
+		for _, ID := range ingredientIDs {
+			chosen[ID] = true
+		}
+		for _, suggestion := range suggestions {
+			if len(ingredientIDs) > 0 && !chosen[suggestion.IngredientID] {
+				continue
+			}
+
+			item := BuyItem{
+				IngredientID: int(suggestion.IngredientID),
+				Quantity:     suggestion.Quantity,
+				BuyListID:    int(list.ID),
+				Position:     list.nextPosition(),
+			}
+			if err := tx.Create(&item).Error; err != nil {
+				return err
+			}
+			tx.Preload("Ingredient").First(&item, item.ID)
+			list.Items = append(list.Items, item)
+			items = append(items, item)
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		return bumpListVersion(tx, list.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lists := BuyListService{Database: service.Database, Events: service.Events}
+	for _, item := range items {
+		lists.publish(EventItemAdded, list, item)
+	}
+
+	return items, nil
+}
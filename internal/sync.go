@@ -0,0 +1,335 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	SyncBuyList    = "buylist"
+	SyncItem       = "item"
+	SyncIngredient = "ingredient"
+
+	SyncCreate = "create"
+	SyncUpdate = "update"
+	SyncDelete = "delete"
+)
+
+// SyncChanges are the records changed since a cursor. Deleted records are
+// returned with DeletedAt set.
+type SyncChanges struct {
+	Cursor      string
+	BuyLists    []BuyList
+	BuyItems    []BuyItem
+	Ingredients []Ingredient
+}
+
+// SyncMutation is a change made by a client while offline. ID is generated
+// by the client and makes the mutation idempotent: a mutation sent twice is
+// applied only once.
+type SyncMutation struct {
+	ID              string `binding:"required"`
+	Entity          string `binding:"required,oneof=buylist item ingredient"`
+	Action          string `binding:"required,oneof=create update delete"`
+	EntityID        uint
+	ClientTimestamp time.Time `binding:"required"`
+	Data            json.RawMessage
+}
+
+// SyncResult is the outcome of a mutation. Conflict is set when the record
+// was changed on the server after the client change, in that case the
+// mutation is not applied and Server has the current record.
+type SyncResult struct {
+	ID       string
+	Applied  bool
+	Conflict bool
+	EntityID uint
+	Server   interface{} `json:",omitempty"`
+	Error    string      `json:",omitempty"`
+}
+
+// AppliedMutation stores results of mutations already applied, so they
+// are answered again when the client resends them.
+type AppliedMutation struct {
+	gorm.Model
+	UserID     string     `gorm:"uniqueIndex:idx_applied_mutation"`
+	MutationID string     `gorm:"uniqueIndex:idx_applied_mutation"`
+	Result     SyncResult `gorm:"serializer:json"`
+}
+
+type SyncService struct {
+	Database    *gorm.DB
+	BuyLists    *BuyListService
+	Ingredients *IngredientService
+}
+
+func EncodeSyncCursor(at time.Time) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(at.UTC().Format(time.RFC3339Nano)))
+}
+
+func DecodeSyncCursor(cursor string) (time.Time, error) {
+	if cursor == "" {
+		return time.Time{}, nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid sync cursor")
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, string(decoded))
+	if err != nil {
+		return time.Time{}, errors.New("Invalid sync cursor")
+	}
+
+	return at, nil
+}
+
+// Changes returns lists and items of the user and ingredients that were
+// created, updated or deleted since the time of the cursor.
+func (service *SyncService) Changes(userID string, since time.Time) (SyncChanges, error) {
+	// records changed while the changes are read are sent again on next sync
+	changes := SyncChanges{Cursor: EncodeSyncCursor(time.Now())}
+	changed := "(%s.updated_at >= ? or %s.deleted_at >= ?)"
+	// dates are stored on local time
+	since = since.Local()
+
+	result := service.Database.Unscoped().
+		Where("owner = ?", userID).
+		Where(fmt.Sprintf(changed, "buy_lists", "buy_lists"), since, since).
+		Find(&changes.BuyLists)
+	if result.Error != nil {
+		return changes, result.Error
+	}
+
+	result = service.Database.Unscoped().
+		Joins("join buy_lists on buy_lists.id = buy_items.buy_list_id").
+		Where("buy_lists.owner = ?", userID).
+		Where(fmt.Sprintf(changed, "buy_items", "buy_items"), since, since).
+		Find(&changes.BuyItems)
+	if result.Error != nil {
+		return changes, result.Error
+	}
+
+	result = service.Database.Unscoped().
+		Where(fmt.Sprintf(changed, "ingredients", "ingredients"), since, since).
+		Find(&changes.Ingredients)
+	return changes, result.Error
+}
+
+// Apply the mutations of the user in order. Mutations already applied
+// return the result of the first time they were applied.
+func (service *SyncService) Apply(userID string, mutations []SyncMutation) []SyncResult {
+	results := make([]SyncResult, len(mutations))
+	for i, mutation := range mutations {
+		// the mutation is claimed before being applied, the unique index
+		// keeps concurrent batches with it from applying it twice
+		applied := AppliedMutation{UserID: userID, MutationID: mutation.ID}
+		if err := service.Database.Create(&applied).Error; err != nil {
+			service.Database.Where("user_id = ? and mutation_id = ?", userID, mutation.ID).First(&applied)
+			switch {
+			case applied.ID == 0:
+				results[i] = SyncResult{ID: mutation.ID, Error: err.Error()}
+			case applied.Result.ID == "":
+				results[i] = SyncResult{ID: mutation.ID, Error: "Mutation is being applied, send it again later"}
+			default:
+				results[i] = applied.Result
+			}
+			continue
+		}
+
+		result, err := service.apply(userID, mutation)
+		result.ID = mutation.ID
+		if err != nil {
+			// failed mutations can be sent again
+			service.Database.Unscoped().Delete(&applied)
+			result.Error = err.Error()
+			results[i] = result
+			continue
+		}
+
+		applied.Result = result
+		service.Database.Model(&applied).Select("Result").Updates(&applied)
+		results[i] = result
+	}
+
+	return results
+}
+
+// Report a conflict when the record was changed on server after the client
+// made its change.
+func conflict(updatedAt time.Time, mutation SyncMutation, server interface{}) (SyncResult, bool) {
+	if updatedAt.After(mutation.ClientTimestamp) {
+		return SyncResult{Conflict: true, EntityID: mutation.EntityID, Server: server}, true
+	}
+	return SyncResult{}, false
+}
+
+func (service *SyncService) apply(userID string, mutation SyncMutation) (SyncResult, error) {
+	switch mutation.Entity {
+	case SyncBuyList:
+		return service.applyBuyList(userID, mutation)
+	case SyncItem:
+		return service.applyItem(userID, mutation)
+	case SyncIngredient:
+		return service.applyIngredient(userID, mutation)
+	}
+
+	return SyncResult{}, fmt.Errorf("Unknown entity %s", mutation.Entity)
+}
+
+func (service *SyncService) applyBuyList(userID string, mutation SyncMutation) (SyncResult, error) {
+	if mutation.Action == SyncCreate {
+		var list BuyList
+		if err := json.Unmarshal(mutation.Data, &list); err != nil {
+			return SyncResult{}, err
+		}
+		list.ID = 0
+		list.Owner = userID
+		list, err := service.BuyLists.Create(list)
+		return SyncResult{Applied: true, EntityID: list.ID, Server: list}, err
+	}
+
+	var stored BuyList
+	service.Database.Unscoped().Where("owner = ?", userID).First(&stored, mutation.EntityID)
+	if stored.ID == 0 {
+		return SyncResult{}, errors.New("List does not exists")
+	}
+	if stored.DeletedAt.Valid {
+		// list was deleted, deleting again changes nothing
+		return SyncResult{Applied: mutation.Action == SyncDelete, Conflict: mutation.Action != SyncDelete, EntityID: stored.ID, Server: stored}, nil
+	}
+	if result, isConflict := conflict(stored.UpdatedAt, mutation, stored); isConflict {
+		return result, nil
+	}
+
+	if mutation.Action == SyncDelete {
+		_, err := service.BuyLists.Delete(uint64(stored.ID), stored.Version)
+		return SyncResult{Applied: true, EntityID: stored.ID}, err
+	}
+
+	var changes struct {
+		Title        *string
+		ScheduledFor *time.Time
+	}
+	if err := json.Unmarshal(mutation.Data, &changes); err != nil {
+		return SyncResult{}, err
+	}
+	list, err := service.BuyLists.Get(uint64(stored.ID))
+	if err != nil {
+		return SyncResult{}, err
+	}
+	if changes.Title != nil {
+		list.Title = *changes.Title
+	}
+	if changes.ScheduledFor != nil {
+		list.ScheduledFor = changes.ScheduledFor
+	}
+	list, err = service.BuyLists.Update(list, uint64(list.ID))
+	return SyncResult{Applied: true, EntityID: list.ID, Server: list}, err
+}
+
+func (service *SyncService) applyItem(userID string, mutation SyncMutation) (SyncResult, error) {
+	if mutation.Action == SyncCreate {
+		var item BuyItem
+		if err := json.Unmarshal(mutation.Data, &item); err != nil {
+			return SyncResult{}, err
+		}
+		var list BuyList
+		service.Database.Where("owner = ?", userID).First(&list, item.BuyListID)
+		if list.ID == 0 {
+			return SyncResult{}, errors.New("List does not exists")
+		}
+		item, err := service.BuyLists.AddItem(uint64(list.ID), item)
+		return SyncResult{Applied: true, EntityID: item.ID, Server: item}, err
+	}
+
+	var stored BuyItem
+	service.Database.Unscoped().
+		Joins("join buy_lists on buy_lists.id = buy_items.buy_list_id").
+		Where("buy_lists.owner = ?", userID).
+		First(&stored, mutation.EntityID)
+	if stored.ID == 0 {
+		return SyncResult{}, errors.New("Item does not exists")
+	}
+	if stored.DeletedAt.Valid {
+		return SyncResult{Applied: mutation.Action == SyncDelete, Conflict: mutation.Action != SyncDelete, EntityID: stored.ID, Server: stored}, nil
+	}
+	if result, isConflict := conflict(stored.UpdatedAt, mutation, stored); isConflict {
+		return result, nil
+	}
+
+	listID, itemID := uint64(stored.BuyListID), uint64(stored.ID)
+	if mutation.Action == SyncDelete {
+		_, err := service.BuyLists.RemoveItem(listID, itemID)
+		return SyncResult{Applied: true, EntityID: stored.ID}, err
+	}
+
+	var changes struct {
+		Quantity  *uint
+		Purchased *bool
+	}
+	if err := json.Unmarshal(mutation.Data, &changes); err != nil {
+		return SyncResult{}, err
+	}
+	item := stored
+	var err error
+	if changes.Quantity != nil {
+		item, err = service.BuyLists.SetQuantity(listID, itemID, *changes.Quantity)
+		if err != nil {
+			return SyncResult{}, err
+		}
+	}
+	if changes.Purchased != nil {
+		item, err = service.BuyLists.SetPurchased(listID, itemID, *changes.Purchased)
+		if err != nil {
+			return SyncResult{}, err
+		}
+	}
+
+	return SyncResult{Applied: true, EntityID: item.ID, Server: item}, nil
+}
+
+func (service *SyncService) applyIngredient(userID string, mutation SyncMutation) (SyncResult, error) {
+	if mutation.Action == SyncCreate {
+		var ingredient Ingredient
+		if err := json.Unmarshal(mutation.Data, &ingredient); err != nil {
+			return SyncResult{}, err
+		}
+		ingredient.ID = 0
+		ingredient, err := service.Ingredients.Create(ingredient)
+		return SyncResult{Applied: true, EntityID: ingredient.ID, Server: ingredient}, err
+	}
+
+	var stored Ingredient
+	service.Database.Unscoped().First(&stored, mutation.EntityID)
+	if stored.ID == 0 {
+		return SyncResult{}, errors.New("Ingredient does not exists")
+	}
+	if stored.DeletedAt.Valid {
+		return SyncResult{Applied: mutation.Action == SyncDelete, Conflict: mutation.Action != SyncDelete, EntityID: stored.ID, Server: stored}, nil
+	}
+	if result, isConflict := conflict(stored.UpdatedAt, mutation, stored); isConflict {
+		return result, nil
+	}
+
+	if mutation.Action == SyncDelete {
+		_, err := service.Ingredients.Delete(stored.ID, stored.Version, userID)
+		return SyncResult{Applied: true, EntityID: stored.ID}, err
+	}
+
+	// only the fields sent are changed
+	ingredient := stored
+	if err := json.Unmarshal(mutation.Data, &ingredient); err != nil {
+		return SyncResult{}, err
+	}
+	ingredient.Model = stored.Model
+	ingredient.Version = stored.Version
+	ingredient, err := service.Ingredients.Update(ingredient, stored.ID)
+	return SyncResult{Applied: true, EntityID: ingredient.ID, Server: ingredient}, err
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	TrashBuyList    = "buylist"
+	TrashIngredient = "ingredient"
+)
+
+// Trash has the deleted lists of a user and the ingredients it deleted, the
+// most recently deleted first.
+type Trash struct {
+	BuyLists    []BuyList
+	Ingredients []Ingredient
+}
+
+// TrashService finds, restores and purges records soft deleted.
+type TrashService struct {
+	Database *gorm.DB
+	Events   *EventBus
+}
+
+func (service *TrashService) Find(owner string) (Trash, error) {
+	trash := Trash{BuyLists: []BuyList{}, Ingredients: []Ingredient{}}
+	result := service.Database.Unscoped().
+		Where("owner = ? and deleted_at is not null", owner).
+		Order("deleted_at desc").
+		Find(&trash.BuyLists)
+	if result.Error != nil {
+		return trash, result.Error
+	}
+
+	result = service.Database.Unscoped().
+		Where("deleted_by = ? and deleted_at is not null", owner).
+		Order("deleted_at desc").
+		Find(&trash.Ingredients)
+	return trash, result.Error
+}
+
+func (service *TrashService) getBuyList(owner string, ID uint) (BuyList, error) {
+	var list BuyList
+	service.Database.Unscoped().Where("owner = ? and deleted_at is not null", owner).First(&list, ID)
+	if list.ID == 0 {
+		return list, errors.New("List does not exists on trash")
+	}
+
+	return list, nil
+}
+
+// Ingredients are shared, so only the user that deleted one can find it on
+// the trash.
+func (service *TrashService) getIngredient(owner string, ID uint) (Ingredient, error) {
+	var ingredient Ingredient
+	service.Database.Unscoped().Where("deleted_by = ? and deleted_at is not null", owner).First(&ingredient, ID)
+	if ingredient.ID == 0 {
+		return ingredient, errors.New("Ingredient does not exists on trash")
+	}
+
+	return ingredient, nil
+}
+
+// Restore a list with the items deleted with it. Items removed from the list
+// before it was deleted stay deleted. Reminders are kept while the list is on
+// the trash and sent after it is restored, except the ones that came due
+// meanwhile, which are dropped.
+func (service *TrashService) RestoreBuyList(owner string, ID uint) (BuyList, error) {
+	list, err := service.getBuyList(owner, ID)
+	if err != nil {
+		return list, err
+	}
+
+	err = service.Database.Transaction(func(tx *gorm.DB) error {
+		var items []BuyItem
+		tx.Unscoped().Where("buy_list_id = ? and deleted_at >= ?", ID, list.DeletedAt.Time).Find(&items)
+		for i := range items {
+			// updates one by one so hooks index them again
+			if err := tx.Unscoped().Model(&items[i]).Update("deleted_at", nil).Error; err != nil {
+				return err
+			}
+		}
+
+		err := tx.Unscoped().Where("buy_list_id = ? and sent_at is null and fire_at < ?", ID, time.Now()).Delete(&Reminder{}).Error
+		if err != nil {
+			return err
+		}
+		// reminders removed while the list was on the trash
+		err = tx.Unscoped().Model(&Reminder{}).Where("buy_list_id = ? and deleted_at is not null", ID).Update("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Model(&list).Update("deleted_at", nil).Error
+	})
+	if err != nil {
+		return list, err
+	}
+
+	buyLists := BuyListService{Database: service.Database}
+	list, err = buyLists.Get(uint64(ID))
+	if err == nil {
+		service.Events.Publish(Event{Type: EventBuyListRestored, Owner: list.Owner, BuyListID: list.ID, Data: list})
+	}
+
+	return list, err
+}
+
+func (service *TrashService) RestoreIngredient(owner string, ID uint) (Ingredient, error) {
+	ingredient, err := service.getIngredient(owner, ID)
+	if err != nil {
+		return ingredient, err
+	}
+
+	ingredient.DeletedBy = ""
+	result := service.Database.Unscoped().Model(&ingredient).Updates(map[string]interface{}{"deleted_at": nil, "deleted_by": ""})
+	if result.Error == nil {
+		service.Events.Publish(Event{Type: EventIngredientRestored, Data: ingredient})
+	}
+
+	return ingredient, result.Error
+}
+
+// Permanently delete a list on the trash, with its items and reminders.
+func (service *TrashService) PurgeBuyList(owner string, ID uint) (BuyList, error) {
+	list, err := service.getBuyList(owner, ID)
+	if err != nil {
+		return list, err
+	}
+
+	return list, service.Database.Transaction(func(tx *gorm.DB) error {
+		return purgeBuyList(tx, list)
+	})
+}
+
+func purgeBuyList(tx *gorm.DB, list BuyList) error {
+	var items []BuyItem
+	tx.Unscoped().Where("buy_list_id = ?", list.ID).Find(&items)
+	for i := range items {
+		// deletes one by one so hooks remove them from the search index
+		if err := tx.Unscoped().Delete(&items[i]).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Unscoped().Where("buy_list_id = ?", list.ID).Delete(&Reminder{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Unscoped().Delete(&list).Error
+}
+
+// Permanently delete an ingredient on the trash. Ingredients still used by
+// items can't be purged.
+func (service *TrashService) PurgeIngredient(owner string, ID uint) (Ingredient, error) {
+	ingredient, err := service.getIngredient(owner, ID)
+	if err != nil {
+		return ingredient, err
+	}
+
+	return ingredient, service.Database.Transaction(func(tx *gorm.DB) error {
+		return purgeIngredient(tx, ingredient)
+	})
+}
+
+// ErrIngredientInUse is returned when purging an ingredient used by items.
+var ErrIngredientInUse = errors.New("Ingredient is used by items of lists")
+
+func purgeIngredient(tx *gorm.DB, ingredient Ingredient) error {
+	var count int64
+	tx.Unscoped().Model(&BuyItem{}).Where("ingredient_id = ?", ingredient.ID).Count(&count)
+	if count > 0 {
+		return ErrIngredientInUse
+	}
+	if err := tx.Unscoped().Where("ingredient_id = ?", ingredient.ID).Delete(&PriceObservation{}).Error; err != nil {
+		return err
+	}
+
+	return tx.Unscoped().Delete(&ingredient).Error
+}
+
+// Permanently delete the lists and ingredients deleted before the date.
+// Returns how many records were purged.
+func (service *TrashService) PurgeDeletedBefore(before time.Time) (int, error) {
+	purged := 0
+
+	var lists []BuyList
+	result := service.Database.Unscoped().Where("deleted_at < ?", before).Find(&lists)
+	if result.Error != nil {
+		return purged, result.Error
+	}
+	for _, list := range lists {
+		err := service.Database.Transaction(func(tx *gorm.DB) error {
+			return purgeBuyList(tx, list)
+		})
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	// purged after the lists, so ingredients used only by them can be purged too
+	var ingredients []Ingredient
+	result = service.Database.Unscoped().Where("deleted_at < ?", before).Find(&ingredients)
+	if result.Error != nil {
+		return purged, result.Error
+	}
+	for _, ingredient := range ingredients {
+		err := service.Database.Transaction(func(tx *gorm.DB) error {
+			return purgeIngredient(tx, ingredient)
+		})
+		if errors.Is(err, ErrIngredientInUse) {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// TrashCollector purges records kept on the trash longer than Retention.
+type TrashCollector struct {
+	Service   *TrashService
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+// Run purges expired records every Interval until ctx is done.
+func (collector *TrashCollector) Run(ctx context.Context) {
+	interval := collector.Interval
+	if interval == 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := collector.Service.PurgeDeletedBefore(time.Now().Add(-collector.Retention))
+		if err != nil {
+			log.Printf("Error purging trash: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d records from trash", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
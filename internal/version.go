@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// ErrVersionConflict is returned when a record was changed after the version
+// the change was based on.
+var ErrVersionConflict = errors.New("Resource was changed by another request")
+
+// Compare and swap the version of the record: the stored version must be
+// version and is increased by one. Version 0 accepts any stored version.
+// Returns the new version of the record.
+func swapVersion(tx *gorm.DB, model interface{}, ID uint64, version uint) (uint, error) {
+	if version == 0 {
+		if err := tx.Model(model).Select("version").Where("id = ?", ID).Scan(&version).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	result := tx.Model(model).Where("id = ? and version = ?", ID, version).UpdateColumn("version", version+1)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, ErrVersionConflict
+	}
+
+	return version + 1, nil
+}
+
+// Increase the version of the list after a change on its items.
+func bumpListVersion(tx *gorm.DB, listID uint) error {
+	return tx.Model(&BuyList{}).Where("id = ?", listID).UpdateColumn("version", gorm.Expr("version + 1")).Error
+}
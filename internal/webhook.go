@@ -0,0 +1,389 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Webhook is an URL of an user that receives the events it subscribed to.
+// Deliveries are signed with Secret using HMAC-SHA256, it is only shown
+// when the webhook is created.
+type Webhook struct {
+	gorm.Model
+	UserID string   `gorm:"index"`
+	URL    string   `binding:"required,url"`
+	Events []string `gorm:"serializer:json" binding:"required,min=1"`
+	Secret string   `json:"-"`
+	Active bool
+}
+
+// Subscribed reports if the webhook wants to receive the event type.
+// Events of the shared ingredients catalog are only sent to the webhooks
+// that subscribed to their type, not to the ones subscribed to *.
+func (webhook Webhook) Subscribed(eventType string) bool {
+	if sharedEvent(eventType) {
+		return slices.Contains(webhook.Events, eventType)
+	}
+	return slices.Contains(webhook.Events, eventType) || slices.Contains(webhook.Events, "*")
+}
+
+// Events of records shared by every user, they have no owner.
+func sharedEvent(eventType string) bool {
+	return strings.HasPrefix(eventType, "ingredient.")
+}
+
+// WebhookDelivery is an event sent to a webhook. Failed deliveries are
+// retried with exponential backoff.
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookID     uint `gorm:"index"`
+	EventID       string
+	EventType     string
+	Payload       string
+	Attempts      []WebhookAttempt
+	AttemptCount  uint
+	NextAttemptAt *time.Time
+	DeliveredAt   *time.Time
+}
+
+// WebhookAttempt is the log of a request made to deliver an event.
+type WebhookAttempt struct {
+	gorm.Model
+	WebhookDeliveryID uint
+	StatusCode        int
+	Error             string
+	Duration          time.Duration
+}
+
+// ErrWebhookTarget is returned for webhook URLs that aren't http or https or
+// reach the network of the server.
+var ErrWebhookTarget = errors.New("Webhook URL must be http or https to a public address")
+
+// Webhooks can't reach loopback, link-local or private addresses, unless
+// WEBHOOK_ALLOW_PRIVATE is true, as on development.
+func allowPrivateWebhooks() bool {
+	allow, _ := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE"))
+	return allow
+}
+
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsMulticast() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// Check that the URL is http or https and its host resolves only to public
+// addresses. Addresses are checked again when delivering, since DNS can change.
+func validateWebhookURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return ErrWebhookTarget
+	}
+	if allowPrivateWebhooks() {
+		return nil
+	}
+
+	ips, err := net.LookupIP(parsed.Hostname())
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrWebhookTarget, err)
+	}
+	for _, ip := range ips {
+		if !publicAddress(ip) {
+			return ErrWebhookTarget
+		}
+	}
+	return nil
+}
+
+// Client of the deliveries, it refuses to connect to addresses that aren't
+// public, even after redirects. Connections aren't reused, so the address
+// of each delivery is checked.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network string, address string, _ syscall.RawConn) error {
+				if allowPrivateWebhooks() {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+					return ErrWebhookTarget
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// WebhookDispatcher delivers events published on EventBus to the webhooks
+// subscribed to them.
+type WebhookDispatcher struct {
+	Database    *gorm.DB
+	Client      *http.Client
+	MaxAttempts uint
+	Backoff     time.Duration
+}
+
+// Dispatch creates a delivery of the event for each webhook subscribed to
+// it and sends them.
+func (dispatcher *WebhookDispatcher) Dispatch(event Event) {
+	webhooks := []Webhook{}
+	query := dispatcher.Database.Where("active = ?", true)
+	if event.Owner != "" {
+		query = query.Where("user_id = ?", event.Owner)
+	} else if !sharedEvent(event.Type) {
+		// records without owner are not visible to any webhook
+		return
+	}
+	if err := query.Find(&webhooks).Error; err != nil {
+		log.Printf("Error finding webhooks of event %s: %v", event.ID, err)
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event %s: %v", event.ID, err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.Subscribed(event.Type) {
+			continue
+		}
+
+		// if the first attempt is interrupted the delivery is retried later
+		retryAt := time.Now().Add(dispatcher.backoff())
+		delivery := WebhookDelivery{
+			WebhookID:     webhook.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Payload:       string(payload),
+			NextAttemptAt: &retryAt,
+		}
+		if err := dispatcher.Database.Create(&delivery).Error; err != nil {
+			log.Printf("Error creating delivery of event %s: %v", event.ID, err)
+			continue
+		}
+
+		go dispatcher.deliver(webhook, &delivery)
+	}
+}
+
+// Run retries failed deliveries every interval until ctx is done.
+func (dispatcher *WebhookDispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := dispatcher.RetryDue(time.Now()); err != nil {
+			log.Printf("Error retrying webhook deliveries: %v", err)
+		}
+	}
+}
+
+// RetryDue sends again every failed delivery whose next attempt is due.
+func (dispatcher *WebhookDispatcher) RetryDue(now time.Time) error {
+	deliveries := []WebhookDelivery{}
+	result := dispatcher.Database.
+		Where("delivered_at is null and next_attempt_at <= ?", now).
+		Find(&deliveries)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	for i := range deliveries {
+		var webhook Webhook
+		dispatcher.Database.First(&webhook, deliveries[i].WebhookID)
+		if webhook.ID == 0 || !webhook.Active {
+			continue
+		}
+		dispatcher.deliver(webhook, &deliveries[i])
+	}
+
+	return nil
+}
+
+// Redeliver sends a past delivery again, even if it was delivered before.
+func (dispatcher *WebhookDispatcher) Redeliver(webhook Webhook, deliveryID uint64) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	dispatcher.Database.Where("webhook_id = ?", webhook.ID).First(&delivery, deliveryID)
+	if delivery.ID == 0 {
+		return delivery, errors.New("Delivery does not exists")
+	}
+
+	dispatcher.deliver(webhook, &delivery)
+	err := dispatcher.Database.Preload("Attempts").First(&delivery, delivery.ID).Error
+	return delivery, err
+}
+
+// Sign the payload with the webhook secret, receivers must compare it with
+// the X-Buylist-Signature header.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send the delivery to the webhook, logging the attempt.
+func (dispatcher *WebhookDispatcher) deliver(webhook Webhook, delivery *WebhookDelivery) {
+	client := dispatcher.Client
+	if client == nil {
+		client = webhookClient
+	}
+
+	attempt := WebhookAttempt{WebhookDeliveryID: delivery.ID}
+	start := time.Now()
+	err := func() error {
+		req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewBufferString(delivery.Payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Buylist-Event", delivery.EventType)
+		req.Header.Set("X-Buylist-Delivery", fmt.Sprint(delivery.ID))
+		req.Header.Set("X-Buylist-Signature", SignWebhookPayload(webhook.Secret, []byte(delivery.Payload)))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		attempt.StatusCode = resp.StatusCode
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("Webhook answered with status %d", resp.StatusCode)
+		}
+		return nil
+	}()
+	attempt.Duration = time.Since(start)
+
+	delivery.AttemptCount++
+	if err != nil {
+		attempt.Error = err.Error()
+		delivery.NextAttemptAt = nil
+		if delivery.AttemptCount < dispatcher.maxAttempts() {
+			next := time.Now().Add(dispatcher.backoff() << (delivery.AttemptCount - 1))
+			delivery.NextAttemptAt = &next
+		}
+	} else {
+		deliveredAt := time.Now()
+		delivery.DeliveredAt = &deliveredAt
+		delivery.NextAttemptAt = nil
+	}
+
+	dispatcher.Database.Create(&attempt)
+	dispatcher.Database.Model(delivery).Select("AttemptCount", "NextAttemptAt", "DeliveredAt").Updates(delivery)
+}
+
+func (dispatcher *WebhookDispatcher) backoff() time.Duration {
+	if dispatcher.Backoff == 0 {
+		return 30 * time.Second
+	}
+	return dispatcher.Backoff
+}
+
+func (dispatcher *WebhookDispatcher) maxAttempts() uint {
+	if dispatcher.MaxAttempts == 0 {
+		return 6
+	}
+	return dispatcher.MaxAttempts
+}
+
+type WebhookService struct {
+	Database *gorm.DB
+}
+
+func (service *WebhookService) Find(userID string) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	result := service.Database.Where("user_id = ?", userID).Find(&webhooks)
+	return webhooks, result.Error
+}
+
+func (service *WebhookService) Get(userID string, ID uint64) (Webhook, error) {
+	var webhook Webhook
+	service.Database.Where("user_id = ?", userID).First(&webhook, ID)
+	if webhook.ID == 0 {
+		return webhook, errors.New("Webhook does not exists")
+	}
+
+	return webhook, nil
+}
+
+// Create the webhook, generating its secret when none was given. The URL
+// must be http or https to a public address.
+func (service *WebhookService) Create(webhook Webhook) (Webhook, error) {
+	if err := validateWebhookURL(webhook.URL); err != nil {
+		return webhook, err
+	}
+	for _, eventType := range webhook.Events {
+		if eventType != "*" && !slices.Contains(EventTypes, eventType) {
+			return webhook, fmt.Errorf("Unknown event type %s", eventType)
+		}
+	}
+
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return webhook, err
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	webhook.ID = 0
+	webhook.Active = true
+	result := service.Database.Create(&webhook)
+	return webhook, result.Error
+}
+
+func (service *WebhookService) Delete(userID string, ID uint64) (Webhook, error) {
+	webhook, err := service.Get(userID, ID)
+	if err != nil {
+		return webhook, err
+	}
+
+	result := service.Database.Delete(&webhook)
+	return webhook, result.Error
+}
+
+// Deliveries of the webhook, most recent first, with their attempts.
+func (service *WebhookService) Deliveries(webhook Webhook, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	result := service.Database.
+		Preload("Attempts").
+		Where("webhook_id = ?", webhook.ID).
+		Order("id desc").
+		Limit(limit).
+		Find(&deliveries)
+	return deliveries, result.Error
+}
@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	WhatsAppStatusSent      = "sent"
+	WhatsAppStatusDelivered = "delivered"
+	WhatsAppStatusRead      = "read"
+	WhatsAppStatusFailed    = "failed"
+)
+
+// Wrong codes accepted before the verification code is invalidated. The
+// attempts are kept when a new code is requested in verificationWindow.
+const maxVerificationAttempts = 5
+
+// Codes that can be requested in verificationWindow by user and by number.
+const (
+	maxVerificationRequests = 3
+	verificationWindow      = time.Hour
+)
+
+const whatsAppVerification = "phone_verification"
+
+// ErrVerificationLimit is returned when too many codes were requested or
+// too many wrong codes were tried in verificationWindow.
+var ErrVerificationLimit = errors.New("Too many verification codes requested, try again later")
+
+// PhoneNumber is the number an user opted in to receive WhatsApp
+// notifications. Notifications are only sent after the number is verified
+// with the code sent to it.
+type PhoneNumber struct {
+	gorm.Model
+	UserID           string `gorm:"uniqueIndex"`
+	Number           string
+	VerificationCode string `json:"-"`
+	CodeExpiresAt    time.Time
+	CodeAttempts     uint `json:"-"`
+	VerifiedAt       *time.Time
+}
+
+// WhatsAppMessage is a message sent to the provider, its Status is updated by
+// the delivery callbacks of the provider.
+type WhatsAppMessage struct {
+	gorm.Model
+	Kind              string
+	UserID            string `gorm:"index"` // user that requested a verification code
+	BuyListID         uint
+	To                string
+	Body              string
+	ProviderMessageID string `gorm:"index"`
+	Status            string
+	StatusUpdatedAt   time.Time
+	Error             string
+}
+
+// WhatsAppNotifier sends notifications to the verified phone of the list
+// owner through an HTTP endpoint compatible with WhatsApp Business API.
+type WhatsAppNotifier struct {
+	Database *gorm.DB
+	Endpoint string
+	Token    string
+	Client   *http.Client
+}
+
+// Create a WhatsAppNotifier configured by WHATSAPP_* environment variables.
+func NewWhatsAppNotifier(db *gorm.DB) *WhatsAppNotifier {
+	return &WhatsAppNotifier{
+		Database: db,
+		Endpoint: os.Getenv("WHATSAPP_ENDPOINT"),
+		Token:    os.Getenv("WHATSAPP_TOKEN"),
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (notifier *WhatsAppNotifier) Notify(ctx context.Context, notification Notification) error {
+	if notification.Recipient != "" {
+		// invites are sent to an email address
+		return nil
+	}
+
+	var phone PhoneNumber
+	result := notifier.Database.Where("user_id = ? and verified_at is not null", notification.Owner).First(&phone)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+
+	message := WhatsAppMessage{
+		Kind:      notification.Kind,
+		BuyListID: notification.BuyList.ID,
+		To:        phone.Number,
+		Body:      FormatWhatsAppMessage(notification),
+	}
+
+	return notifier.send(ctx, &message)
+}
+
+func (notifier *WhatsAppNotifier) Channel() string {
+	return "whatsapp"
+}
+
+// Send a new verification code to the phone number of the user. Returns
+// ErrVerificationLimit when the user or the number requested
+// maxVerificationRequests codes, or the user tried maxVerificationAttempts
+// wrong codes, in verificationWindow.
+func (notifier *WhatsAppNotifier) RequestVerification(ctx context.Context, userID string, number string) (PhoneNumber, error) {
+	var phone PhoneNumber
+	result := notifier.Database.Where("user_id = ?", userID).First(&phone)
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return phone, result.Error
+	}
+
+	since := time.Now().Add(-verificationWindow)
+	for column, value := range map[string]string{"user_id": userID, "to": number} {
+		var requests int64
+		result = notifier.Database.Model(&WhatsAppMessage{}).
+			Where("kind = ? and created_at > ?", whatsAppVerification, since).
+			Where(map[string]interface{}{column: value}).
+			Count(&requests)
+		if result.Error != nil {
+			return phone, result.Error
+		}
+		if requests >= maxVerificationRequests {
+			return phone, ErrVerificationLimit
+		}
+	}
+	// wrong attempts on recent codes carry over to the new one
+	if phone.CodeExpiresAt.Before(since) {
+		phone.CodeAttempts = 0
+	}
+	if phone.CodeAttempts >= maxVerificationAttempts {
+		return phone, ErrVerificationLimit
+	}
+
+	code, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return phone, err
+	}
+
+	phone.UserID = userID
+	phone.Number = number
+	phone.VerificationCode = fmt.Sprintf("%06d", code.Int64())
+	phone.CodeExpiresAt = time.Now().Add(10 * time.Minute)
+	phone.VerifiedAt = nil
+	result = notifier.Database.Save(&phone)
+	if result.Error != nil {
+		return phone, result.Error
+	}
+
+	message := WhatsAppMessage{
+		Kind:   whatsAppVerification,
+		UserID: userID,
+		To:     number,
+		Body:   fmt.Sprintf("Your buy list verification code is *%s*", phone.VerificationCode),
+	}
+
+	return phone, notifier.send(ctx, &message)
+}
+
+// Verify the phone number of the user with the code sent to it. After
+// maxVerificationAttempts wrong codes the code is invalidated and a new one
+// must be requested.
+func (notifier *WhatsAppNotifier) Verify(userID string, code string) (PhoneNumber, error) {
+	var phone PhoneNumber
+	notifier.Database.Where("user_id = ?", userID).First(&phone)
+	if phone.ID == 0 {
+		return phone, errors.New("Phone number was not registered")
+	}
+
+	if phone.VerificationCode == "" || time.Now().After(phone.CodeExpiresAt) {
+		return phone, errors.New("Invalid or expired verification code")
+	}
+	if subtle.ConstantTimeCompare([]byte(phone.VerificationCode), []byte(code)) != 1 {
+		phone.CodeAttempts++
+		if phone.CodeAttempts >= maxVerificationAttempts {
+			phone.VerificationCode = ""
+		}
+		if result := notifier.Database.Select("CodeAttempts", "VerificationCode").Updates(&phone); result.Error != nil {
+			return phone, result.Error
+		}
+		return phone, errors.New("Invalid or expired verification code")
+	}
+
+	verifiedAt := time.Now()
+	phone.VerifiedAt = &verifiedAt
+	phone.VerificationCode = ""
+	phone.CodeAttempts = 0
+	result := notifier.Database.Save(&phone)
+	return phone, result.Error
+}
+
+// Remove the phone number of the user, opting out of notifications.
+func (notifier *WhatsAppNotifier) OptOut(userID string) error {
+	return notifier.Database.Unscoped().Where("user_id = ?", userID).Delete(&PhoneNumber{}).Error
+}
+
+// UpdateStatus stores the delivery status reported by the provider for a message.
+// Statuses of unknown messages are ignored.
+func (notifier *WhatsAppNotifier) UpdateStatus(providerMessageID string, status string, updatedAt time.Time) error {
+	return notifier.Database.Model(&WhatsAppMessage{}).
+		Where("provider_message_id = ?", providerMessageID).
+		Updates(map[string]interface{}{"status": status, "status_updated_at": updatedAt}).Error
+}
+
+type whatsAppTextRequest struct {
+	MessagingProduct string `json:"messaging_product"`
+	To               string `json:"to"`
+	Type             string `json:"type"`
+	Text             struct {
+		Body string `json:"body"`
+	} `json:"text"`
+}
+
+type whatsAppTextResponse struct {
+	Messages []struct {
+		ID string `json:"id"`
+	} `json:"messages"`
+}
+
+// Post the message to the provider and store it with the result.
+func (notifier *WhatsAppNotifier) send(ctx context.Context, message *WhatsAppMessage) error {
+	payload := whatsAppTextRequest{MessagingProduct: "whatsapp", To: message.To, Type: "text"}
+	payload.Text.Body = message.Body
+	body, _ := json.Marshal(payload)
+
+	err := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, notifier.Endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if notifier.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+notifier.Token)
+		}
+
+		client := notifier.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("WhatsApp provider answered with status %d", resp.StatusCode)
+		}
+
+		var response whatsAppTextResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		if len(response.Messages) > 0 {
+			message.ProviderMessageID = response.Messages[0].ID
+		}
+		return nil
+	}()
+
+	message.Status = WhatsAppStatusSent
+	message.StatusUpdatedAt = time.Now()
+	if err != nil {
+		message.Status = WhatsAppStatusFailed
+		message.Error = err.Error()
+	}
+
+	if result := notifier.Database.Create(message); result.Error != nil {
+		return result.Error
+	}
+
+	return err
+}
+
+// Format the list of the notification as WhatsApp text, using its markup for
+// bold and italic text.
+func FormatWhatsAppMessage(notification Notification) string {
+	var text strings.Builder
+	list := notification.BuyList
+
+	if notification.Kind == NotificationReminder {
+		text.WriteString("⏰ Reminder: ")
+	}
+	fmt.Fprintf(&text, "*%s*\n", list.Title)
+	if list.ScheduledFor != nil {
+		fmt.Fprintf(&text, "_%s_\n", list.ScheduledFor.Format("02/01/2006 15:04"))
+	}
+
+	for _, group := range GroupItemsByCategory(list.Items) {
+		fmt.Fprintf(&text, "\n*%s*\n", group.Category)
+		for _, item := range group.Items {
+			fmt.Fprintf(&text, "☐ %d x %s\n", item.Quantity, item.Ingredient.Name)
+		}
+	}
+
+	return text.String()
+}
@@ -4,8 +4,13 @@ import (
 	server "buylist/api"
 	"buylist/api/auth"
 	_ "buylist/docs"
+	"buylist/internal"
 	"buylist/internal/database"
+	"context"
 	"log"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -44,7 +49,47 @@ func main() {
 	if err != nil {
 		panic("Error setting up Authenticathor")
 	}
-	app := server.GetRouter(db, auth)
+
+	notifiers := internal.MultiNotifier{internal.LogNotifier{}}
+	if os.Getenv("SMTP_HOST") != "" {
+		emailNotifier := internal.NewEmailNotifier(db)
+		go emailNotifier.Run(context.Background(), time.Minute)
+		notifiers = append(notifiers, emailNotifier)
+	}
+
+	var whatsapp *internal.WhatsAppNotifier
+	if os.Getenv("WHATSAPP_ENDPOINT") != "" {
+		whatsapp = internal.NewWhatsAppNotifier(db)
+		notifiers = append(notifiers, whatsapp)
+	}
+
+	app := server.GetRouter(db, auth, notifiers, whatsapp)
+
+	scheduler := internal.ReminderScheduler{
+		Database: db,
+		Notifier: notifiers,
+		Interval: time.Minute,
+	}
+	go scheduler.Run(context.Background())
+
+	webhooks := internal.WebhookDispatcher{Database: db}
+	go webhooks.Run(context.Background(), 30*time.Second)
+
+	// deleted records are kept on trash for TRASH_RETENTION_DAYS, 30 by default
+	retentionDays := 30
+	if days := os.Getenv("TRASH_RETENTION_DAYS"); days != "" {
+		retentionDays, err = strconv.Atoi(days)
+		if err != nil {
+			panic("Invalid TRASH_RETENTION_DAYS")
+		}
+	}
+	if retentionDays > 0 {
+		trash := internal.TrashCollector{
+			Service:   &internal.TrashService{Database: db},
+			Retention: time.Duration(retentionDays) * 24 * time.Hour,
+		}
+		go trash.Run(context.Background())
+	}
 
 	app.Run() // run on default port 8080
 }